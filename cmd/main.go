@@ -2,22 +2,36 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"gochat-server/internal/config"
 	"gochat-server/internal/database"
 	"gochat-server/internal/handlers"
+	"gochat-server/internal/health"
 	"gochat-server/internal/hub"
+	"gochat-server/internal/mailer"
+	"gochat-server/internal/metrics"
+	"gochat-server/internal/models"
 	"gochat-server/internal/queue"
 	"gochat-server/internal/services"
+	"gochat-server/internal/storage"
+	"gochat-server/internal/tracing"
 
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
 )
 
 func main() {
@@ -25,11 +39,30 @@ func main() {
 		logrus.Warn("No .env file found")
 	}
 
-	cfg := config.Load()
-
-	logrus.SetLevel(logrus.InfoLevel)
 	logrus.SetFormatter(&logrus.JSONFormatter{})
 
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		logrus.Fatal("Invalid configuration: ", err)
+	}
+
+	setLogLevel(cfg)
+
+	// Settings tagged reload in config.Config are swapped in on SIGHUP or
+	// when the config file changes; everything below reads them from the store
+	configStore := config.NewStore(cfg, os.Args[1:])
+	configStore.OnReload(func(_, next *config.Config) {
+		setLogLevel(next)
+	})
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.TracingExporter, cfg.TracingSampleRatio)
+	if err != nil {
+		logrus.Fatal("Failed to initialize tracing: ", err)
+	}
+
 	db, err := database.Connect(cfg.MongoURI, cfg.DatabaseName)
 	if err != nil {
 		logrus.Fatal("Failed to connect to database: ", err)
@@ -38,21 +71,98 @@ func main() {
 
 	messageService := services.NewMessageService(db)
 	userService := services.NewUserService()
-	emailService := services.NewEmailService(cfg)
+	profileService := services.NewProfileService(db)
+	membershipService := services.NewMembershipService(db)
+	preferenceService := services.NewPreferenceService(db)
+	emailMailer, err := mailer.New(cfg)
+	if err != nil {
+		logrus.Fatal("Failed to initialize email transport: ", err)
+	}
+	defer emailMailer.Close()
+	suppressionService := services.NewSuppressionService(db)
+	auditService := services.NewAuditService(db)
+	botService := services.NewBotService(db)
+	webhookService := services.NewWebhookService(db)
+	indexCtx, cancelIndexes := context.WithTimeout(context.Background(), 10*time.Second)
+	if err := webhookService.EnsureIndexes(indexCtx); err != nil {
+		logrus.Fatal("Failed to create webhook delivery indexes: ", err)
+	}
+	cancelIndexes()
+	incomingWebhookService := services.NewIncomingWebhookService(db)
+	emailService := services.NewEmailService(cfg, emailMailer, suppressionService)
 
-	queueManager := queue.NewManager(cfg.RedisAddr, emailService)
-	go queueManager.StartWorker()
+	blobStore, err := storage.New(cfg)
+	if err != nil {
+		logrus.Fatal("Failed to initialize attachment storage: ", err)
+	}
+	attachmentService := services.NewAttachmentService(db, blobStore, models.AttachmentLimits{
+		MaxSize:      cfg.MaxUploadSize,
+		AllowedTypes: cfg.AllowedUploadTypes,
+	})
 
-	chatHub := hub.NewHub(messageService, queueManager, userService)
-	go chatHub.Run()
+	linkPreviewService := services.NewLinkPreviewService(messageService)
+	notificationService := services.NewNotificationService(preferenceService, profileService, membershipService, userService, emailService)
+	digestService := services.NewDigestService(db, messageService, profileService, membershipService, preferenceService, emailService)
+
+	// Every background job must be registered before the worker starts
+	queueManager := queue.NewManager(cfg.RedisAddr, cfg.QueueConcurrency)
+	emailService.RegisterJobs(queueManager)
+	notificationService.RegisterJobs(queueManager)
+	attachmentService.RegisterJobs(queueManager)
+	linkPreviewService.RegisterJobs(queueManager)
+	webhookService.RegisterJobs(queueManager)
+	if err := digestService.RegisterJobs(queueManager); err != nil {
+		logrus.Fatal("Failed to schedule digests: ", err)
+	}
+
+	queueManager.SetArchiveAlert(cfg.DeadLetterAlertThreshold, time.Hour)
+	configStore.OnReload(func(_, next *config.Config) {
+		queueManager.SetArchiveAlert(next.DeadLetterAlertThreshold, time.Hour)
+	})
+	if cfg.DeadLetterAlertWebhook != "" {
+		queueManager.OnArchiveAlert(queue.WebhookAlert(cfg.DeadLetterAlertWebhook))
+	}
+
+	chatHub := hub.NewHub(messageService, notificationService, linkPreviewService, userService, attachmentService, profileService, membershipService)
+	linkPreviewService.SetMessageUpdateHandler(chatHub.BroadcastMessageUpdate)
+
+	// Hooks run on the hub goroutine, so the audit write mustn't block it
+	chatHub.OnJoin(func(client *hub.Client) {
+		event := &models.AuditEvent{
+			Action: services.AuditRoomJoin,
+			Actor:  client.UserID,
+			Target: client.RoomID,
+			IP:     client.RemoteAddr,
+			Details: map[string]interface{}{
+				"username":      client.Username,
+				"connection_id": client.ID,
+			},
+		}
+		go auditService.Log(context.Background(), event)
+	})
+	dispatchWebhooks(chatHub, webhookService)
+	configStore.OnReload(func(old, next *config.Config) {
+		auditService.Log(context.Background(), &models.AuditEvent{
+			Action: services.AuditConfigReload,
+			Actor:  services.AuditActorSystem,
+			Target: next.ConfigFile,
+			Details: map[string]interface{}{
+				"changed": config.Changes(old, next),
+			},
+		})
+	})
+
+	if err := queueManager.StartWorker(); err != nil {
+		logrus.Fatal("Failed to start worker: ", err)
+	}
+	go chatHub.Run(context.Background())
 
 	e := echo.New()
 
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins: []string{
-			"http://localhost:3000",
-			"http://127.0.0.1:3000",
-			"https://localhost:3000",
+		AllowOriginFunc: func(origin string) (bool, error) {
+			allowed := configStore.Current().CORSOrigins
+			return slices.Contains(allowed, "*") || slices.Contains(allowed, origin), nil
 		},
 		AllowMethods: []string{
 			echo.GET,
@@ -81,14 +191,100 @@ func main() {
 	}))
 
 	e.Use(middleware.Recover())
+	e.Use(metrics.Middleware())
+	e.Use(otelecho.Middleware(tracing.ServiceName, otelecho.WithSkipper(func(c echo.Context) bool {
+		switch c.Path() {
+		case "/metrics", "/livez", "/readyz", "/rooms/:roomID/events", "/sessions/:sessionID/poll":
+			return true
+		}
+		return false
+	})))
 
-	chatHandler := handlers.NewChatHandler(chatHub, messageService)
-	emailHandler := handlers.NewEmailHandler(queueManager)
+	chatHandler := handlers.NewChatHandler(chatHub, messageService, profileService, membershipService, configStore)
+	userHandler := handlers.NewUserHandler(profileService, emailService, preferenceService)
+	unsubscribeHandler := handlers.NewUnsubscribeHandler(emailService, preferenceService, profileService, suppressionService, cfg.BounceWebhookSecret)
+	emailHandler := handlers.NewEmailHandler(emailService)
+	attachmentHandler := handlers.NewAttachmentHandler(attachmentService)
+	jobHandler := handlers.NewJobHandler(queueManager)
+	hubHandler := handlers.NewHubHandler(chatHub)
+	auditHandler := handlers.NewAuditHandler(auditService)
+	botHandler := handlers.NewBotHandler(chatHub, botService, configStore)
+	webhookHandler := handlers.NewWebhookHandler(webhookService)
+	incomingWebhookHandler := handlers.NewIncomingWebhookHandler(chatHub, incomingWebhookService, configStore)
+	healthHandler := handlers.NewHealthHandler(healthCheckers(configStore, chatHub, queueManager, emailMailer))
 
 	e.GET("/ws/:roomID/:userID", chatHandler.HandleWebSocket)
+	e.GET("/rooms/:roomID/events", chatHandler.HandleEvents)
+	e.POST("/rooms/:roomID/sessions", chatHandler.OpenPollSession)
+	e.GET("/sessions/:sessionID/poll", chatHandler.Poll)
+	e.POST("/sessions/:sessionID/messages", chatHandler.SendMessage)
+	e.DELETE("/sessions/:sessionID", chatHandler.CloseSession)
 	e.GET("/rooms/:roomID/messages", chatHandler.GetRoomMessages)
+	e.POST("/rooms/:roomID/messages", botHandler.PostMessage, handlers.RequireBot(botService, services.BotScopeMessagesWrite))
+	e.POST("/hooks/:token", incomingWebhookHandler.Receive, middleware.BodyLimit("64K"))
 	e.GET("/rooms/:roomID/users", chatHandler.GetRoomUsers)
+	e.GET("/users/:userID/profile", userHandler.GetProfile)
+	e.PUT("/users/:userID/profile", userHandler.UpdateProfile)
+	e.GET("/verify-email", userHandler.VerifyEmail)
+	e.GET("/users/:userID/notification-preferences", userHandler.GetNotificationPreferences)
+	e.PUT("/users/:userID/notification-preferences", userHandler.UpdateNotificationPreferences)
+	e.PUT("/users/:userID/notification-preferences/rooms/:roomID", userHandler.SetRoomNotificationPreference)
+	e.DELETE("/users/:userID/notification-preferences/rooms/:roomID", userHandler.ClearRoomNotificationPreference)
 	e.POST("/queue-email", emailHandler.QueueEmail)
+	e.GET("/emails/:id", emailHandler.GetEmailStatus)
+	e.GET("/unsubscribe", unsubscribeHandler.ShowUnsubscribe)
+	e.POST("/unsubscribe", unsubscribeHandler.Unsubscribe)
+	e.POST("/resubscribe", unsubscribeHandler.Resubscribe)
+	e.POST("/email/bounces", unsubscribeHandler.RecordBounce)
+	e.POST("/rooms/:roomID/attachments", attachmentHandler.UploadAttachment, middleware.BodyLimit(uploadBodyLimit(cfg.MaxUploadSize)))
+	e.GET("/rooms/:roomID/attachment-limits", attachmentHandler.GetRoomLimits)
+	e.GET("/attachments/:id", attachmentHandler.GetAttachment)
+	e.GET("/attachments/:id/thumbnail", attachmentHandler.GetThumbnail)
+
+	// Every admin action that changes something is audited
+	audit := func(action, targetParam string) echo.MiddlewareFunc {
+		return handlers.Audit(auditService, action, targetParam)
+	}
+	admin := e.Group("/admin", handlers.RequireAdmin(cfg.AdminToken, auditService))
+	admin.PUT("/rooms/:roomID/attachment-limits", attachmentHandler.SetRoomLimits, audit(services.AuditAttachmentLimits, "roomID"))
+	admin.GET("/emails/failed", emailHandler.ListFailedEmails)
+	admin.POST("/emails/:id/retry", emailHandler.RetryEmail, audit(services.AuditEmailRetry, "id"))
+	admin.DELETE("/emails/:id", emailHandler.DeleteEmail, audit(services.AuditEmailDelete, "id"))
+	admin.GET("/jobs/dead/:queue", jobHandler.ListDeadLetters)
+	admin.POST("/jobs/dead/:queue/replay", jobHandler.ReplayDeadLetters, audit(services.AuditDeadLetterReplay, "queue"))
+	admin.DELETE("/jobs/dead/:queue", jobHandler.PurgeDeadLetters, audit(services.AuditDeadLetterPurge, "queue"))
+	admin.GET("/jobs/dead/:queue/:id", jobHandler.GetDeadLetter)
+	admin.POST("/jobs/dead/:queue/:id/replay", jobHandler.ReplayDeadLetter, audit(services.AuditDeadLetterReplay, "id"))
+	admin.DELETE("/jobs/dead/:queue/:id", jobHandler.PurgeDeadLetter, audit(services.AuditDeadLetterPurge, "id"))
+	admin.GET("/hub/rooms", hubHandler.ListRooms)
+	admin.GET("/hub/rooms/:roomID", hubHandler.GetRoom)
+	admin.DELETE("/hub/rooms/:roomID", hubHandler.CloseRoom, audit(services.AuditRoomClose, "roomID"))
+	admin.POST("/hub/rooms/:roomID/reopen", hubHandler.ReopenRoom, audit(services.AuditRoomReopen, "roomID"))
+	admin.GET("/hub/connections", hubHandler.ListConnections)
+	admin.DELETE("/hub/connections/:id", hubHandler.DisconnectConnection, audit(services.AuditConnectionKick, "id"))
+	admin.POST("/hub/announcements", hubHandler.Announce, audit(services.AuditAnnouncement, ""))
+	admin.GET("/audit", auditHandler.ListEvents)
+	admin.GET("/audit/export", auditHandler.ExportEvents)
+	admin.GET("/bots", botHandler.ListBots)
+	admin.POST("/bots", botHandler.CreateBot, audit(services.AuditBotCreate, ""))
+	admin.GET("/bots/:id", botHandler.GetBot)
+	admin.DELETE("/bots/:id", botHandler.DeleteBot, audit(services.AuditBotDelete, "id"))
+	admin.POST("/bots/:id/token", botHandler.RotateToken, audit(services.AuditBotTokenRotate, "id"))
+	admin.GET("/rooms/:roomID/webhooks", webhookHandler.ListWebhooks)
+	admin.POST("/rooms/:roomID/webhooks", webhookHandler.CreateWebhook, audit(services.AuditWebhookCreate, "roomID"))
+	admin.GET("/webhooks/:id", webhookHandler.GetWebhook)
+	admin.DELETE("/webhooks/:id", webhookHandler.DeleteWebhook, audit(services.AuditWebhookDelete, "id"))
+	admin.GET("/webhooks/:id/deliveries", webhookHandler.ListDeliveries)
+	admin.POST("/webhooks/:id/test", webhookHandler.TestWebhook, audit(services.AuditWebhookTest, "id"))
+	admin.GET("/rooms/:roomID/incoming-webhooks", incomingWebhookHandler.ListIncomingWebhooks)
+	admin.POST("/rooms/:roomID/incoming-webhooks", incomingWebhookHandler.CreateIncomingWebhook, audit(services.AuditIncomingWebhookCreate, "roomID"))
+	admin.DELETE("/incoming-webhooks/:id", incomingWebhookHandler.DeleteIncomingWebhook, audit(services.AuditIncomingWebhookDelete, "id"))
+
+	prometheus.MustRegister(queueManager.Collector())
+	e.GET("/metrics", metrics.Handler())
+
+	e.GET("/livez", healthHandler.Livez)
+	e.GET("/readyz", healthHandler.Readyz)
 
 	e.GET("/health", func(c echo.Context) error {
 		return c.JSON(200, map[string]interface{}{
@@ -107,12 +303,16 @@ func main() {
 	})
 
 	logrus.Info("Starting GoChat Server on port ", cfg.Port)
-	logrus.Info("CORS enabled for frontend at http://localhost:3000")
+	logrus.Info("CORS enabled for ", strings.Join(cfg.CORSOrigins, ", "))
 	logrus.Info("WebSocket endpoint: ws://localhost:", cfg.Port, "/ws/{roomID}/{userID}")
 
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	go configStore.Watch(watchCtx, cfg.ConfigWatchInterval)
+
 	go func() {
-		if err := e.Start(":" + cfg.Port); err != nil {
-			logrus.Info("Server stopped")
+		if err := e.Start(":" + cfg.Port); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.Fatal("Server failed: ", err)
 		}
 	}()
 
@@ -121,10 +321,143 @@ func main() {
 	<-quit
 
 	logrus.Info("Shutting down server...")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	stopWatching()
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
 	defer cancel()
 
+	// Clients first, so the messages they flush are saved and their
+	// notifications queued before the worker stops
+	if err := chatHub.Shutdown(ctx); err != nil {
+		logrus.Error("Hub did not drain cleanly: ", err)
+	}
+
 	if err := e.Shutdown(ctx); err != nil {
-		logrus.Fatal("Server forced to shutdown: ", err)
+		logrus.Error("HTTP server did not shut down cleanly: ", err)
+	}
+
+	if err := queueManager.Shutdown(ctx); err != nil {
+		logrus.Error("Job worker did not shut down cleanly: ", err)
+	}
+
+	if err := shutdownTracing(ctx); err != nil {
+		logrus.Error("Failed to flush traces: ", err)
+	}
+
+	logrus.Info("Server stopped")
+}
+
+// healthCheckers builds the liveness checks, which only cover this process,
+// and the readiness checks, which also cover its dependencies and fail as soon
+// as a graceful shutdown starts.
+func healthCheckers(configStore *config.Store, chatHub *hub.Hub, queueManager *queue.Manager, emailMailer mailer.Mailer) (*health.Checker, *health.Checker) {
+	cfg := configStore.Current()
+	live := health.NewChecker(cfg.HealthCheckTimeout)
+	live.Add("hub", chatHub.Ping)
+
+	ready := health.NewChecker(cfg.HealthCheckTimeout)
+	ready.Add("shutdown", func(context.Context) error {
+		if chatHub.Closing() {
+			return errors.New("server is shutting down")
+		}
+		return nil
+	})
+	ready.Add("hub", chatHub.Ping)
+	ready.Add("mongo", database.Ping)
+	ready.Add("redis", queueManager.Ping)
+	ready.Add("queue_backlog", func(ctx context.Context) error {
+		return queueManager.CheckBacklog(ctx, configStore.Current().QueueBacklogThreshold)
+	})
+	if pinger, ok := emailMailer.(mailer.Pinger); ok && cfg.HealthCheckSMTP {
+		ready.Add("smtp", pinger.Ping)
 	}
+
+	return live, ready
+}
+
+func setLogLevel(cfg *config.Config) {
+	// Validated when the config was loaded
+	level, _ := logrus.ParseLevel(cfg.LogLevel)
+	logrus.SetLevel(level)
+}
+
+// dispatchWebhooks delivers hub events to room webhooks. Hooks run on the hub
+// goroutine, so the webhook lookup happens in the background.
+func dispatchWebhooks(chatHub *hub.Hub, webhookService *services.WebhookService) {
+	dispatch := func(ctx context.Context, roomID, event string, data map[string]interface{}) {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+			defer cancel()
+			if err := webhookService.Dispatch(ctx, roomID, event, data); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"room_id": roomID,
+					"event":   event,
+				}).Error("Failed to dispatch webhook event: ", err)
+			}
+		}()
+	}
+
+	chatHub.OnMessage(func(message *models.WSMessage) {
+		if message.ID == "" {
+			return
+		}
+		ctx := message.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+
+		switch message.Type {
+		case "message":
+			dispatch(ctx, message.RoomID, services.WebhookMessageCreated, map[string]interface{}{
+				"id":          message.ID,
+				"user_id":     message.UserID,
+				"username":    message.Username,
+				"content":     message.Content,
+				"attachments": message.Attachments,
+				"mentions":    message.Mentions,
+				"bot":         message.Bot,
+			})
+		case "message_updated":
+			stored, ok := message.Data.(*models.Message)
+			if !ok {
+				return
+			}
+			dispatch(ctx, message.RoomID, services.WebhookMessageUpdated, map[string]interface{}{
+				"id":            message.ID,
+				"user_id":       stored.UserID,
+				"username":      stored.Username,
+				"content":       stored.Content,
+				"attachments":   stored.Attachments,
+				"link_previews": stored.LinkPreviews,
+				"mentions":      stored.Mentions,
+				"bot":           stored.Bot,
+			})
+		}
+	})
+	// user.joined and user.left follow presence, not connections: a user
+	// with several tabs open joins with the first and leaves with the last
+	chatHub.OnJoin(func(client *hub.Client) {
+		if chatHub.UserConnections(client.RoomID, client.UserID) > 1 {
+			return
+		}
+		dispatch(context.Background(), client.RoomID, services.WebhookUserJoined, map[string]interface{}{
+			"user_id":  client.UserID,
+			"username": client.Username,
+		})
+	})
+	chatHub.OnLeave(func(client *hub.Client) {
+		if chatHub.UserConnections(client.RoomID, client.UserID) > 0 {
+			return
+		}
+		dispatch(context.Background(), client.RoomID, services.WebhookUserLeft, map[string]interface{}{
+			"user_id":  client.UserID,
+			"username": client.Username,
+		})
+	})
+}
+
+// uploadBodyLimit caps attachment request bodies at the largest allowed file
+// plus room for the multipart framing and form fields, so oversized uploads
+// are refused before they are spooled to disk.
+func uploadBodyLimit(maxUploadSize int64) string {
+	return strconv.FormatInt(maxUploadSize+64<<10, 10) + "B"
 }
@@ -1,36 +1,504 @@
 package config
 
 import (
+    "errors"
+    "flag"
+    "fmt"
+    "net"
+    "net/url"
     "os"
+    "path/filepath"
+    "reflect"
+    "regexp"
+    "slices"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/BurntSushi/toml"
+    "github.com/sirupsen/logrus"
+    "gopkg.in/yaml.v3"
 )
 
+// Every field tagged with a config key can be set from a file (smtp_host), an
+// environment variable (SMTP_HOST) or a flag (-smtp-host). Fields also tagged
+// reload are applied by Store.Reload without a restart.
 type Config struct {
-    Port         string
-    MongoURI     string
-    DatabaseName string
-    RedisAddr    string
-    SMTPHost     string
-    SMTPPort     string
-    SMTPUser     string
-    SMTPPass     string
+    // ConfigFile is the file the config was read from, if any
+    ConfigFile string
+
+    // ConfigWatchInterval is how often ConfigFile is checked for changes; zero
+    // leaves reloading to SIGHUP
+    ConfigWatchInterval time.Duration `config:"config_watch_interval"`
+
+    Port         string `config:"port"`
+    MongoURI     string `config:"mongo_uri"`
+    DatabaseName string `config:"database_name"`
+    RedisAddr    string `config:"redis_addr"`
+    SMTPHost     string `config:"smtp_host"`
+    SMTPPort     string `config:"smtp_port"`
+    SMTPUser     string `config:"smtp_user"`
+    SMTPPass     string `config:"smtp_pass"`
+
+    // LogLevel is any logrus level name (debug, info, warn, ...)
+    LogLevel string `config:"log_level,reload"`
+
+    // CORSOrigins are allowed to call the REST API; WSAllowedOrigins are
+    // allowed to open WebSockets and default to CORSOrigins
+    CORSOrigins      []string `config:"cors_origins,reload"`
+    WSAllowedOrigins []string `config:"ws_allowed_origins,reload"`
+
+    // MessageRateLimit is how many messages per second each connection may
+    // send on average, with bursts of up to MessageRateBurst; zero disables it.
+    // Messages containing a BannedWords entry (whole word, any case) have it
+    // masked.
+    MessageRateLimit float64  `config:"message_rate_limit,reload"`
+    MessageRateBurst int      `config:"message_rate_burst,reload"`
+    BannedWords      []string `config:"banned_words,reload"`
+
+    // IncomingWebhookRateLimit is how many messages per second each incoming
+    // webhook may post, with bursts of up to IncomingWebhookRateBurst; zero
+    // disables it.
+    IncomingWebhookRateLimit float64 `config:"incoming_webhook_rate_limit,reload"`
+    IncomingWebhookRateBurst int     `config:"incoming_webhook_rate_burst,reload"`
+
+    // WebSocket limits
+    MaxMessageLength         int           `config:"max_message_length,reload"`
+    MaxAttachmentsPerMessage int           `config:"max_attachments_per_message,reload"`
+    WSReadLimit              int64         `config:"ws_read_limit"`
+    WSReadBufferSize         int           `config:"ws_read_buffer_size"`
+    WSWriteBufferSize        int           `config:"ws_write_buffer_size"`
+    WSSendBufferSize         int           `config:"ws_send_buffer_size"`
+    WSPingInterval           time.Duration `config:"ws_ping_interval"`
+    WSPongTimeout            time.Duration `config:"ws_pong_timeout"`
+    WSWriteTimeout           time.Duration `config:"ws_write_timeout"`
+
+    // QueueConcurrency is how many tasks the job worker runs at once
+    QueueConcurrency int `config:"queue_concurrency"`
+
+    // ShutdownTimeout bounds the whole graceful shutdown: disconnecting
+    // clients, draining the hub and stopping the job worker
+    ShutdownTimeout time.Duration `config:"shutdown_timeout"`
+
+    // TracingExporter is otlp, stdout or none; the OTLP endpoint comes from the
+    // standard OTEL_EXPORTER_OTLP_* variables
+    TracingExporter    string  `config:"tracing_exporter"`
+    TracingSampleRatio float64 `config:"tracing_sample_ratio"`
+
+    // Readiness probe settings; the SMTP check is opt-in since mail outages
+    // shouldn't take the chat out of rotation
+    HealthCheckTimeout    time.Duration `config:"health_check_timeout"`
+    HealthCheckSMTP       bool          `config:"health_check_smtp"`
+    QueueBacklogThreshold int           `config:"queue_backlog_threshold,reload"`
+
+    // AdminToken guards the /admin API; the API is disabled when empty
+    AdminToken string `config:"admin_token"`
+
+    SMTPSecurity string `config:"smtp_security"`
+    SMTPPoolSize int    `config:"smtp_pool_size"`
+
+    // EmailTransport is smtp, file (write .eml files to EmailFileDir) or memory
+    EmailTransport string `config:"email_transport"`
+    EmailFileDir   string `config:"email_file_dir"`
+    EmailFrom      string `config:"email_from"`
+    EmailFromName  string `config:"email_from_name"`
+
+    // PublicURL is where this server is reachable from emails (unsubscribe links)
+    PublicURL           string `config:"public_url"`
+    UnsubscribeSecret   string `config:"unsubscribe_secret"`
+    BounceWebhookSecret string `config:"bounce_webhook_secret"`
+
+    // An alert fires (and is POSTed to DeadLetterAlertWebhook, if set) when a
+    // queue's dead-letter archive holds this many tasks
+    DeadLetterAlertThreshold int    `config:"dead_letter_alert_threshold,reload"`
+    DeadLetterAlertWebhook   string `config:"dead_letter_alert_webhook"`
+
+    // Attachment storage
+    StorageDriver      string   `config:"storage_driver"`
+    StorageLocalDir    string   `config:"storage_local_dir"`
+    S3Endpoint         string   `config:"s3_endpoint"`
+    S3AccessKey        string   `config:"s3_access_key"`
+    S3SecretKey        string   `config:"s3_secret_key"`
+    S3Bucket           string   `config:"s3_bucket"`
+    S3Region           string   `config:"s3_region"`
+    S3UseSSL           bool     `config:"s3_use_ssl"`
+    MaxUploadSize      int64    `config:"max_upload_size"`
+    AllowedUploadTypes []string `config:"allowed_upload_types"`
 }
 
-func Load() *Config {
+func defaults() *Config {
     return &Config{
-        Port:         getEnv("PORT", "8080"),
-        MongoURI:     getEnv("MONGO_URI", "mongodb://localhost:27017"),
-        DatabaseName: getEnv("DATABASE_NAME", "chatdb"),
-        RedisAddr:    getEnv("REDIS_ADDR", "localhost:6379"),
-        SMTPHost:     getEnv("SMTP_HOST", "localhost"),
-        SMTPPort:     getEnv("SMTP_PORT", "1025"),
-        SMTPUser:     getEnv("SMTP_USER", ""),
-        SMTPPass:     getEnv("SMTP_PASS", ""),
+        Port:         "8080",
+        MongoURI:     "mongodb://localhost:27017",
+        DatabaseName: "chatdb",
+        RedisAddr:    "localhost:6379",
+        SMTPHost:     "localhost",
+        SMTPPort:     "1025",
+
+        ConfigWatchInterval: 10 * time.Second,
+
+        LogLevel: "info",
+
+        CORSOrigins: []string{
+            "http://localhost:3000",
+            "http://127.0.0.1:3000",
+            "https://localhost:3000",
+        },
+
+        MessageRateLimit: 5,
+        MessageRateBurst: 10,
+
+        IncomingWebhookRateLimit: 1,
+        IncomingWebhookRateBurst: 5,
+
+        MaxMessageLength:         1000,
+        MaxAttachmentsPerMessage: 10,
+        WSReadLimit:              4096,
+        WSReadBufferSize:         1024,
+        WSWriteBufferSize:        1024,
+        WSSendBufferSize:         256,
+        WSPingInterval:           54 * time.Second,
+        WSPongTimeout:            60 * time.Second,
+        WSWriteTimeout:           10 * time.Second,
+
+        QueueConcurrency: 10,
+
+        ShutdownTimeout: 15 * time.Second,
+
+        TracingExporter:    "none",
+        TracingSampleRatio: 1,
+
+        HealthCheckTimeout:    2 * time.Second,
+        QueueBacklogThreshold: 1000,
+
+        SMTPSecurity: "none",
+        SMTPPoolSize: 4,
+
+        EmailTransport: "smtp",
+        EmailFileDir:   "./data/mail",
+        EmailFrom:      "noreply@chatserver.com",
+        EmailFromName:  "GoChat",
+
+        PublicURL: "http://localhost:8080",
+
+        DeadLetterAlertThreshold: 100,
+
+        StorageDriver:      "local",
+        StorageLocalDir:    "./data/uploads",
+        S3Endpoint:         "localhost:9000",
+        S3Bucket:           "gochat-attachments",
+        S3Region:           "us-east-1",
+        MaxUploadSize:      10 << 20,
+        AllowedUploadTypes: []string{"image/*", "application/pdf", "text/plain"},
+    }
+}
+
+// Load builds the configuration from, in increasing order of precedence, the
+// defaults, a YAML or TOML file (-config or CONFIG_FILE), environment
+// variables and command-line flags, then validates it. The returned error
+// lists every problem found, not just the first.
+func Load(args []string) (*Config, error) {
+    cfg := defaults()
+    fields := fieldsOf(cfg)
+
+    flags := flag.NewFlagSet("gochat-server", flag.ContinueOnError)
+    path := flags.String("config", os.Getenv("CONFIG_FILE"), "YAML or TOML config `file`")
+    overrides := make(map[string]string)
+    for _, f := range fields {
+        key := f.key
+        flags.Func(strings.ReplaceAll(key, "_", "-"), "overrides "+envName(key), func(value string) error {
+            overrides[key] = value
+            return nil
+        })
+    }
+    if err := flags.Parse(args); err != nil {
+        return nil, err
+    }
+
+    var errs []error
+    if *path != "" {
+        cfg.ConfigFile = *path
+        errs = append(errs, loadFile(*path, fields)...)
+    }
+
+    for _, f := range fields {
+        if value := os.Getenv(envName(f.key)); value != "" {
+            if err := f.set(value); err != nil {
+                errs = append(errs, fmt.Errorf("%s: %w", envName(f.key), err))
+            }
+        }
+    }
+
+    for _, f := range fields {
+        if value, ok := overrides[f.key]; ok {
+            if err := f.set(value); err != nil {
+                errs = append(errs, fmt.Errorf("-%s: %w", strings.ReplaceAll(f.key, "_", "-"), err))
+            }
+        }
+    }
+
+    if len(cfg.WSAllowedOrigins) == 0 {
+        cfg.WSAllowedOrigins = cfg.CORSOrigins
+    }
+
+    if err := cfg.Validate(); err != nil {
+        errs = append(errs, err)
+    }
+    if len(errs) > 0 {
+        return nil, errors.Join(errs...)
+    }
+    return cfg, nil
+}
+
+// Validate reports every setting that is out of range or inconsistent.
+func (c *Config) Validate() error {
+    var errs []error
+    check := func(ok bool, format string, args ...interface{}) {
+        if !ok {
+            errs = append(errs, fmt.Errorf(format, args...))
+        }
     }
+
+    check(isPort(c.Port), "PORT must be a port number, got %q", c.Port)
+    check(isPort(c.SMTPPort), "SMTP_PORT must be a port number, got %q", c.SMTPPort)
+    check(c.MongoURI != "", "MONGO_URI is required")
+    check(c.DatabaseName != "", "DATABASE_NAME is required")
+    check(c.RedisAddr != "", "REDIS_ADDR is required")
+
+    _, err := logrus.ParseLevel(c.LogLevel)
+    check(err == nil, "LOG_LEVEL must be a log level (debug, info, warn, error), got %q", c.LogLevel)
+
+    for _, origin := range c.CORSOrigins {
+        check(isOrigin(origin), "CORS_ORIGINS: %q is not an origin like https://chat.example.com", origin)
+    }
+    for _, origin := range c.WSAllowedOrigins {
+        if slices.Contains(c.CORSOrigins, origin) {
+            continue // already reported
+        }
+        check(isOrigin(origin), "WS_ALLOWED_ORIGINS: %q is not an origin like https://chat.example.com", origin)
+    }
+
+    check(c.ConfigWatchInterval >= 0, "CONFIG_WATCH_INTERVAL must not be negative")
+    check(c.MessageRateLimit >= 0, "MESSAGE_RATE_LIMIT must not be negative")
+    check(c.MessageRateLimit == 0 || c.MessageRateBurst > 0, "MESSAGE_RATE_BURST must be positive when MESSAGE_RATE_LIMIT is set")
+    check(c.IncomingWebhookRateLimit >= 0, "INCOMING_WEBHOOK_RATE_LIMIT must not be negative")
+    check(c.IncomingWebhookRateLimit == 0 || c.IncomingWebhookRateBurst > 0, "INCOMING_WEBHOOK_RATE_BURST must be positive when INCOMING_WEBHOOK_RATE_LIMIT is set")
+    for _, word := range c.BannedWords {
+        check(bannedWord.MatchString(word), "BANNED_WORDS: %q must be a single word of letters and digits", word)
+    }
+
+    check(c.MaxMessageLength > 0, "MAX_MESSAGE_LENGTH must be positive")
+    check(c.MaxAttachmentsPerMessage >= 0, "MAX_ATTACHMENTS_PER_MESSAGE must not be negative")
+    check(c.WSReadLimit >= int64(c.MaxMessageLength), "WS_READ_LIMIT (%d) must be at least MAX_MESSAGE_LENGTH (%d)", c.WSReadLimit, c.MaxMessageLength)
+    check(c.WSReadBufferSize > 0, "WS_READ_BUFFER_SIZE must be positive")
+    check(c.WSWriteBufferSize > 0, "WS_WRITE_BUFFER_SIZE must be positive")
+    check(c.WSSendBufferSize > 0, "WS_SEND_BUFFER_SIZE must be positive")
+    check(c.WSWriteTimeout > 0, "WS_WRITE_TIMEOUT must be positive")
+    check(c.WSPingInterval > 0 && c.WSPingInterval < c.WSPongTimeout,
+        "WS_PING_INTERVAL (%s) must be positive and shorter than WS_PONG_TIMEOUT (%s)", c.WSPingInterval, c.WSPongTimeout)
+
+    check(c.QueueConcurrency > 0, "QUEUE_CONCURRENCY must be positive")
+    check(c.ShutdownTimeout > 0, "SHUTDOWN_TIMEOUT must be positive")
+
+    check(slices.Contains([]string{"none", "otlp", "stdout"}, c.TracingExporter),
+        "TRACING_EXPORTER must be none, otlp or stdout, got %q", c.TracingExporter)
+    check(c.TracingSampleRatio >= 0 && c.TracingSampleRatio <= 1,
+        "TRACING_SAMPLE_RATIO must be between 0 and 1, got %g", c.TracingSampleRatio)
+
+    check(c.HealthCheckTimeout > 0, "HEALTH_CHECK_TIMEOUT must be positive")
+    check(c.QueueBacklogThreshold > 0, "QUEUE_BACKLOG_THRESHOLD must be positive")
+
+    check(slices.Contains([]string{"none", "starttls", "tls"}, c.SMTPSecurity),
+        "SMTP_SECURITY must be none, starttls or tls, got %q", c.SMTPSecurity)
+    check(c.SMTPPoolSize > 0, "SMTP_POOL_SIZE must be positive")
+    check(slices.Contains([]string{"smtp", "file", "memory"}, c.EmailTransport),
+        "EMAIL_TRANSPORT must be smtp, file or memory, got %q", c.EmailTransport)
+    check(c.EmailTransport != "file" || c.EmailFileDir != "", "EMAIL_FILE_DIR is required when EMAIL_TRANSPORT is file")
+
+    publicURL, err := url.Parse(c.PublicURL)
+    check(err == nil && publicURL.Scheme != "" && publicURL.Host != "", "PUBLIC_URL must be an absolute URL, got %q", c.PublicURL)
+
+    check(c.DeadLetterAlertThreshold > 0, "DEAD_LETTER_ALERT_THRESHOLD must be positive")
+    if c.DeadLetterAlertWebhook != "" {
+        webhook, err := url.Parse(c.DeadLetterAlertWebhook)
+        check(err == nil && webhook.Scheme != "" && webhook.Host != "", "DEAD_LETTER_ALERT_WEBHOOK must be an absolute URL, got %q", c.DeadLetterAlertWebhook)
+    }
+
+    check(slices.Contains([]string{"local", "s3"}, c.StorageDriver),
+        "STORAGE_DRIVER must be local or s3, got %q", c.StorageDriver)
+    check(c.StorageDriver != "local" || c.StorageLocalDir != "", "STORAGE_LOCAL_DIR is required when STORAGE_DRIVER is local")
+    check(c.StorageDriver != "s3" || (c.S3Endpoint != "" && c.S3Bucket != ""), "S3_ENDPOINT and S3_BUCKET are required when STORAGE_DRIVER is s3")
+    check(c.MaxUploadSize > 0, "MAX_UPLOAD_SIZE must be positive")
+    check(len(c.AllowedUploadTypes) > 0, "ALLOWED_UPLOAD_TYPES must not be empty")
+
+    return errors.Join(errs...)
+}
+
+var bannedWord = regexp.MustCompile(`^[\pL\pN_]+$`)
+
+func isPort(s string) bool {
+    port, err := strconv.Atoi(s)
+    return err == nil && port > 0 && port <= 65535
+}
+
+// isOrigin accepts "*" or a scheme://host[:port] origin with nothing after it.
+func isOrigin(s string) bool {
+    if s == "*" {
+        return true
+    }
+    u, err := url.Parse(s)
+    if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+        return false
+    }
+    if _, port, err := net.SplitHostPort(u.Host); err == nil && !isPort(port) {
+        return false
+    }
+    return u.Path == "" && u.RawQuery == "" && u.Fragment == ""
+}
+
+type field struct {
+    key        string
+    reloadable bool
+    value      reflect.Value
+}
+
+func fieldsOf(cfg *Config) []field {
+    v := reflect.ValueOf(cfg).Elem()
+    var fields []field
+    for i := 0; i < v.NumField(); i++ {
+        tag := v.Type().Field(i).Tag.Get("config")
+        if tag == "" {
+            continue
+        }
+        key, opt, _ := strings.Cut(tag, ",")
+        fields = append(fields, field{key: key, reloadable: opt == "reload", value: v.Field(i)})
+    }
+    return fields
+}
+
+func envName(key string) string {
+    return strings.ToUpper(key)
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// set parses s into the field. Lists are comma-separated.
+func (f field) set(s string) error {
+    if f.value.Type() == durationType {
+        d, err := time.ParseDuration(s)
+        if err != nil {
+            return fmt.Errorf("invalid duration %q", s)
+        }
+        f.value.SetInt(int64(d))
+        return nil
+    }
+
+    switch f.value.Kind() {
+    case reflect.String:
+        f.value.SetString(s)
+    case reflect.Bool:
+        b, err := strconv.ParseBool(s)
+        if err != nil {
+            return fmt.Errorf("invalid boolean %q", s)
+        }
+        f.value.SetBool(b)
+    case reflect.Int, reflect.Int64:
+        n, err := strconv.ParseInt(s, 10, 64)
+        if err != nil {
+            return fmt.Errorf("invalid integer %q", s)
+        }
+        f.value.SetInt(n)
+    case reflect.Float64:
+        n, err := strconv.ParseFloat(s, 64)
+        if err != nil {
+            return fmt.Errorf("invalid number %q", s)
+        }
+        f.value.SetFloat(n)
+    case reflect.Slice:
+        var list []string
+        for _, item := range strings.Split(s, ",") {
+            if item = strings.TrimSpace(item); item != "" {
+                list = append(list, item)
+            }
+        }
+        f.value.Set(reflect.ValueOf(list))
+    default:
+        panic("config: unsupported field type " + f.value.Type().String())
+    }
+    return nil
+}
+
+// loadFile applies a flat YAML or TOML file whose keys are the config keys.
+// Unknown keys are errors so typos don't go unnoticed.
+func loadFile(path string, fields []field) []error {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return []error{fmt.Errorf("config file: %w", err)}
+    }
+
+    raw := make(map[string]interface{})
+    switch strings.ToLower(filepath.Ext(path)) {
+    case ".yaml", ".yml":
+        err = yaml.Unmarshal(data, &raw)
+    case ".toml":
+        _, err = toml.Decode(string(data), &raw)
+    default:
+        return []error{fmt.Errorf("config file %s: unsupported format, want .yaml, .yml or .toml", path)}
+    }
+    if err != nil {
+        return []error{fmt.Errorf("config file %s: %w", path, err)}
+    }
+
+    var errs []error
+    for _, f := range fields {
+        value, ok := raw[f.key]
+        if !ok {
+            continue
+        }
+        delete(raw, f.key)
+
+        s, err := fileValue(value)
+        if err == nil {
+            err = f.set(s)
+        }
+        if err != nil {
+            errs = append(errs, fmt.Errorf("config file %s: %s: %w", path, f.key, err))
+        }
+    }
+
+    unknown := make([]string, 0, len(raw))
+    for key := range raw {
+        unknown = append(unknown, key)
+    }
+    sort.Strings(unknown)
+    for _, key := range unknown {
+        errs = append(errs, fmt.Errorf("config file %s: unknown key %q", path, key))
+    }
+
+    return errs
 }
 
-func getEnv(key, defaultValue string) string {
-    if value := os.Getenv(key); value != "" {
-        return value
+// fileValue turns a decoded YAML/TOML value into the string form set parses.
+func fileValue(value interface{}) (string, error) {
+    switch v := value.(type) {
+    case nil:
+        return "", nil
+    case string:
+        return v, nil
+    case []interface{}:
+        items := make([]string, len(v))
+        for i, item := range v {
+            s, err := fileValue(item)
+            if err != nil {
+                return "", err
+            }
+            items[i] = s
+        }
+        return strings.Join(items, ","), nil
+    case map[string]interface{}:
+        return "", errors.New("expected a value or a list, got a table")
+    default:
+        return fmt.Sprint(v), nil
     }
-    return defaultValue
 }
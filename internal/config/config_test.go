@@ -0,0 +1,269 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearEnv blanks every config variable for the test, so settings of the
+// machine running it don't leak in.
+func clearEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", "")
+	for _, f := range fieldsOf(defaults()) {
+		t.Setenv(envName(f.key), "")
+	}
+}
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  string
+		flag string
+		want string
+	}{
+		{"default", "", "", "", "8080"},
+		{"file", "9001", "", "", "9001"},
+		{"env over file", "9001", "9002", "", "9002"},
+		{"flag over env", "9001", "9002", "9003", "9003"},
+		{"flag over file", "9001", "", "9003", "9003"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			var args []string
+			if tt.file != "" {
+				args = append(args, "-config", writeConfig(t, "gochat.yaml", "port: \""+tt.file+"\"\n"))
+			}
+			if tt.env != "" {
+				t.Setenv("PORT", tt.env)
+			}
+			if tt.flag != "" {
+				args = append(args, "-port", tt.flag)
+			}
+
+			cfg, err := Load(args)
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if cfg.Port != tt.want {
+				t.Errorf("Port = %q, want %q", cfg.Port, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileFromEnv(t *testing.T) {
+	clearEnv(t)
+	path := writeConfig(t, "gochat.yaml", "port: \"9001\"\n")
+	t.Setenv("CONFIG_FILE", path)
+
+	cfg, err := Load(nil)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.ConfigFile != path || cfg.Port != "9001" {
+		t.Errorf("ConfigFile = %q, Port = %q", cfg.ConfigFile, cfg.Port)
+	}
+}
+
+func TestLoadFileFormats(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"gochat.yaml", `
+cors_origins:
+  - https://chat.example.com
+  - https://admin.example.com
+banned_words: [spam, scam]
+ws_ping_interval: 20s
+ws_pong_timeout: 1m
+message_rate_limit: 2.5
+max_message_length: 500
+s3_use_ssl: true
+`},
+		{"gochat.toml", `
+cors_origins = ["https://chat.example.com", "https://admin.example.com"]
+banned_words = ["spam", "scam"]
+ws_ping_interval = "20s"
+ws_pong_timeout = "1m"
+message_rate_limit = 2.5
+max_message_length = 500
+s3_use_ssl = true
+`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			cfg, err := Load([]string{"-config", writeConfig(t, tt.name, tt.content)})
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+
+			origins := []string{"https://chat.example.com", "https://admin.example.com"}
+			if !reflect.DeepEqual(cfg.CORSOrigins, origins) {
+				t.Errorf("CORSOrigins = %q", cfg.CORSOrigins)
+			}
+			if !reflect.DeepEqual(cfg.WSAllowedOrigins, origins) {
+				t.Errorf("WSAllowedOrigins = %q, want the CORS origins", cfg.WSAllowedOrigins)
+			}
+			if !reflect.DeepEqual(cfg.BannedWords, []string{"spam", "scam"}) {
+				t.Errorf("BannedWords = %q", cfg.BannedWords)
+			}
+			if cfg.WSPingInterval != 20*time.Second || cfg.WSPongTimeout != time.Minute {
+				t.Errorf("WSPingInterval = %s, WSPongTimeout = %s", cfg.WSPingInterval, cfg.WSPongTimeout)
+			}
+			if cfg.MessageRateLimit != 2.5 || cfg.MaxMessageLength != 500 || !cfg.S3UseSSL {
+				t.Errorf("MessageRateLimit = %g, MaxMessageLength = %d, S3UseSSL = %v", cfg.MessageRateLimit, cfg.MaxMessageLength, cfg.S3UseSSL)
+			}
+		})
+	}
+}
+
+func TestLoadListsFromEnv(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("BANNED_WORDS", " spam, ,scam ")
+
+	cfg, err := Load(nil)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !reflect.DeepEqual(cfg.BannedWords, []string{"spam", "scam"}) {
+		t.Errorf("BannedWords = %q", cfg.BannedWords)
+	}
+}
+
+func TestLoadRejectsBadFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    []string
+	}{
+		{"unknown yaml keys", "gochat.yaml", "prot: 9000\nsmtp_hots: mail\n", []string{`unknown key "prot"`, `unknown key "smtp_hots"`}},
+		{"unknown toml key", "gochat.toml", "prot = 9000\n", []string{`unknown key "prot"`}},
+		{"bad duration", "gochat.yaml", "ws_ping_interval: soon\n", []string{`ws_ping_interval: invalid duration "soon"`}},
+		{"table", "gochat.yaml", "cors_origins:\n  origin: https://chat.example.com\n", []string{"cors_origins: expected a value or a list, got a table"}},
+		{"json", "gochat.json", "{}", []string{"unsupported format"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			_, err := Load([]string{"-config", writeConfig(t, tt.file, tt.content)})
+			if err == nil {
+				t.Fatal("Load succeeded")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadReportsEveryError(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("MAX_MESSAGE_LENGTH", "lots")
+	path := writeConfig(t, "gochat.yaml", "prot: 9000\nlog_level: loud\n")
+
+	_, err := Load([]string{"-config", path, "-queue-concurrency", "0"})
+	if err == nil {
+		t.Fatal("Load succeeded")
+	}
+	for _, want := range []string{
+		`unknown key "prot"`,
+		`MAX_MESSAGE_LENGTH: invalid integer "lots"`,
+		`LOG_LEVEL must be a log level`,
+		`QUEUE_CONCURRENCY must be positive`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't mention %q", err, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := defaults().Validate(); err != nil {
+		t.Fatalf("defaults don't validate: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		want   []string
+	}{
+		{
+			"ports",
+			func(c *Config) { c.Port, c.SMTPPort = "0", "smtp" },
+			[]string{`PORT must be a port number, got "0"`, `SMTP_PORT must be a port number, got "smtp"`},
+		},
+		{
+			"origins",
+			func(c *Config) {
+				c.CORSOrigins = []string{"https://chat.example.com/app"}
+				c.WSAllowedOrigins = []string{"https://chat.example.com/app", "chat.example.com"}
+			},
+			[]string{"CORS_ORIGINS:", `WS_ALLOWED_ORIGINS: "chat.example.com"`},
+		},
+		{
+			"websocket timing",
+			func(c *Config) { c.WSPingInterval, c.WSReadLimit = time.Minute, 10 },
+			[]string{"WS_PING_INTERVAL (1m0s) must be positive and shorter than WS_PONG_TIMEOUT (1m0s)", "WS_READ_LIMIT (10) must be at least MAX_MESSAGE_LENGTH (1000)"},
+		},
+		{
+			"dependent settings",
+			func(c *Config) {
+				c.EmailTransport, c.EmailFileDir = "file", ""
+				c.StorageDriver, c.S3Bucket = "s3", ""
+				c.MessageRateBurst = 0
+			},
+			[]string{"EMAIL_FILE_DIR is required", "S3_ENDPOINT and S3_BUCKET are required", "MESSAGE_RATE_BURST must be positive"},
+		},
+		{
+			"enums",
+			func(c *Config) {
+				c.TracingExporter, c.SMTPSecurity, c.BannedWords = "jaeger", "ssl", []string{"two words"}
+			},
+			[]string{"TRACING_EXPORTER must be", "SMTP_SECURITY must be", `BANNED_WORDS: "two words"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaults()
+			tt.modify(cfg)
+
+			err := cfg.Validate()
+			if err == nil {
+				t.Fatal("Validate succeeded")
+			}
+			if got := strings.Count(err.Error(), "\n") + 1; got != len(tt.want) {
+				t.Errorf("got %d errors, want %d: %v", got, len(tt.want), err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't mention %q", err, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Store holds the running configuration. Reload re-reads every source and
+// swaps in the settings tagged reload; the rest need a restart and keep their
+// startup values.
+type Store struct {
+	args    []string
+	current atomic.Pointer[Config]
+
+	mu       sync.Mutex
+	onReload []func(old, cfg *Config)
+}
+
+// NewStore wraps cfg, loaded from args, for reloading.
+func NewStore(cfg *Config, args []string) *Store {
+	s := &Store{args: args}
+	s.current.Store(cfg)
+	return s
+}
+
+// Current returns the configuration in effect. It must not be modified.
+func (s *Store) Current() *Config {
+	return s.current.Load()
+}
+
+// OnReload registers fn to run after each reload that changed something.
+func (s *Store) OnReload(fn func(old, cfg *Config)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onReload = append(s.onReload, fn)
+}
+
+// Reload loads and validates the configuration again. An invalid
+// configuration is rejected and the current one stays in effect.
+func (s *Store) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	loaded, err := Load(s.args)
+	if err != nil {
+		return err
+	}
+
+	old := s.Current()
+	next := *old
+	nextFields := fieldsOf(&next)
+
+	var changed []logrus.Fields
+	for i, f := range fieldsOf(loaded) {
+		current := nextFields[i]
+		if reflect.DeepEqual(current.value.Interface(), f.value.Interface()) {
+			continue
+		}
+		if !f.reloadable {
+			logrus.WithField("key", f.key).Warn("Config change needs a restart to take effect")
+			continue
+		}
+		changed = append(changed, logrus.Fields{
+			"key": f.key,
+			"old": current.value.Interface(),
+			"new": f.value.Interface(),
+		})
+		current.value.Set(f.value)
+	}
+
+	if len(changed) == 0 {
+		logrus.Info("Config reloaded, nothing to apply")
+		return nil
+	}
+
+	// Reloadable settings are validated against the ones that stayed
+	if err := next.Validate(); err != nil {
+		return err
+	}
+
+	s.current.Store(&next)
+	for _, change := range changed {
+		logrus.WithFields(change).Info("Config changed")
+	}
+	for _, fn := range s.onReload {
+		fn(old, &next)
+	}
+
+	logrus.WithField("changes", len(changed)).Info("Config reloaded")
+	return nil
+}
+
+// Watch reloads on SIGHUP and, when a config file is in use and interval is
+// positive, whenever the file's modification time changes. It returns when
+// ctx is done.
+func (s *Store) Watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	path := s.Current().ConfigFile
+	var tick <-chan time.Time
+	var modTime time.Time
+	if path != "" && interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+		modTime, _ = fileModTime(path)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			s.reload("SIGHUP")
+		case <-tick:
+			t, err := fileModTime(path)
+			if err != nil || t.Equal(modTime) {
+				continue
+			}
+			modTime = t
+			s.reload(fmt.Sprintf("%s changed", path))
+		}
+	}
+}
+
+func (s *Store) reload(reason string) {
+	logrus.WithField("reason", reason).Info("Reloading config")
+	if err := s.Reload(); err != nil {
+		logrus.WithField("reason", reason).Error("Rejected config reload, keeping the current config: ", err)
+	}
+}
+
+func fileModTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// Changes lists the keys whose values differ between old and cfg.
+func Changes(old, cfg *Config) []string {
+	oldFields := fieldsOf(old)
+	var keys []string
+	for i, f := range fieldsOf(cfg) {
+		if !reflect.DeepEqual(oldFields[i].value.Interface(), f.value.Interface()) {
+			keys = append(keys, f.key)
+		}
+	}
+	return keys
+}
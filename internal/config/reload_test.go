@@ -0,0 +1,153 @@
+package config
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestStore loads content from a temp config file and returns a Store
+// for it, the file's path and the configs passed to OnReload callbacks.
+func newTestStore(t *testing.T, content string) (*Store, string, *[][2]*Config) {
+	t.Helper()
+	clearEnv(t)
+	path := writeConfig(t, "gochat.yaml", content)
+	args := []string{"-config", path}
+
+	cfg, err := Load(args)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	store := NewStore(cfg, args)
+
+	var reloads [][2]*Config
+	store.OnReload(func(old, cfg *Config) {
+		reloads = append(reloads, [2]*Config{old, cfg})
+	})
+	return store, path, &reloads
+}
+
+func rewriteConfig(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadAppliesReloadableKeys(t *testing.T) {
+	store, path, reloads := newTestStore(t, "log_level: info\n")
+	initial := store.Current()
+
+	rewriteConfig(t, path, "log_level: debug\nbanned_words: [spam]\n")
+	if err := store.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+
+	cfg := store.Current()
+	if cfg.LogLevel != "debug" || !reflect.DeepEqual(cfg.BannedWords, []string{"spam"}) {
+		t.Errorf("LogLevel = %q, BannedWords = %q", cfg.LogLevel, cfg.BannedWords)
+	}
+	if initial.LogLevel != "info" {
+		t.Errorf("the old config was modified, LogLevel = %q", initial.LogLevel)
+	}
+
+	if len(*reloads) != 1 {
+		t.Fatalf("OnReload ran %d times, want once", len(*reloads))
+	}
+	if old, next := (*reloads)[0][0], (*reloads)[0][1]; old != initial || next != cfg {
+		t.Errorf("OnReload got (%p, %p), want (%p, %p)", old, next, initial, cfg)
+	}
+	if keys := Changes(initial, cfg); !reflect.DeepEqual(keys, []string{"log_level", "banned_words"}) {
+		t.Errorf("Changes = %q", keys)
+	}
+}
+
+func TestReloadKeepsRestartOnlyKeys(t *testing.T) {
+	store, path, reloads := newTestStore(t, "port: \"8080\"\nlog_level: info\n")
+
+	rewriteConfig(t, path, "port: \"9090\"\nlog_level: info\n")
+	if err := store.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if store.Current().Port != "8080" {
+		t.Errorf("Port = %q, want it kept until a restart", store.Current().Port)
+	}
+	if len(*reloads) != 0 {
+		t.Errorf("OnReload ran %d times, want none when only restart-only keys changed", len(*reloads))
+	}
+
+	rewriteConfig(t, path, "port: \"9090\"\nlog_level: warn\n")
+	if err := store.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if cfg := store.Current(); cfg.Port != "8080" || cfg.LogLevel != "warn" {
+		t.Errorf("Port = %q, LogLevel = %q, want 8080 and warn", cfg.Port, cfg.LogLevel)
+	}
+	if len(*reloads) != 1 {
+		t.Errorf("OnReload ran %d times, want once", len(*reloads))
+	}
+}
+
+func TestReloadWithoutChanges(t *testing.T) {
+	store, _, reloads := newTestStore(t, "log_level: info\n")
+	initial := store.Current()
+
+	if err := store.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if store.Current() != initial {
+		t.Error("Reload replaced the config although nothing changed")
+	}
+	if len(*reloads) != 0 {
+		t.Errorf("OnReload ran %d times, want none", len(*reloads))
+	}
+}
+
+func TestReloadRejectsInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		initial string
+		next    string
+		want    string
+	}{
+		{
+			"invalid file",
+			"log_level: info\n",
+			"log_level: loud\n",
+			"LOG_LEVEL must be a log level",
+		},
+		{
+			"unknown key",
+			"log_level: info\n",
+			"log_level: debug\nprot: 9000\n",
+			`unknown key "prot"`,
+		},
+		{
+			// Valid on its own, but the read limit only changes on restart
+			"invalid with the kept keys",
+			"ws_read_limit: 8192\nmax_message_length: 5000\n",
+			"ws_read_limit: 10000\nmax_message_length: 9000\n",
+			"WS_READ_LIMIT (8192) must be at least MAX_MESSAGE_LENGTH (9000)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, path, reloads := newTestStore(t, tt.initial)
+			initial := store.Current()
+
+			rewriteConfig(t, path, tt.next)
+			err := store.Reload()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Reload = %v, want an error mentioning %q", err, tt.want)
+			}
+			if store.Current() != initial {
+				t.Error("the rejected config was applied")
+			}
+			if len(*reloads) != 0 {
+				t.Errorf("OnReload ran %d times, want none", len(*reloads))
+			}
+		})
+	}
+}
@@ -6,6 +6,8 @@ import (
 
     "go.mongodb.org/mongo-driver/mongo"
     "go.mongodb.org/mongo-driver/mongo/options"
+    "go.mongodb.org/mongo-driver/mongo/readpref"
+    "go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
 )
 
 var client *mongo.Client
@@ -15,7 +17,8 @@ func Connect(uri, dbName string) (*mongo.Database, error) {
     defer cancel()
 
     var err error
-    client, err = mongo.Connect(ctx, options.Client().ApplyURI(uri))
+    // The monitor turns every Mongo command into a span of the caller's trace
+    client, err = mongo.Connect(ctx, options.Client().ApplyURI(uri).SetMonitor(otelmongo.NewMonitor()))
     if err != nil {
         return nil, err
     }
@@ -27,6 +30,14 @@ func Connect(uri, dbName string) (*mongo.Database, error) {
     return client.Database(dbName), nil
 }
 
+// Ping checks the primary is reachable.
+func Ping(ctx context.Context) error {
+    if client == nil {
+        return mongo.ErrClientDisconnected
+    }
+    return client.Ping(ctx, readpref.Primary())
+}
+
 func Disconnect() error {
     if client != nil {
         ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -0,0 +1,178 @@
+// internal/handlers/attachment_handler.go
+package handlers
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+
+	"gochat-server/internal/models"
+	"gochat-server/internal/services"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+type AttachmentHandler struct {
+	attachmentService *services.AttachmentService
+}
+
+func NewAttachmentHandler(attachmentService *services.AttachmentService) *AttachmentHandler {
+	return &AttachmentHandler{
+		attachmentService: attachmentService,
+	}
+}
+
+func (h *AttachmentHandler) UploadAttachment(c echo.Context) error {
+	roomID := c.Param("roomID")
+	userID := c.FormValue("user_id")
+	if userID == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Missing required field: user_id",
+		})
+	}
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Missing file",
+		})
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Unable to read file",
+		})
+	}
+	defer src.Close()
+
+	attachment, err := h.attachmentService.Upload(c.Request().Context(), roomID, userID, file.Filename, src)
+	switch {
+	case errors.Is(err, services.ErrAttachmentTooLarge):
+		return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{
+			"error": err.Error(),
+		})
+	case errors.Is(err, services.ErrAttachmentTypeNotAllowed):
+		return c.JSON(http.StatusUnsupportedMediaType, map[string]string{
+			"error": err.Error(),
+		})
+	case err != nil:
+		logrus.Error("Failed to store attachment: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to store attachment",
+		})
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"roomID":       roomID,
+		"userID":       userID,
+		"attachmentID": attachment.ID.Hex(),
+		"size":         attachment.Size,
+	}).Info("Attachment uploaded")
+
+	return c.JSON(http.StatusCreated, attachment)
+}
+
+func (h *AttachmentHandler) GetAttachment(c echo.Context) error {
+	return h.serveAttachment(c, false)
+}
+
+func (h *AttachmentHandler) GetThumbnail(c echo.Context) error {
+	return h.serveAttachment(c, true)
+}
+
+func (h *AttachmentHandler) serveAttachment(c echo.Context, thumbnail bool) error {
+	ctx := c.Request().Context()
+
+	attachment, err := h.attachmentService.GetAttachment(ctx, c.Param("id"))
+	if errors.Is(err, services.ErrAttachmentNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Attachment not found",
+		})
+	}
+	if err != nil {
+		logrus.Error("Failed to fetch attachment: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to fetch attachment",
+		})
+	}
+
+	key, contentType := attachment.StorageKey, attachment.MimeType
+	if thumbnail {
+		if !attachment.HasThumbnail {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": "Thumbnail not available",
+			})
+		}
+		key, contentType = attachment.ThumbnailKey, "image/jpeg"
+	}
+
+	blob, err := h.attachmentService.Open(ctx, key)
+	if err != nil {
+		logrus.Error("Failed to open attachment blob: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to fetch attachment",
+		})
+	}
+	defer blob.Close()
+
+	if !thumbnail {
+		c.Response().Header().Set(echo.HeaderContentDisposition,
+			mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Name}))
+		c.Response().Header().Set("X-Checksum-SHA256", attachment.Checksum)
+	}
+	c.Response().Header().Set("X-Content-Type-Options", "nosniff")
+
+	c.Response().Header().Set(echo.HeaderContentType, contentType)
+	c.Response().WriteHeader(http.StatusOK)
+	_, err = io.Copy(c.Response(), blob)
+	return err
+}
+
+func (h *AttachmentHandler) GetRoomLimits(c echo.Context) error {
+	limits, err := h.attachmentService.GetRoomLimits(c.Request().Context(), c.Param("roomID"))
+	if err != nil {
+		logrus.Error("Failed to fetch attachment limits: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to fetch attachment limits",
+		})
+	}
+
+	return c.JSON(http.StatusOK, limits)
+}
+
+func (h *AttachmentHandler) SetRoomLimits(c echo.Context) error {
+	var limits models.AttachmentLimits
+	if err := c.Bind(&limits); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid request payload",
+		})
+	}
+
+	if limits.MaxSize <= 0 || len(limits.AllowedTypes) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Missing required fields: max_size, allowed_types",
+		})
+	}
+	limits.RoomID = c.Param("roomID")
+
+	err := h.attachmentService.SetRoomLimits(c.Request().Context(), &limits)
+	if errors.Is(err, services.ErrAttachmentLimitTooHigh) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		logrus.Error("Failed to save attachment limits: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to save attachment limits",
+		})
+	}
+
+	setAuditDetail(c, "max_size", limits.MaxSize)
+	setAuditDetail(c, "allowed_types", limits.AllowedTypes)
+
+	return c.JSON(http.StatusOK, limits)
+}
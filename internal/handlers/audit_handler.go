@@ -0,0 +1,108 @@
+// internal/handlers/audit_handler.go
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gochat-server/internal/services"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// AuditHandler lets admins query and export the audit trail.
+type AuditHandler struct {
+	auditService *services.AuditService
+}
+
+func NewAuditHandler(auditService *services.AuditService) *AuditHandler {
+	return &AuditHandler{
+		auditService: auditService,
+	}
+}
+
+func (h *AuditHandler) ListEvents(c echo.Context) error {
+	filter, err := auditFilter(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = defaultAuditLimit
+	}
+	filter.Limit = min(filter.Limit, maxAuditLimit)
+
+	events, err := h.auditService.Find(c.Request().Context(), filter)
+	if err != nil {
+		logrus.Error("Failed to query audit log: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to query audit log",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"events": events,
+		"count":  len(events),
+	})
+}
+
+// ExportEvents streams every matching event as JSON Lines, oldest first.
+func (h *AuditHandler) ExportEvents(c echo.Context) error {
+	filter, err := auditFilter(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="audit-log.jsonl"`)
+	res.WriteHeader(http.StatusOK)
+
+	// Headers are gone by now, so a failure can only cut the export short
+	if err := h.auditService.Export(c.Request().Context(), filter, res); err != nil {
+		logrus.Error("Audit log export failed: ", err)
+	}
+	return nil
+}
+
+// auditFilter reads action, actor, target, since, until (RFC 3339) and limit
+// from the query string.
+func auditFilter(c echo.Context) (services.AuditFilter, error) {
+	filter := services.AuditFilter{
+		Action: c.QueryParam("action"),
+		Actor:  c.QueryParam("actor"),
+		Target: c.QueryParam("target"),
+	}
+
+	for param, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := c.QueryParam(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, fmt.Errorf("%s must be an RFC 3339 time", param)
+			}
+			*dst = t
+		}
+	}
+
+	if value := c.QueryParam("limit"); value != "" {
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || limit < 1 {
+			return filter, errors.New("limit must be a positive integer")
+		}
+		filter.Limit = limit
+	}
+
+	return filter, nil
+}
@@ -0,0 +1,232 @@
+// internal/handlers/bot_handler.go
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"gochat-server/internal/config"
+	"gochat-server/internal/hub"
+	"gochat-server/internal/models"
+	"gochat-server/internal/services"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// BotHandler manages bot accounts for admins and lets bots post messages.
+type BotHandler struct {
+	hub        *hub.Hub
+	botService *services.BotService
+	cfg        *config.Store
+	filter     atomic.Pointer[services.WordFilter]
+}
+
+func NewBotHandler(h *hub.Hub, botService *services.BotService, cfg *config.Store) *BotHandler {
+	handler := &BotHandler{
+		hub:        h,
+		botService: botService,
+		cfg:        cfg,
+	}
+
+	handler.filter.Store(services.NewWordFilter(cfg.Current().BannedWords))
+	cfg.OnReload(func(_, next *config.Config) {
+		handler.filter.Store(services.NewWordFilter(next.BannedWords))
+	})
+
+	return handler
+}
+
+type createBotRequest struct {
+	Name   string   `json:"name"`
+	Rooms  []string `json:"rooms"`
+	Scopes []string `json:"scopes"`
+}
+
+type postMessageRequest struct {
+	Content string `json:"content"`
+}
+
+func (h *BotHandler) CreateBot(c echo.Context) error {
+	var req createBotRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid request payload",
+		})
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Rooms) == 0 || len(req.Scopes) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Missing required fields: name, rooms, scopes",
+		})
+	}
+
+	bot, token, err := h.botService.CreateBot(c.Request().Context(), req.Name, req.Rooms, req.Scopes)
+	if errors.Is(err, services.ErrUnknownBotScope) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		logrus.Error("Failed to create bot: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to create bot",
+		})
+	}
+
+	setAuditDetail(c, "bot_id", bot.ID.Hex())
+	setAuditDetail(c, "name", bot.Name)
+	setAuditDetail(c, "rooms", bot.Rooms)
+	setAuditDetail(c, "scopes", bot.Scopes)
+
+	logrus.WithFields(logrus.Fields{
+		"bot_id": bot.ID.Hex(),
+		"name":   bot.Name,
+	}).Info("Created bot")
+
+	// The token is only ever shown here
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"bot":   bot,
+		"token": token,
+	})
+}
+
+func (h *BotHandler) ListBots(c echo.Context) error {
+	bots, err := h.botService.ListBots(c.Request().Context())
+	if err != nil {
+		logrus.Error("Failed to list bots: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list bots",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"bots":  bots,
+		"count": len(bots),
+	})
+}
+
+func (h *BotHandler) GetBot(c echo.Context) error {
+	bot, err := h.botService.GetBot(c.Request().Context(), c.Param("id"))
+	if errors.Is(err, services.ErrBotNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Bot not found",
+		})
+	}
+	if err != nil {
+		logrus.Error("Failed to fetch bot: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to fetch bot",
+		})
+	}
+
+	return c.JSON(http.StatusOK, bot)
+}
+
+func (h *BotHandler) RotateToken(c echo.Context) error {
+	token, err := h.botService.RotateToken(c.Request().Context(), c.Param("id"))
+	if errors.Is(err, services.ErrBotNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Bot not found",
+		})
+	}
+	if err != nil {
+		logrus.Error("Failed to rotate bot token: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to rotate bot token",
+		})
+	}
+
+	logrus.WithField("bot_id", c.Param("id")).Info("Rotated bot token")
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"token": token,
+	})
+}
+
+func (h *BotHandler) DeleteBot(c echo.Context) error {
+	err := h.botService.DeleteBot(c.Request().Context(), c.Param("id"))
+	if errors.Is(err, services.ErrBotNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Bot not found",
+		})
+	}
+	if err != nil {
+		logrus.Error("Failed to delete bot: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to delete bot",
+		})
+	}
+
+	logrus.WithField("bot_id", c.Param("id")).Info("Deleted bot")
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// PostMessage posts a message as the authenticated bot. It goes through the
+// hub like a WebSocket message, so it is saved, broadcast and notified on.
+func (h *BotHandler) PostMessage(c echo.Context) error {
+	bot := c.Get(botKey).(*models.Bot)
+	roomID := c.Param("roomID")
+
+	var req postMessageRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid request payload",
+		})
+	}
+
+	cfg := h.cfg.Current()
+	if strings.TrimSpace(req.Content) == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Missing required field: content",
+		})
+	}
+	if len(req.Content) > cfg.MaxMessageLength {
+		return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{
+			"error": "Message too long",
+		})
+	}
+
+	content, _ := h.filter.Load().Censor(req.Content)
+	message := &models.WSMessage{
+		Type:     "message",
+		RoomID:   roomID,
+		UserID:   services.BotUserID(bot),
+		Username: bot.Name,
+		Content:  content,
+		Bot:      true,
+		Context:  c.Request().Context(),
+	}
+
+	id, err := h.hub.Post(c.Request().Context(), message)
+	if errors.Is(err, hub.ErrStopped) {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{
+			"error": "Server is shutting down",
+		})
+	}
+	if errors.Is(err, hub.ErrRoomClosed) {
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": "Room is closed",
+		})
+	}
+	if err != nil {
+		logrus.Error("Failed to post bot message: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to post message",
+		})
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"roomID": roomID,
+		"botID":  bot.ID.Hex(),
+		"bot":    bot.Name,
+	}).Info("Bot message posted")
+
+	return c.JSON(http.StatusCreated, map[string]string{
+		"id": id,
+	})
+}
@@ -2,219 +2,382 @@
 package handlers
 
 import (
-    "gochat-server/internal/hub"
-    "gochat-server/internal/models"
-    "gochat-server/internal/services"
-    "net/http"
-    "strconv"
-    "time"
-
-    "github.com/gorilla/websocket"
-    "github.com/labstack/echo/v4"
-    "github.com/sirupsen/logrus"
+	"context"
+	"errors"
+	"gochat-server/internal/config"
+	"gochat-server/internal/hub"
+	"gochat-server/internal/models"
+	"gochat-server/internal/services"
+	"gochat-server/internal/tracing"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 )
 
-var upgrader = websocket.Upgrader{
-    ReadBufferSize:  1024,
-    WriteBufferSize: 1024,
-    CheckOrigin: func(r *http.Request) bool {
-        // Allow connections from localhost:3000 (frontend)
-        origin := r.Header.Get("Origin")
-        return origin == "http://localhost:3000" || 
-               origin == "http://127.0.0.1:3000" || 
-               origin == "https://localhost:3000" ||
-               origin == "" // Allow connections without origin (for testing)
-    },
+type ChatHandler struct {
+	hub               *hub.Hub
+	messageService    *services.MessageService
+	profileService    *services.ProfileService
+	membershipService *services.MembershipService
+	cfg               *config.Store
+	upgrader          websocket.Upgrader
+	filter            atomic.Pointer[services.WordFilter]
+
+	// SSE and long-poll sessions by token
+	sessionsMu sync.Mutex
+	sessions   map[string]*session
 }
 
-type ChatHandler struct {
-    hub            *hub.Hub
-    messageService *services.MessageService
+func NewChatHandler(
+	h *hub.Hub,
+	messageService *services.MessageService,
+	profileService *services.ProfileService,
+	membershipService *services.MembershipService,
+	cfg *config.Store,
+) *ChatHandler {
+	handler := &ChatHandler{
+		hub:               h,
+		messageService:    messageService,
+		profileService:    profileService,
+		membershipService: membershipService,
+		cfg:               cfg,
+		sessions:          make(map[string]*session),
+	}
+	handler.upgrader = websocket.Upgrader{
+		ReadBufferSize:  cfg.Current().WSReadBufferSize,
+		WriteBufferSize: cfg.Current().WSWriteBufferSize,
+		CheckOrigin:     handler.checkOrigin,
+	}
+
+	handler.filter.Store(services.NewWordFilter(cfg.Current().BannedWords))
+	cfg.OnReload(func(_, next *config.Config) {
+		handler.filter.Store(services.NewWordFilter(next.BannedWords))
+	})
+
+	return handler
 }
 
-func NewChatHandler(h *hub.Hub, messageService *services.MessageService) *ChatHandler {
-    return &ChatHandler{
-        hub:            h,
-        messageService: messageService,
-    }
+// checkOrigin allows the configured origins. Requests without an Origin
+// header don't come from a browser and are allowed (for testing).
+func (h *ChatHandler) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	allowed := h.cfg.Current().WSAllowedOrigins
+	return origin == "" || slices.Contains(allowed, "*") || slices.Contains(allowed, origin)
 }
 
 func (h *ChatHandler) HandleWebSocket(c echo.Context) error {
-    roomID := c.Param("roomID")
-    userID := c.Param("userID")
-    username := c.QueryParam("username")
-
-    if username == "" {
-        username = "Anonymous"
-    }
-
-    logrus.WithFields(logrus.Fields{
-        "roomID":   roomID,
-        "userID":   userID,
-        "username": username,
-    }).Info("WebSocket connection attempt")
-
-    conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
-    if err != nil {
-        logrus.Error("WebSocket upgrade failed: ", err)
-        return err
-    }
-
-    client := &hub.Client{
-        Hub:      h.hub,
-        Conn:     conn,
-        Send:     make(chan []byte, 256),
-        RoomID:   roomID,
-        UserID:   userID,
-        Username: username,
-    }
-
-    h.hub.Register <- client
-
-    // Start goroutines for reading and writing
-    go h.writePump(client)
-    go h.readPump(client)
-
-    return nil
+	roomID := c.Param("roomID")
+	userID := c.Param("userID")
+	username := c.QueryParam("username")
+
+	if username == "" {
+		username = "Anonymous"
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"roomID":   roomID,
+		"userID":   userID,
+		"username": username,
+	}).Info("WebSocket connection attempt")
+
+	if h.hub.Closing() {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{
+			"error": "Server is shutting down",
+		})
+	}
+	if _, closed := h.hub.RoomClosed(roomID); closed {
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": "Room is closed",
+		})
+	}
+
+	client := h.newClient(c, hub.TransportWebSocket, roomID, userID, username)
+
+	conn, err := h.upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		logrus.Error("WebSocket upgrade failed: ", err)
+		return err
+	}
+	client.Conn = conn
+
+	select {
+	case h.hub.Register <- client:
+	case <-h.hub.Done():
+		conn.Close()
+		return nil
+	}
+
+	// Start goroutines for reading and writing
+	go h.writePump(client)
+	go h.readPump(client)
+
+	return nil
 }
 
 func (h *ChatHandler) readPump(client *hub.Client) {
-    defer func() {
-        h.hub.Unregister <- client
-        client.Conn.Close()
-    }()
-
-    client.Conn.SetReadLimit(512)
-    client.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-    client.Conn.SetPongHandler(func(string) error {
-        client.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-        return nil
-    })
-
-    for {
-        var message models.WSMessage
-        err := client.Conn.ReadJSON(&message)
-        if err != nil {
-            if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-                logrus.Error("WebSocket error: ", err)
-            }
-            break
-        }
-
-        // Validate message content
-        if len(message.Content) > 1000 {
-            logrus.Warn("Message too long, rejecting")
-            continue
-        }
-
-        message.RoomID = client.RoomID
-        message.UserID = client.UserID
-        message.Username = client.Username
-
-        logrus.WithFields(logrus.Fields{
-            "roomID":   client.RoomID,
-            "userID":   client.UserID,
-            "username": client.Username,
-            "content":  message.Content,
-        }).Info("Message received")
-
-        h.hub.Broadcast <- &message
-    }
+	defer func() {
+		select {
+		case h.hub.Unregister <- client:
+		case <-h.hub.Done():
+		}
+		client.Conn.Close()
+	}()
+
+	cfg := h.cfg.Current()
+	client.Conn.SetReadLimit(cfg.WSReadLimit)
+	client.Conn.SetReadDeadline(time.Now().Add(cfg.WSPongTimeout))
+	client.Conn.SetPongHandler(func(string) error {
+		client.Conn.SetReadDeadline(time.Now().Add(cfg.WSPongTimeout))
+		return nil
+	})
+
+	var limiter *rate.Limiter
+
+	for {
+		var message models.WSMessage
+		err := client.Conn.ReadJSON(&message)
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				logrus.Error("WebSocket error: ", err)
+			}
+			break
+		}
+
+		limiter = h.messageLimiter(limiter)
+		if err := h.accept(client, limiter, &message); err != nil {
+			if errors.Is(err, hub.ErrStopped) {
+				return
+			}
+			logrus.WithField("userID", client.UserID).Warn("Rejected message: ", err)
+		}
+	}
+}
+
+// newClient records the user's profile and room membership and returns a
+// client for them over transport, not yet registered with the hub.
+func (h *ChatHandler) newClient(c echo.Context, transport, roomID, userID, username string) *hub.Client {
+	ctx := c.Request().Context()
+	if err := h.profileService.Touch(ctx, userID, username); err != nil {
+		logrus.Error("Failed to record user profile: ", err)
+	}
+	if err := h.membershipService.AddMember(ctx, roomID, userID); err != nil {
+		logrus.Error("Failed to record room membership: ", err)
+	}
+
+	return &hub.Client{
+		Hub:       h.hub,
+		Transport: transport,
+		Send:      make(chan []byte, h.cfg.Current().WSSendBufferSize),
+		RoomID:    roomID,
+		UserID:    userID,
+		Username:  username,
+		Quit:      make(chan struct{}),
+
+		ID:          primitive.NewObjectID().Hex(),
+		RemoteAddr:  c.RealIP(),
+		ConnectedAt: time.Now(),
+	}
+}
+
+var (
+	errRateLimited        = errors.New("message rate limit exceeded")
+	errMessageTooLong     = errors.New("message too long")
+	errTooManyAttachments = errors.New("too many attachments")
+)
+
+// messageLimiter returns the limiter to check a client's next message
+// against; limits may have been reloaded since its last one.
+func (h *ChatHandler) messageLimiter(limiter *rate.Limiter) *rate.Limiter {
+	cfg := h.cfg.Current()
+	return rateLimiter(limiter, cfg.MessageRateLimit, cfg.MessageRateBurst)
+}
+
+// accept validates a message the client sent, over whichever transport,
+// stamps it with the client's identity and hands it to the hub.
+func (h *ChatHandler) accept(client *hub.Client, limiter *rate.Limiter, message *models.WSMessage) error {
+	cfg := h.cfg.Current()
+	if !limiter.Allow() {
+		return errRateLimited
+	}
+
+	// Validate message content
+	if len(message.Content) > cfg.MaxMessageLength {
+		return errMessageTooLong
+	}
+
+	if len(message.AttachmentIDs) > cfg.MaxAttachmentsPerMessage {
+		return errTooManyAttachments
+	}
+
+	if content, masked := h.filter.Load().Censor(message.Content); masked {
+		logrus.WithField("userID", client.UserID).Info("Masked banned words in message")
+		message.Content = content
+	}
+
+	message.RoomID = client.RoomID
+	message.UserID = client.UserID
+	message.Username = client.Username
+	message.Bot = false
+
+	ctx, span := tracing.Tracer().Start(context.Background(), "ws.receive", trace.WithAttributes(
+		attribute.String("message.type", message.Type),
+		attribute.String("room.id", client.RoomID),
+		attribute.String("user.id", client.UserID),
+		attribute.String("transport", client.Transport),
+	))
+	defer span.End()
+	message.Context = ctx
+
+	logrus.WithFields(logrus.Fields{
+		"roomID":    client.RoomID,
+		"userID":    client.UserID,
+		"username":  client.Username,
+		"transport": client.Transport,
+		"content":   message.Content,
+	}).Info("Message received")
+
+	select {
+	case h.hub.Broadcast <- message:
+		return nil
+	case <-h.hub.Done():
+		return hub.ErrStopped
+	}
 }
 
 func (h *ChatHandler) writePump(client *hub.Client) {
-    ticker := time.NewTicker(54 * time.Second)
-    defer func() {
-        ticker.Stop()
-        client.Conn.Close()
-    }()
-
-    for {
-        select {
-        case message, ok := <-client.Send:
-            client.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-            if !ok {
-                client.Conn.WriteMessage(websocket.CloseMessage, []byte{})
-                return
-            }
-
-            w, err := client.Conn.NextWriter(websocket.TextMessage)
-            if err != nil {
-                return
-            }
-            w.Write(message)
-
-            // Add queued messages
-            n := len(client.Send)
-            for i := 0; i < n; i++ {
-                w.Write([]byte{'\n'})
-                w.Write(<-client.Send)
-            }
-
-            if err := w.Close(); err != nil {
-                return
-            }
-
-        case <-ticker.C:
-            client.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-            if err := client.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-                return
-            }
-        }
-    }
+	cfg := h.cfg.Current()
+	ticker := time.NewTicker(cfg.WSPingInterval)
+	defer func() {
+		ticker.Stop()
+		client.Conn.Close()
+	}()
+
+	for {
+		select {
+		case message, ok := <-client.Send:
+			client.Conn.SetWriteDeadline(time.Now().Add(cfg.WSWriteTimeout))
+			if !ok {
+				client.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+
+			w, err := client.Conn.NextWriter(websocket.TextMessage)
+			if err != nil {
+				return
+			}
+			w.Write(message)
+
+			// Add queued messages
+			n := len(client.Send)
+			for i := 0; i < n; i++ {
+				w.Write([]byte{'\n'})
+				w.Write(<-client.Send)
+			}
+
+			if err := w.Close(); err != nil {
+				return
+			}
+
+		case <-client.Quit:
+			client.Conn.SetWriteDeadline(time.Now().Add(cfg.WSWriteTimeout))
+			for n := len(client.Send); n > 0; n-- {
+				message, ok := <-client.Send
+				if !ok {
+					break
+				}
+				if err := client.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
+					return
+				}
+			}
+			client.Conn.WriteMessage(websocket.CloseMessage, client.CloseFrame())
+			return
+
+		case <-ticker.C:
+			client.Conn.SetWriteDeadline(time.Now().Add(cfg.WSWriteTimeout))
+			if err := client.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// rateLimiter returns limiter, or a fresh one if the configured rate changed.
+// A perSecond of zero means no limit.
+func rateLimiter(limiter *rate.Limiter, perSecond float64, burst int) *rate.Limiter {
+	limit := rate.Inf
+	if perSecond > 0 {
+		limit = rate.Limit(perSecond)
+	} else {
+		burst = 0
+	}
+	if limiter == nil || limiter.Limit() != limit || limiter.Burst() != burst {
+		return rate.NewLimiter(limit, burst)
+	}
+	return limiter
 }
 
 func (h *ChatHandler) GetRoomMessages(c echo.Context) error {
-    roomID := c.Param("roomID")
-    limitStr := c.QueryParam("limit")
-    
-    limit := 50 // default
-    if limitStr != "" {
-        if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
-            limit = l
-        }
-    }
-
-    logrus.WithFields(logrus.Fields{
-        "roomID": roomID,
-        "limit":  limit,
-    }).Info("Fetching room messages")
-
-    messages, err := h.messageService.GetRoomMessages(roomID, limit)
-    if err != nil {
-        logrus.Error("Failed to fetch messages: ", err)
-        return c.JSON(http.StatusInternalServerError, map[string]string{
-            "error": "Failed to fetch messages",
-        })
-    }
-
-    return c.JSON(http.StatusOK, messages)
+	roomID := c.Param("roomID")
+	limitStr := c.QueryParam("limit")
+
+	limit := 50 // default
+	if limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"roomID": roomID,
+		"limit":  limit,
+	}).Info("Fetching room messages")
+
+	messages, err := h.messageService.GetRoomMessages(roomID, limit)
+	if err != nil {
+		logrus.Error("Failed to fetch messages: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to fetch messages",
+		})
+	}
+
+	return c.JSON(http.StatusOK, messages)
 }
 
 func (h *ChatHandler) GetRoomUsers(c echo.Context) error {
-    roomID := c.Param("roomID")
-    
-    logrus.WithFields(logrus.Fields{
-        "roomID": roomID,
-    }).Info("Fetching room users")
-    
-    room := h.hub.GetRoom(roomID)
-    if room == nil {
-        return c.JSON(http.StatusOK, map[string]interface{}{
-            "room_id": roomID,
-            "users":   []interface{}{},
-            "count":   0,
-        })
-    }
-
-    users := make([]*models.User, 0, len(room.Users))
-    for _, user := range room.Users {
-        users = append(users, user)
-    }
-
-    return c.JSON(http.StatusOK, map[string]interface{}{
-        "room_id": roomID,
-        "users":   users,
-        "count":   len(users),
-    })
+	roomID := c.Param("roomID")
+
+	logrus.WithFields(logrus.Fields{
+		"roomID": roomID,
+	}).Info("Fetching room users")
+
+	room := h.hub.GetRoom(roomID)
+	if room == nil {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"room_id": roomID,
+			"users":   []interface{}{},
+			"count":   0,
+		})
+	}
+
+	users := make([]*models.User, 0, len(room.Users))
+	for _, user := range room.Users {
+		users = append(users, user)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"room_id": roomID,
+		"users":   users,
+		"count":   len(users),
+	})
 }
@@ -0,0 +1,419 @@
+// internal/handlers/chat_sessions.go
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gochat-server/internal/hub"
+	"gochat-server/internal/models"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultPollWait = 25 * time.Second
+	maxPollWait     = 55 * time.Second
+)
+
+// session is a hub client connected over SSE or long polling rather than a
+// WebSocket. Its token authenticates the requests that make up the
+// connection, including messages sent over REST.
+type session struct {
+	token  string
+	client *hub.Client
+
+	mu      sync.Mutex // guards limiter
+	limiter *rate.Limiter
+
+	// polling holds a token while a long poll is in progress, so there is
+	// at most one and expireSession can wait for it to finish
+	polling  chan struct{}
+	lastSeen atomic.Int64 // UnixNano of the last request
+}
+
+func (s *session) touch() {
+	s.lastSeen.Store(time.Now().UnixNano())
+}
+
+// openSession registers a client for the user over transport and returns
+// its session. It fails with hub.ErrStopped while the server is stopping
+// and with hub.ErrRoomClosed if an admin has closed the room.
+func (h *ChatHandler) openSession(c echo.Context, transport string) (*session, error) {
+	if h.hub.Closing() {
+		return nil, hub.ErrStopped
+	}
+	if _, closed := h.hub.RoomClosed(c.Param("roomID")); closed {
+		return nil, hub.ErrRoomClosed
+	}
+
+	username := c.QueryParam("username")
+	if username == "" {
+		username = "Anonymous"
+	}
+	client := h.newClient(c, transport, c.Param("roomID"), c.QueryParam("user_id"), username)
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	s := &session{
+		token:   base64.RawURLEncoding.EncodeToString(secret),
+		client:  client,
+		polling: make(chan struct{}, 1),
+	}
+	s.touch()
+
+	select {
+	case h.hub.Register <- client:
+	case <-h.hub.Done():
+		return nil, hub.ErrStopped
+	}
+
+	h.sessionsMu.Lock()
+	h.sessions[s.token] = s
+	h.sessionsMu.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"roomID":    client.RoomID,
+		"userID":    client.UserID,
+		"transport": transport,
+	}).Info("Session opened")
+
+	return s, nil
+}
+
+func (h *ChatHandler) session(token string) *session {
+	h.sessionsMu.Lock()
+	defer h.sessionsMu.Unlock()
+	return h.sessions[token]
+}
+
+// closeSession unregisters the session's client. It is safe to call more
+// than once.
+func (h *ChatHandler) closeSession(s *session) {
+	h.sessionsMu.Lock()
+	_, open := h.sessions[s.token]
+	delete(h.sessions, s.token)
+	h.sessionsMu.Unlock()
+	if !open {
+		return
+	}
+
+	select {
+	case h.hub.Unregister <- s.client:
+	case <-h.hub.Done():
+	}
+}
+
+// HandleEvents streams the room to the client as Server-Sent Events, for
+// clients that can't open a WebSocket. The first event, "session", carries
+// the session ID to send messages with; each message is then a default
+// event, and a "close" event says why the server ended the stream.
+func (h *ChatHandler) HandleEvents(c echo.Context) error {
+	if c.QueryParam("user_id") == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Missing required query parameter: user_id",
+		})
+	}
+
+	s, err := h.openSession(c, hub.TransportSSE)
+	if errors.Is(err, hub.ErrStopped) {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{
+			"error": "Server is shutting down",
+		})
+	}
+	if errors.Is(err, hub.ErrRoomClosed) {
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": "Room is closed",
+		})
+	}
+	if err != nil {
+		logrus.Error("Failed to open SSE session: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to open session",
+		})
+	}
+	defer h.closeSession(s)
+	client := s.client
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	cfg := h.cfg.Current()
+	rc := http.NewResponseController(w)
+	send := func(event string, data []byte) error {
+		rc.SetWriteDeadline(time.Now().Add(cfg.WSWriteTimeout))
+		if event != "" {
+			fmt.Fprintf(w, "event: %s\n", event)
+		}
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		return rc.Flush()
+	}
+
+	hello, _ := json.Marshal(map[string]string{
+		"session_id":    s.token,
+		"connection_id": client.ID,
+	})
+	if err := send("session", hello); err != nil {
+		return nil
+	}
+
+	ticker := time.NewTicker(cfg.WSPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case message, ok := <-client.Send:
+			if !ok {
+				return nil
+			}
+			if err := send("", message); err != nil {
+				return nil
+			}
+
+		case <-client.Quit:
+			for n := len(client.Send); n > 0; n-- {
+				message, ok := <-client.Send
+				if !ok {
+					break
+				}
+				if err := send("", message); err != nil {
+					return nil
+				}
+			}
+			reason, _ := json.Marshal(map[string]string{"reason": client.CloseReason()})
+			send("close", reason)
+			return nil
+
+		case <-ticker.C:
+			// A comment, so proxies don't time the stream out
+			rc.SetWriteDeadline(time.Now().Add(cfg.WSWriteTimeout))
+			fmt.Fprint(w, ": ping\n\n")
+			if err := rc.Flush(); err != nil {
+				return nil
+			}
+
+		case <-c.Request().Context().Done():
+			return nil
+		}
+	}
+}
+
+// OpenPollSession joins the room with a long-poll session. The client then
+// polls for messages and sends over REST; the session expires if it isn't
+// polled for WS_PONG_TIMEOUT.
+func (h *ChatHandler) OpenPollSession(c echo.Context) error {
+	if c.QueryParam("user_id") == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Missing required query parameter: user_id",
+		})
+	}
+
+	s, err := h.openSession(c, hub.TransportLongPoll)
+	if errors.Is(err, hub.ErrStopped) {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{
+			"error": "Server is shutting down",
+		})
+	}
+	if errors.Is(err, hub.ErrRoomClosed) {
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": "Room is closed",
+		})
+	}
+	if err != nil {
+		logrus.Error("Failed to open long-poll session: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to open session",
+		})
+	}
+	go h.expireSession(s)
+
+	return c.JSON(http.StatusCreated, map[string]string{
+		"session_id":    s.token,
+		"connection_id": s.client.ID,
+	})
+}
+
+// expireSession closes a long-poll session once the server has closed its
+// client or it has gone unpolled for too long.
+func (h *ChatHandler) expireSession(s *session) {
+	idle := h.cfg.Current().WSPongTimeout
+	timer := time.NewTimer(idle)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.client.Quit:
+			// Let a poll in progress deliver what was flushed first. The
+			// token is kept, as the session is closed for good.
+			s.polling <- struct{}{}
+			h.closeSession(s)
+			return
+
+		case <-timer.C:
+			left := idle - time.Since(time.Unix(0, s.lastSeen.Load()))
+			if len(s.polling) > 0 || left > 0 {
+				timer.Reset(max(left, time.Second))
+				continue
+			}
+			logrus.WithFields(logrus.Fields{
+				"roomID": s.client.RoomID,
+				"userID": s.client.UserID,
+			}).Info("Long-poll session expired")
+			h.closeSession(s)
+			return
+		}
+	}
+}
+
+// Poll waits up to wait seconds (25 by default) for messages and returns
+// everything queued for the session. When the server has closed the
+// session, closed is true and reason says why.
+func (h *ChatHandler) Poll(c echo.Context) error {
+	s := h.session(c.Param("sessionID"))
+	if s == nil || s.client.Transport != hub.TransportLongPoll {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Session not found",
+		})
+	}
+	select {
+	case s.polling <- struct{}{}:
+		defer func() { <-s.polling }()
+	default:
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": "Session is already being polled",
+		})
+	}
+	defer s.touch()
+
+	wait := defaultPollWait
+	if seconds, err := strconv.Atoi(c.QueryParam("wait")); err == nil && seconds >= 0 {
+		wait = min(time.Duration(seconds)*time.Second, maxPollWait)
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	client := s.client
+	messages := []json.RawMessage{}
+	closed := false
+	select {
+	case message, ok := <-client.Send:
+		if ok {
+			messages = append(messages, message)
+		} else {
+			closed = true
+		}
+	case <-client.Quit:
+		closed = true
+	case <-timer.C:
+	case <-c.Request().Context().Done():
+		return nil
+	}
+
+	for n := len(client.Send); n > 0; n-- {
+		message, ok := <-client.Send
+		if !ok {
+			break
+		}
+		messages = append(messages, message)
+	}
+
+	select {
+	case <-client.Quit:
+		closed = true
+	default:
+	}
+	if !closed {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"messages": messages,
+		})
+	}
+
+	h.closeSession(s)
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"messages": messages,
+		"closed":   true,
+		"reason":   client.CloseReason(),
+	})
+}
+
+// SendMessage is how SSE and long-poll sessions send what a WebSocket client
+// would write to its socket. The message goes through the same checks and
+// hub pipeline.
+func (h *ChatHandler) SendMessage(c echo.Context) error {
+	s := h.session(c.Param("sessionID"))
+	if s == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Session not found",
+		})
+	}
+	s.touch()
+
+	var message models.WSMessage
+	if err := c.Bind(&message); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid request payload",
+		})
+	}
+	if message.Type == "" {
+		message.Type = "message"
+	}
+
+	s.mu.Lock()
+	s.limiter = h.messageLimiter(s.limiter)
+	limiter := s.limiter
+	s.mu.Unlock()
+
+	err := h.accept(s.client, limiter, &message)
+	switch {
+	case errors.Is(err, errRateLimited):
+		return c.JSON(http.StatusTooManyRequests, map[string]string{
+			"error": "Message rate limit exceeded",
+		})
+	case errors.Is(err, errMessageTooLong):
+		return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{
+			"error": "Message too long",
+		})
+	case errors.Is(err, errTooManyAttachments):
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Too many attachments",
+		})
+	case errors.Is(err, hub.ErrStopped):
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{
+			"error": "Server is shutting down",
+		})
+	}
+
+	return c.JSON(http.StatusAccepted, map[string]string{
+		"status": "accepted",
+	})
+}
+
+// CloseSession leaves the room. SSE sessions can also just drop the stream.
+func (h *ChatHandler) CloseSession(c echo.Context) error {
+	s := h.session(c.Param("sessionID"))
+	if s == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Session not found",
+		})
+	}
+
+	s.client.CloseWith(websocket.CloseNormalClosure, "session closed")
+	h.closeSession(s)
+	return c.NoContent(http.StatusNoContent)
+}
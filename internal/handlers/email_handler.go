@@ -2,20 +2,24 @@
 package handlers
 
 import (
+    "errors"
     "gochat-server/internal/models"
-    "gochat-server/internal/queue"
+    "gochat-server/internal/services"
     "net/http"
+    "net/mail"
+    "strconv"
 
     "github.com/labstack/echo/v4"
+    "github.com/sirupsen/logrus"
 )
 
 type EmailHandler struct {
-    queueManager *queue.Manager
+    emailService *services.EmailService
 }
 
-func NewEmailHandler(queueManager *queue.Manager) *EmailHandler {
+func NewEmailHandler(emailService *services.EmailService) *EmailHandler {
     return &EmailHandler{
-        queueManager: queueManager,
+        emailService: emailService,
     }
 }
 
@@ -27,13 +31,32 @@ func (h *EmailHandler) QueueEmail(c echo.Context) error {
         })
     }
 
-    if payload.To == "" || payload.Subject == "" || payload.Body == "" {
+    if payload.To == "" || (payload.Template == "" && (payload.Subject == "" || payload.Body == "")) {
         return c.JSON(http.StatusBadRequest, map[string]string{
-            "error": "Missing required fields: to, subject, body",
+            "error": "Missing required fields: to, and either template or subject and body",
         })
     }
 
-    if err := h.queueManager.QueueEmail(&payload); err != nil {
+    to, err := mail.ParseAddress(payload.To)
+    if err != nil {
+        return c.JSON(http.StatusBadRequest, map[string]string{
+            "error": "Invalid email address: to",
+        })
+    }
+    payload.To = to.Address
+
+    // Unsubscribe links are only minted for notifications we generate ourselves
+    payload.UserID = ""
+    payload.RoomID = ""
+
+    if payload.Template != "" && !h.emailService.HasTemplate(payload.Template) {
+        return c.JSON(http.StatusBadRequest, map[string]string{
+            "error": "Unknown email template: " + payload.Template,
+        })
+    }
+
+    taskID, err := h.emailService.QueueEmail(c.Request().Context(), &payload)
+    if err != nil {
         return c.JSON(http.StatusInternalServerError, map[string]string{
             "error": "Failed to queue email",
         })
@@ -41,5 +64,75 @@ func (h *EmailHandler) QueueEmail(c echo.Context) error {
 
     return c.JSON(http.StatusOK, map[string]string{
         "message": "Email queued successfully",
+        "id":      taskID,
+    })
+}
+
+func (h *EmailHandler) GetEmailStatus(c echo.Context) error {
+    status, err := h.emailService.GetEmailStatus(c.Param("id"))
+    if err != nil {
+        return emailTaskError(c, err)
+    }
+
+    return c.JSON(http.StatusOK, status)
+}
+
+func (h *EmailHandler) ListFailedEmails(c echo.Context) error {
+    page, _ := strconv.Atoi(c.QueryParam("page"))
+    if page < 1 {
+        page = 1
+    }
+    pageSize, _ := strconv.Atoi(c.QueryParam("page_size"))
+    if pageSize < 1 || pageSize > 100 {
+        pageSize = 20
+    }
+
+    emails, err := h.emailService.ListFailedEmails(page, pageSize)
+    if err != nil {
+        return emailTaskError(c, err)
+    }
+
+    return c.JSON(http.StatusOK, map[string]interface{}{
+        "emails":    emails,
+        "page":      page,
+        "page_size": pageSize,
+    })
+}
+
+func (h *EmailHandler) RetryEmail(c echo.Context) error {
+    id, err := h.emailService.RetryEmail(c.Param("id"))
+    if err != nil {
+        return emailTaskError(c, err)
+    }
+
+    logrus.WithFields(logrus.Fields{
+        "task_id":     c.Param("id"),
+        "new_task_id": id,
+    }).Info("Failed email requeued")
+    return c.JSON(http.StatusOK, map[string]string{
+        "message": "Email requeued",
+        "id":      id,
+    })
+}
+
+func (h *EmailHandler) DeleteEmail(c echo.Context) error {
+    if err := h.emailService.DeleteEmail(c.Param("id")); err != nil {
+        return emailTaskError(c, err)
+    }
+
+    logrus.WithField("task_id", c.Param("id")).Info("Email task deleted")
+    return c.NoContent(http.StatusNoContent)
+}
+
+func emailTaskError(c echo.Context, err error) error {
+    if errors.Is(err, services.ErrEmailNotFound) {
+        return c.JSON(http.StatusNotFound, map[string]string{
+            "error": "Email not found",
+        })
+    }
+
+    logrus.Error("Email queue inspection failed: ", err)
+    return c.JSON(http.StatusInternalServerError, map[string]string{
+        "error": "Failed to inspect email queue",
     })
 }
@@ -0,0 +1,44 @@
+// internal/handlers/health_handler.go
+package handlers
+
+import (
+	"net/http"
+
+	"gochat-server/internal/health"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// HealthHandler serves the Kubernetes-style probes. Liveness only covers the
+// process itself; readiness also covers every dependency.
+type HealthHandler struct {
+	live  *health.Checker
+	ready *health.Checker
+}
+
+func NewHealthHandler(live, ready *health.Checker) *HealthHandler {
+	return &HealthHandler{
+		live:  live,
+		ready: ready,
+	}
+}
+
+func (h *HealthHandler) Livez(c echo.Context) error {
+	return h.respond(c, h.live.Run(c.Request().Context()))
+}
+
+func (h *HealthHandler) Readyz(c echo.Context) error {
+	return h.respond(c, h.ready.Run(c.Request().Context()))
+}
+
+func (h *HealthHandler) respond(c echo.Context, report *health.Report) error {
+	if report.Status != health.StatusOK {
+		logrus.WithFields(logrus.Fields{
+			"path":   c.Path(),
+			"checks": report.Checks,
+		}).Warn("Health check failed")
+		return c.JSON(http.StatusServiceUnavailable, report)
+	}
+	return c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,163 @@
+// internal/handlers/hub_handler.go
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"gochat-server/internal/hub"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultDisconnectReason = "disconnected by an administrator"
+
+// HubHandler exposes the live hub state and moderation actions to admins.
+type HubHandler struct {
+	hub *hub.Hub
+}
+
+func NewHubHandler(h *hub.Hub) *HubHandler {
+	return &HubHandler{
+		hub: h,
+	}
+}
+
+type announcementRequest struct {
+	Message string `json:"message"`
+}
+
+type disconnectRequest struct {
+	Reason string `json:"reason" query:"reason"`
+}
+
+func (h *HubHandler) ListRooms(c echo.Context) error {
+	rooms := h.hub.RoomInfos()
+
+	connections := 0
+	for _, room := range rooms {
+		connections += room.Connections
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"rooms":       rooms,
+		"count":       len(rooms),
+		"connections": connections,
+	})
+}
+
+func (h *HubHandler) GetRoom(c echo.Context) error {
+	room, ok := h.hub.RoomInfo(c.Param("roomID"))
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Room has no live connections",
+		})
+	}
+
+	return c.JSON(http.StatusOK, room)
+}
+
+func (h *HubHandler) ListConnections(c echo.Context) error {
+	connections := h.hub.Connections()
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"connections": connections,
+		"count":       len(connections),
+	})
+}
+
+func (h *HubHandler) Announce(c echo.Context) error {
+	var req announcementRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid request payload",
+		})
+	}
+
+	req.Message = strings.TrimSpace(req.Message)
+	if req.Message == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Missing required field: message",
+		})
+	}
+
+	sent := h.hub.Announce(req.Message)
+	setAuditDetail(c, "message", req.Message)
+	setAuditDetail(c, "sent", sent)
+
+	logrus.WithField("connections", sent).Info("Sent server announcement")
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"sent": sent,
+	})
+}
+
+func (h *HubHandler) DisconnectConnection(c echo.Context) error {
+	id := c.Param("id")
+	reason := disconnectReason(c)
+
+	setAuditDetail(c, "reason", reason)
+	if !h.hub.Disconnect(id, reason) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Connection not found",
+		})
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"connection_id": id,
+		"reason":        reason,
+	}).Info("Force-disconnected connection")
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (h *HubHandler) CloseRoom(c echo.Context) error {
+	roomID := c.Param("roomID")
+	reason := disconnectReason(c)
+
+	closed := h.hub.CloseRoom(roomID, reason)
+	setAuditDetail(c, "reason", reason)
+	setAuditDetail(c, "closed", closed)
+
+	logrus.WithFields(logrus.Fields{
+		"room_id":     roomID,
+		"connections": closed,
+		"reason":      reason,
+	}).Info("Closed room")
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"room_id": roomID,
+		"closed":  closed,
+	})
+}
+
+func (h *HubHandler) ReopenRoom(c echo.Context) error {
+	roomID := c.Param("roomID")
+
+	if !h.hub.ReopenRoom(roomID) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Room is not closed",
+		})
+	}
+
+	logrus.WithField("room_id", roomID).Info("Reopened room")
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// disconnectReason reads the optional reason from the body. Close frames
+// carry at most 123 bytes of reason, so longer ones are cut.
+func disconnectReason(c echo.Context) string {
+	var req disconnectRequest
+	_ = c.Bind(&req)
+
+	reason := strings.TrimSpace(req.Reason)
+	if reason == "" {
+		reason = defaultDisconnectReason
+	}
+	if len(reason) > 123 {
+		reason = strings.ToValidUTF8(reason[:123], "")
+	}
+	return reason
+}
@@ -0,0 +1,244 @@
+// internal/handlers/incoming_webhook_handler.go
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"gochat-server/internal/config"
+	"gochat-server/internal/hub"
+	"gochat-server/internal/models"
+	"gochat-server/internal/services"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// IncomingWebhookHandler manages incoming webhooks for admins and posts what
+// external systems send to them into their rooms.
+type IncomingWebhookHandler struct {
+	hub            *hub.Hub
+	webhookService *services.IncomingWebhookService
+	cfg            *config.Store
+	filter         atomic.Pointer[services.WordFilter]
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func NewIncomingWebhookHandler(h *hub.Hub, webhookService *services.IncomingWebhookService, cfg *config.Store) *IncomingWebhookHandler {
+	handler := &IncomingWebhookHandler{
+		hub:            h,
+		webhookService: webhookService,
+		cfg:            cfg,
+		limiters:       make(map[string]*rate.Limiter),
+	}
+
+	handler.filter.Store(services.NewWordFilter(cfg.Current().BannedWords))
+	cfg.OnReload(func(_, next *config.Config) {
+		handler.filter.Store(services.NewWordFilter(next.BannedWords))
+	})
+
+	return handler
+}
+
+type createIncomingWebhookRequest struct {
+	Name string `json:"name"`
+}
+
+func (h *IncomingWebhookHandler) CreateIncomingWebhook(c echo.Context) error {
+	roomID := c.Param("roomID")
+
+	var req createIncomingWebhookRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid request payload",
+		})
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Missing required field: name",
+		})
+	}
+
+	webhook, token, err := h.webhookService.CreateIncomingWebhook(c.Request().Context(), roomID, req.Name)
+	if err != nil {
+		logrus.Error("Failed to create incoming webhook: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to create incoming webhook",
+		})
+	}
+
+	setAuditDetail(c, "webhook_id", webhook.ID.Hex())
+	setAuditDetail(c, "name", webhook.Name)
+
+	logrus.WithFields(logrus.Fields{
+		"webhook_id": webhook.ID.Hex(),
+		"room_id":    roomID,
+	}).Info("Created incoming webhook")
+
+	// The URL is only ever shown here
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"webhook": webhook,
+		"url":     strings.TrimRight(h.cfg.Current().PublicURL, "/") + "/hooks/" + token,
+	})
+}
+
+func (h *IncomingWebhookHandler) ListIncomingWebhooks(c echo.Context) error {
+	webhooks, err := h.webhookService.ListIncomingWebhooks(c.Request().Context(), c.Param("roomID"))
+	if err != nil {
+		logrus.Error("Failed to list incoming webhooks: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list incoming webhooks",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"webhooks": webhooks,
+		"count":    len(webhooks),
+	})
+}
+
+func (h *IncomingWebhookHandler) DeleteIncomingWebhook(c echo.Context) error {
+	id := c.Param("id")
+
+	err := h.webhookService.DeleteIncomingWebhook(c.Request().Context(), id)
+	if errors.Is(err, services.ErrIncomingWebhookNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Incoming webhook not found",
+		})
+	}
+	if err != nil {
+		logrus.Error("Failed to delete incoming webhook: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to delete incoming webhook",
+		})
+	}
+
+	h.mu.Lock()
+	delete(h.limiters, id)
+	h.mu.Unlock()
+
+	logrus.WithField("webhook_id", id).Info("Deleted incoming webhook")
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Receive posts the payload sent to an incoming webhook URL into its room.
+// Both JSON bodies and Slack's form-encoded payload=... are accepted.
+func (h *IncomingWebhookHandler) Receive(c echo.Context) error {
+	webhook, err := h.webhookService.Authenticate(c.Request().Context(), c.Param("token"))
+	if errors.Is(err, services.ErrIncomingWebhookNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Unknown webhook",
+		})
+	}
+	if err != nil {
+		logrus.Error("Failed to look up incoming webhook: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to look up webhook",
+		})
+	}
+
+	cfg := h.cfg.Current()
+	if wait, ok := h.allow(webhook, cfg); !ok {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(wait))
+		return c.JSON(http.StatusTooManyRequests, map[string]string{
+			"error": "Rate limit exceeded",
+		})
+	}
+
+	var payload services.IncomingMessage
+	if form := c.FormValue("payload"); form != "" {
+		err = json.Unmarshal([]byte(form), &payload)
+	} else {
+		err = c.Bind(&payload)
+	}
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid request payload",
+		})
+	}
+
+	content := payload.Content()
+	if content == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Missing required field: text",
+		})
+	}
+	if len(content) > cfg.MaxMessageLength {
+		return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{
+			"error": "Message too long",
+		})
+	}
+	content, _ = h.filter.Load().Censor(content)
+
+	username := strings.TrimSpace(payload.Username)
+	if username == "" {
+		username = webhook.Name
+	}
+
+	id, err := h.hub.Post(c.Request().Context(), &models.WSMessage{
+		Type:     "message",
+		RoomID:   webhook.RoomID,
+		UserID:   services.IncomingWebhookUserID(webhook),
+		Username: username,
+		Content:  content,
+		Bot:      true,
+		Context:  c.Request().Context(),
+	})
+	if errors.Is(err, hub.ErrStopped) {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{
+			"error": "Server is shutting down",
+		})
+	}
+	if errors.Is(err, hub.ErrRoomClosed) {
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": "Room is closed",
+		})
+	}
+	if err != nil {
+		logrus.Error("Failed to post incoming webhook message: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to post message",
+		})
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"roomID":    webhook.RoomID,
+		"webhookID": webhook.ID.Hex(),
+	}).Info("Incoming webhook message posted")
+
+	// 200 rather than 201: Slack clients expect it
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"ok": true,
+		"id": id,
+	})
+}
+
+// allow takes a token from the webhook's rate limiter. When it is empty it
+// returns how many seconds to wait instead.
+func (h *IncomingWebhookHandler) allow(webhook *models.IncomingWebhook, cfg *config.Config) (int, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	id := webhook.ID.Hex()
+	limiter := rateLimiter(h.limiters[id], cfg.IncomingWebhookRateLimit, cfg.IncomingWebhookRateBurst)
+	h.limiters[id] = limiter
+
+	reservation := limiter.Reserve()
+	if delay := reservation.Delay(); delay > 0 {
+		reservation.Cancel()
+		return int(math.Ceil(delay.Seconds())), false
+	}
+	return 0, true
+}
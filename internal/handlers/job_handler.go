@@ -0,0 +1,167 @@
+// internal/handlers/job_handler.go
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"gochat-server/internal/queue"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// JobHandler exposes the job queue's dead-letter archive to admins.
+type JobHandler struct {
+	queueManager *queue.Manager
+}
+
+func NewJobHandler(queueManager *queue.Manager) *JobHandler {
+	return &JobHandler{
+		queueManager: queueManager,
+	}
+}
+
+func (h *JobHandler) ListDeadLetters(c echo.Context) error {
+	name := c.Param("queue")
+	if !slices.Contains(queue.Queues, name) {
+		return unknownQueue(c, name)
+	}
+
+	page, _ := strconv.Atoi(c.QueryParam("page"))
+	if page < 1 {
+		page = 1
+	}
+	pageSize, _ := strconv.Atoi(c.QueryParam("page_size"))
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+
+	tasks, err := h.queueManager.ListDeadLetters(name, page, pageSize)
+	if err != nil {
+		return deadLetterError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"tasks":     tasks,
+		"queue":     name,
+		"page":      page,
+		"page_size": pageSize,
+	})
+}
+
+func (h *JobHandler) GetDeadLetter(c echo.Context) error {
+	name := c.Param("queue")
+	if !slices.Contains(queue.Queues, name) {
+		return unknownQueue(c, name)
+	}
+
+	task, err := h.queueManager.GetDeadLetter(name, c.Param("id"))
+	if err != nil {
+		return deadLetterError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, task)
+}
+
+func (h *JobHandler) ReplayDeadLetter(c echo.Context) error {
+	name := c.Param("queue")
+	if !slices.Contains(queue.Queues, name) {
+		return unknownQueue(c, name)
+	}
+
+	id, err := h.queueManager.ReplayDeadLetter(name, c.Param("id"))
+	if err != nil {
+		return deadLetterError(c, err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"queue":       name,
+		"task_id":     c.Param("id"),
+		"new_task_id": id,
+	}).Info("Dead-letter task replayed")
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Task requeued",
+		"id":      id,
+	})
+}
+
+func (h *JobHandler) ReplayDeadLetters(c echo.Context) error {
+	name := c.Param("queue")
+	if !slices.Contains(queue.Queues, name) {
+		return unknownQueue(c, name)
+	}
+
+	n, err := h.queueManager.ReplayDeadLetters(name)
+	if err != nil {
+		return deadLetterError(c, err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"queue": name,
+		"count": n,
+	}).Info("Dead-letter archive replayed")
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message": "Tasks requeued",
+		"count":   n,
+	})
+}
+
+func (h *JobHandler) PurgeDeadLetter(c echo.Context) error {
+	name := c.Param("queue")
+	if !slices.Contains(queue.Queues, name) {
+		return unknownQueue(c, name)
+	}
+
+	if err := h.queueManager.PurgeDeadLetter(name, c.Param("id")); err != nil {
+		return deadLetterError(c, err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"queue":   name,
+		"task_id": c.Param("id"),
+	}).Info("Dead-letter task purged")
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (h *JobHandler) PurgeDeadLetters(c echo.Context) error {
+	name := c.Param("queue")
+	if !slices.Contains(queue.Queues, name) {
+		return unknownQueue(c, name)
+	}
+
+	n, err := h.queueManager.PurgeDeadLetters(name)
+	if err != nil {
+		return deadLetterError(c, err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"queue": name,
+		"count": n,
+	}).Info("Dead-letter archive purged")
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message": "Tasks purged",
+		"count":   n,
+	})
+}
+
+func unknownQueue(c echo.Context, name string) error {
+	return c.JSON(http.StatusNotFound, map[string]string{
+		"error": "Unknown queue: " + name,
+	})
+}
+
+func deadLetterError(c echo.Context, err error) error {
+	if errors.Is(err, queue.ErrTaskNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Task not found in dead-letter archive",
+		})
+	}
+
+	logrus.Error("Dead-letter archive inspection failed: ", err)
+	return c.JSON(http.StatusInternalServerError, map[string]string{
+		"error": "Failed to inspect dead-letter archive",
+	})
+}
@@ -0,0 +1,146 @@
+// internal/handlers/middleware.go
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"gochat-server/internal/models"
+	"gochat-server/internal/services"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	auditActorKey   = "audit_actor"
+	auditDetailsKey = "audit_details"
+	botKey          = "bot"
+)
+
+// RequireAdmin only lets through requests bearing the admin token. With no
+// token configured the admin API is switched off entirely. Rejected tokens are
+// audited.
+func RequireAdmin(token string, audit *services.AuditService) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if token == "" {
+				return c.JSON(http.StatusForbidden, map[string]string{
+					"error": "Admin API is disabled",
+				})
+			}
+
+			provided := strings.TrimPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+				audit.Log(c.Request().Context(), &models.AuditEvent{
+					Action: services.AuditAdminAuthFailed,
+					Actor:  services.AuditActorAnonymous,
+					IP:     c.RealIP(),
+					Details: map[string]interface{}{
+						"method": c.Request().Method,
+						"path":   c.Request().URL.Path,
+					},
+				})
+				return c.JSON(http.StatusUnauthorized, map[string]string{
+					"error": "Invalid admin token",
+				})
+			}
+
+			c.Set(auditActorKey, services.AuditActorAdmin)
+			return next(c)
+		}
+	}
+}
+
+// RequireBot only lets through requests bearing a bot token with scope in the
+// route's room. The bot is available to handlers under botKey.
+func RequireBot(bots *services.BotService, scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			header := c.Request().Header.Get(echo.HeaderAuthorization)
+			token, ok := strings.CutPrefix(header, "Bearer ")
+			if !ok {
+				return c.JSON(http.StatusUnauthorized, map[string]string{
+					"error": "Missing bot token",
+				})
+			}
+
+			bot, err := bots.Authenticate(c.Request().Context(), token)
+			if errors.Is(err, services.ErrInvalidBotToken) {
+				return c.JSON(http.StatusUnauthorized, map[string]string{
+					"error": "Invalid bot token",
+				})
+			}
+			if err != nil {
+				logrus.Error("Failed to authenticate bot: ", err)
+				return c.JSON(http.StatusInternalServerError, map[string]string{
+					"error": "Failed to authenticate bot",
+				})
+			}
+
+			if !services.BotCan(bot, scope, c.Param("roomID")) {
+				return c.JSON(http.StatusForbidden, map[string]string{
+					"error": "Bot token is not allowed to do this here",
+				})
+			}
+
+			c.Set(botKey, bot)
+			c.Set(auditActorKey, services.BotUserID(bot))
+			return next(c)
+		}
+	}
+}
+
+// Audit records action in the audit trail once the request has succeeded.
+// The target is the route parameter targetParam, if given; handlers can add
+// details with setAuditDetail.
+func Audit(audit *services.AuditService, action, targetParam string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			err := next(c)
+			if err != nil || c.Response().Status >= http.StatusBadRequest {
+				return err
+			}
+
+			details := map[string]interface{}{
+				"method": c.Request().Method,
+				"path":   c.Request().URL.Path,
+			}
+			if extra, ok := c.Get(auditDetailsKey).(map[string]interface{}); ok {
+				for key, value := range extra {
+					details[key] = value
+				}
+			}
+
+			actor, _ := c.Get(auditActorKey).(string)
+			if actor == "" {
+				actor = services.AuditActorAnonymous
+			}
+
+			event := &models.AuditEvent{
+				Action:  action,
+				Actor:   actor,
+				IP:      c.RealIP(),
+				Details: details,
+			}
+			if targetParam != "" {
+				event.Target = c.Param(targetParam)
+			}
+			audit.Log(c.Request().Context(), event)
+
+			return nil
+		}
+	}
+}
+
+// setAuditDetail adds a detail to the event the Audit middleware records.
+func setAuditDetail(c echo.Context, key string, value interface{}) {
+	details, ok := c.Get(auditDetailsKey).(map[string]interface{})
+	if !ok {
+		details = make(map[string]interface{})
+		c.Set(auditDetailsKey, details)
+	}
+	details[key] = value
+}
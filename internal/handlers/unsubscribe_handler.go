@@ -0,0 +1,232 @@
+// internal/handlers/unsubscribe_handler.go
+package handlers
+
+import (
+	"crypto/subtle"
+	"html/template"
+	"net/http"
+	"net/mail"
+
+	"gochat-server/internal/models"
+	"gochat-server/internal/services"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Unsubscribe</title></head>
+<body style="font-family:-apple-system,Segoe UI,Helvetica,Arial,sans-serif;max-width:480px;margin:48px auto;color:#18181b;">
+{{if .Resubscribed}}<p>You will receive notification emails from GoChat again.</p>
+{{else if .Done}}<p>You will no longer receive {{if .RoomID}}emails about {{.RoomID}}{{else}}notification emails{{end}} from GoChat.</p>
+{{if not .RoomID}}<form method="post" action="resubscribe"><input type="hidden" name="token" value="{{.Token}}"><button type="submit">Resubscribe</button></form>{{end}}
+{{else}}<p>Stop receiving {{if .RoomID}}emails about {{.RoomID}}{{else}}all notification emails{{end}} from GoChat?</p>
+<form method="post"><input type="hidden" name="token" value="{{.Token}}"><button type="submit">Unsubscribe</button></form>
+{{end}}</body>
+</html>
+`))
+
+type UnsubscribeHandler struct {
+	emailService       *services.EmailService
+	preferenceService  *services.PreferenceService
+	profileService     *services.ProfileService
+	suppressionService *services.SuppressionService
+	bounceSecret       string
+}
+
+func NewUnsubscribeHandler(
+	emailService *services.EmailService,
+	preferenceService *services.PreferenceService,
+	profileService *services.ProfileService,
+	suppressionService *services.SuppressionService,
+	bounceSecret string,
+) *UnsubscribeHandler {
+	return &UnsubscribeHandler{
+		emailService:       emailService,
+		preferenceService:  preferenceService,
+		profileService:     profileService,
+		suppressionService: suppressionService,
+		bounceSecret:       bounceSecret,
+	}
+}
+
+// ShowUnsubscribe renders a confirmation page. It never changes anything, so
+// link scanners that prefetch URLs can't unsubscribe people.
+func (h *UnsubscribeHandler) ShowUnsubscribe(c echo.Context) error {
+	token := c.QueryParam("token")
+	_, roomID, err := h.emailService.VerifyUnsubscribeToken(token)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "This unsubscribe link is invalid.")
+	}
+
+	return unsubscribePage.Execute(c.Response(), map[string]interface{}{
+		"Token":  token,
+		"RoomID": roomID,
+	})
+}
+
+// Unsubscribe handles both the confirmation form and RFC 8058 one-click
+// requests from mail clients.
+func (h *UnsubscribeHandler) Unsubscribe(c echo.Context) error {
+	token := c.FormValue("token")
+	if token == "" {
+		token = c.QueryParam("token")
+	}
+
+	userID, roomID, err := h.emailService.VerifyUnsubscribeToken(token)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "This unsubscribe link is invalid.")
+	}
+
+	ctx := c.Request().Context()
+	if roomID != "" {
+		err = h.preferenceService.SetRoomPreference(ctx, userID, &models.RoomNotificationSetting{
+			RoomID: roomID,
+			Mode:   models.NotifyNone,
+		})
+	} else {
+		err = h.unsubscribeAll(c, userID)
+	}
+	if err != nil {
+		logrus.Error("Failed to unsubscribe: ", err)
+		return c.String(http.StatusInternalServerError, "Something went wrong, please try again.")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"user_id": userID,
+		"room_id": roomID,
+	}).Info("User unsubscribed")
+
+	if c.FormValue("List-Unsubscribe") == "One-Click" {
+		return c.NoContent(http.StatusOK)
+	}
+	return unsubscribePage.Execute(c.Response(), map[string]interface{}{
+		"Done":   true,
+		"Token":  token,
+		"RoomID": roomID,
+	})
+}
+
+// Resubscribe undoes an unsubscribe from all notifications. It takes the
+// same signed token as Unsubscribe, since only the owner of the address has
+// it; saving preferences through the API never lifts the suppression.
+func (h *UnsubscribeHandler) Resubscribe(c echo.Context) error {
+	userID, roomID, err := h.emailService.VerifyUnsubscribeToken(c.FormValue("token"))
+	if err != nil || roomID != "" {
+		return c.String(http.StatusBadRequest, "This resubscribe link is invalid.")
+	}
+
+	ctx := c.Request().Context()
+	prefs, err := h.preferenceService.GetPreferences(ctx, userID)
+	if err == nil && prefs.Mode == models.NotifyNone {
+		prefs.Mode = models.NotifyAll
+		err = h.preferenceService.SavePreferences(ctx, prefs)
+	}
+	if err == nil {
+		var profile *models.UserProfile
+		if profile, err = h.profileService.GetProfile(ctx, userID); err == nil && profile.Email != "" {
+			// Lifts only the unsubscribe; a bounce stays
+			err = h.suppressionService.Lift(ctx, profile.Email, services.SuppressionUnsubscribe)
+		}
+	}
+	if err != nil {
+		logrus.Error("Failed to resubscribe: ", err)
+		return c.String(http.StatusInternalServerError, "Something went wrong, please try again.")
+	}
+
+	logrus.WithField("user_id", userID).Info("User resubscribed")
+
+	return unsubscribePage.Execute(c.Response(), map[string]interface{}{
+		"Resubscribed": true,
+	})
+}
+
+func (h *UnsubscribeHandler) unsubscribeAll(c echo.Context, userID string) error {
+	ctx := c.Request().Context()
+
+	prefs, err := h.preferenceService.GetPreferences(ctx, userID)
+	if err != nil {
+		return err
+	}
+	prefs.Mode = models.NotifyNone
+	prefs.DigestInterval = ""
+	if err := h.preferenceService.SavePreferences(ctx, prefs); err != nil {
+		return err
+	}
+
+	// Also suppress the address itself so nothing else reaches it either
+	profile, err := h.profileService.GetProfile(ctx, userID)
+	if err != nil || profile.Email == "" {
+		return nil
+	}
+	return h.suppressionService.Suppress(ctx, profile.Email, services.SuppressionUnsubscribe, "user "+userID)
+}
+
+type bounceRequest struct {
+	Email  string `json:"email"`
+	Type   string `json:"type"` // hard, soft or complaint
+	Reason string `json:"reason"`
+}
+
+// RecordBounce is the webhook for bounce and complaint notifications from the
+// mail provider. Hard bounces and complaints suppress the address; soft
+// bounces are only logged. Without BOUNCE_WEBHOOK_SECRET the webhook is
+// disabled, since anyone could otherwise suppress any address.
+func (h *UnsubscribeHandler) RecordBounce(c echo.Context) error {
+	if h.bounceSecret == "" {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Bounce webhook is not configured",
+		})
+	}
+	if subtle.ConstantTimeCompare([]byte(c.Request().Header.Get("X-Webhook-Secret")), []byte(h.bounceSecret)) != 1 {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "Invalid webhook secret",
+		})
+	}
+
+	var req bounceRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid request payload",
+		})
+	}
+	addr, err := mail.ParseAddress(req.Email)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid email address",
+		})
+	}
+
+	var reason string
+	switch req.Type {
+	case "hard":
+		reason = services.SuppressionBounce
+	case "complaint":
+		reason = services.SuppressionComplaint
+	case "soft":
+		logrus.WithFields(logrus.Fields{
+			"email":  addr.Address,
+			"reason": req.Reason,
+		}).Warn("Soft bounce reported")
+		return c.NoContent(http.StatusAccepted)
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "type must be hard, soft or complaint",
+		})
+	}
+
+	if err := h.suppressionService.Suppress(c.Request().Context(), addr.Address, reason, req.Reason); err != nil {
+		logrus.Error("Failed to record bounce: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to record bounce",
+		})
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"email":  addr.Address,
+		"reason": reason,
+	}).Info("Email address suppressed")
+
+	return c.NoContent(http.StatusAccepted)
+}
@@ -0,0 +1,198 @@
+// internal/handlers/user_handler.go
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/mail"
+
+	"gochat-server/internal/models"
+	"gochat-server/internal/services"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+type UserHandler struct {
+	profileService    *services.ProfileService
+	emailService      *services.EmailService
+	preferenceService *services.PreferenceService
+}
+
+func NewUserHandler(
+	profileService *services.ProfileService,
+	emailService *services.EmailService,
+	preferenceService *services.PreferenceService,
+) *UserHandler {
+	return &UserHandler{
+		profileService:    profileService,
+		emailService:      emailService,
+		preferenceService: preferenceService,
+	}
+}
+
+type updateProfileRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+// publicProfile is what anyone may see of a profile; email addresses stay
+// private.
+type publicProfile struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+}
+
+func (h *UserHandler) GetProfile(c echo.Context) error {
+	profile, err := h.profileService.GetProfile(c.Request().Context(), c.Param("userID"))
+	if errors.Is(err, services.ErrProfileNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Profile not found",
+		})
+	}
+	if err != nil {
+		logrus.Error("Failed to fetch profile: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to fetch profile",
+		})
+	}
+
+	return c.JSON(http.StatusOK, publicProfile{
+		ID:       profile.ID,
+		Username: profile.Username,
+	})
+}
+
+// UpdateProfile changes the username and starts verifying a new email
+// address. Notifications keep going to the old address, if any, until the
+// link emailed to the new one is opened.
+func (h *UserHandler) UpdateProfile(c echo.Context) error {
+	var req updateProfileRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid request payload",
+		})
+	}
+
+	if req.Email != "" {
+		addr, err := mail.ParseAddress(req.Email)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Invalid email address",
+			})
+		}
+		req.Email = addr.Address
+	}
+
+	ctx := c.Request().Context()
+	profile, token, err := h.profileService.UpdateProfile(ctx, c.Param("userID"), req.Username, req.Email)
+	if err != nil {
+		logrus.Error("Failed to update profile: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to update profile",
+		})
+	}
+
+	if token != "" {
+		if _, err := h.emailService.QueueEmailVerification(ctx, profile, token); err != nil {
+			logrus.Error("Failed to queue email verification: ", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to send verification email",
+			})
+		}
+	}
+
+	return c.JSON(http.StatusOK, profile)
+}
+
+// VerifyEmail confirms a pending email address from the link sent to it.
+func (h *UserHandler) VerifyEmail(c echo.Context) error {
+	profile, err := h.profileService.ConfirmEmail(c.Request().Context(), c.QueryParam("token"))
+	if errors.Is(err, services.ErrInvalidVerificationToken) {
+		return c.String(http.StatusBadRequest, "This verification link is invalid or has expired.")
+	}
+	if err != nil {
+		logrus.Error("Failed to confirm email: ", err)
+		return c.String(http.StatusInternalServerError, "Something went wrong, please try again.")
+	}
+
+	logrus.WithField("user_id", profile.ID).Info("Email address confirmed")
+
+	return c.String(http.StatusOK, "Your email address is confirmed. GoChat notifications will be sent to "+profile.Email+".")
+}
+
+func (h *UserHandler) GetNotificationPreferences(c echo.Context) error {
+	prefs, err := h.preferenceService.GetPreferences(c.Request().Context(), c.Param("userID"))
+	if err != nil {
+		logrus.Error("Failed to fetch notification preferences: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to fetch notification preferences",
+		})
+	}
+
+	return c.JSON(http.StatusOK, prefs)
+}
+
+func (h *UserHandler) UpdateNotificationPreferences(c echo.Context) error {
+	var prefs models.NotificationPreferences
+	if err := c.Bind(&prefs); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid request payload",
+		})
+	}
+	prefs.UserID = c.Param("userID")
+
+	ctx := c.Request().Context()
+	if err := h.preferenceService.SavePreferences(ctx, &prefs); err != nil {
+		return preferenceError(c, err)
+	}
+
+	saved, err := h.preferenceService.GetPreferences(ctx, prefs.UserID)
+	if err != nil {
+		return preferenceError(c, err)
+	}
+	return c.JSON(http.StatusOK, saved)
+}
+
+func (h *UserHandler) SetRoomNotificationPreference(c echo.Context) error {
+	var setting models.RoomNotificationSetting
+	if err := c.Bind(&setting); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid request payload",
+		})
+	}
+	setting.RoomID = c.Param("roomID")
+
+	ctx := c.Request().Context()
+	userID := c.Param("userID")
+	if err := h.preferenceService.SetRoomPreference(ctx, userID, &setting); err != nil {
+		return preferenceError(c, err)
+	}
+
+	saved, err := h.preferenceService.GetPreferences(ctx, userID)
+	if err != nil {
+		return preferenceError(c, err)
+	}
+	return c.JSON(http.StatusOK, saved)
+}
+
+func (h *UserHandler) ClearRoomNotificationPreference(c echo.Context) error {
+	if err := h.preferenceService.ClearRoomPreference(c.Request().Context(), c.Param("userID"), c.Param("roomID")); err != nil {
+		return preferenceError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func preferenceError(c echo.Context, err error) error {
+	if errors.Is(err, services.ErrInvalidPreferences) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	logrus.Error("Failed to save notification preferences: ", err)
+	return c.JSON(http.StatusInternalServerError, map[string]string{
+		"error": "Failed to save notification preferences",
+	})
+}
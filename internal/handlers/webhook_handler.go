@@ -0,0 +1,177 @@
+// internal/handlers/webhook_handler.go
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"gochat-server/internal/services"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 500
+)
+
+// WebhookHandler lets admins manage room webhooks and inspect their deliveries.
+type WebhookHandler struct {
+	webhookService *services.WebhookService
+}
+
+func NewWebhookHandler(webhookService *services.WebhookService) *WebhookHandler {
+	return &WebhookHandler{
+		webhookService: webhookService,
+	}
+}
+
+type createWebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+func (h *WebhookHandler) CreateWebhook(c echo.Context) error {
+	roomID := c.Param("roomID")
+
+	var req createWebhookRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid request payload",
+		})
+	}
+	if req.URL == "" || len(req.Events) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Missing required fields: url, events",
+		})
+	}
+
+	webhook, err := h.webhookService.CreateWebhook(c.Request().Context(), roomID, req.URL, req.Events)
+	if errors.Is(err, services.ErrInvalidWebhookURL) || errors.Is(err, services.ErrUnknownWebhookEvent) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		logrus.Error("Failed to create webhook: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to create webhook",
+		})
+	}
+
+	setAuditDetail(c, "webhook_id", webhook.ID.Hex())
+	setAuditDetail(c, "url", webhook.URL)
+	setAuditDetail(c, "events", webhook.Events)
+
+	logrus.WithFields(logrus.Fields{
+		"webhook_id": webhook.ID.Hex(),
+		"room_id":    roomID,
+		"url":        webhook.URL,
+	}).Info("Created webhook")
+
+	// The secret is only ever shown here
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"webhook": webhook,
+		"secret":  webhook.Secret,
+	})
+}
+
+func (h *WebhookHandler) ListWebhooks(c echo.Context) error {
+	webhooks, err := h.webhookService.ListWebhooks(c.Request().Context(), c.Param("roomID"))
+	if err != nil {
+		logrus.Error("Failed to list webhooks: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list webhooks",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"webhooks": webhooks,
+		"count":    len(webhooks),
+	})
+}
+
+func (h *WebhookHandler) GetWebhook(c echo.Context) error {
+	webhook, err := h.webhookService.GetWebhook(c.Request().Context(), c.Param("id"))
+	if errors.Is(err, services.ErrWebhookNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Webhook not found",
+		})
+	}
+	if err != nil {
+		logrus.Error("Failed to fetch webhook: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to fetch webhook",
+		})
+	}
+
+	return c.JSON(http.StatusOK, webhook)
+}
+
+func (h *WebhookHandler) DeleteWebhook(c echo.Context) error {
+	err := h.webhookService.DeleteWebhook(c.Request().Context(), c.Param("id"))
+	if errors.Is(err, services.ErrWebhookNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Webhook not found",
+		})
+	}
+	if err != nil {
+		logrus.Error("Failed to delete webhook: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to delete webhook",
+		})
+	}
+
+	logrus.WithField("webhook_id", c.Param("id")).Info("Deleted webhook")
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (h *WebhookHandler) ListDeliveries(c echo.Context) error {
+	limit := int64(defaultDeliveryLimit)
+	if l, err := strconv.ParseInt(c.QueryParam("limit"), 10, 64); err == nil && l > 0 && l <= maxDeliveryLimit {
+		limit = l
+	}
+
+	deliveries, err := h.webhookService.Deliveries(c.Request().Context(), c.Param("id"), limit)
+	if errors.Is(err, services.ErrWebhookNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Webhook not found",
+		})
+	}
+	if err != nil {
+		logrus.Error("Failed to list webhook deliveries: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list webhook deliveries",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"deliveries": deliveries,
+		"count":      len(deliveries),
+	})
+}
+
+// TestWebhook sends a webhook.test event right away and reports how the
+// receiver answered.
+func (h *WebhookHandler) TestWebhook(c echo.Context) error {
+	delivery, err := h.webhookService.Test(c.Request().Context(), c.Param("id"))
+	if errors.Is(err, services.ErrWebhookNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Webhook not found",
+		})
+	}
+	if err != nil {
+		logrus.Error("Failed to test webhook: ", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to test webhook",
+		})
+	}
+
+	setAuditDetail(c, "success", delivery.Success)
+	setAuditDetail(c, "status_code", delivery.StatusCode)
+
+	return c.JSON(http.StatusOK, delivery)
+}
@@ -0,0 +1,112 @@
+// Package health runs dependency checks for the liveness and readiness probes.
+package health
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// CheckFunc returns nil when the dependency is healthy.
+type CheckFunc func(ctx context.Context) error
+
+// Result is the outcome of one check.
+type Result struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Report is the outcome of every check; Status is ok only if all passed.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+// Checker runs a set of named checks concurrently, each bounded by timeout.
+type Checker struct {
+	timeout time.Duration
+	names   []string
+	checks  map[string]CheckFunc
+}
+
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{
+		timeout: timeout,
+		checks:  make(map[string]CheckFunc),
+	}
+}
+
+// Add registers a check; it must be called before the checker is in use.
+func (c *Checker) Add(name string, check CheckFunc) {
+	if _, exists := c.checks[name]; !exists {
+		c.names = append(c.names, name)
+	}
+	c.checks[name] = check
+}
+
+// Run runs every check and reports once they have all finished or the
+// timeout (or ctx) has expired, whichever is first. Checks still running by
+// then are reported as failed; they are left to finish in the background, so
+// each should give up once its ctx is done.
+func (c *Checker) Run(ctx context.Context) *Report {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	type outcome struct {
+		name   string
+		result Result
+	}
+	// Buffered so checks that finish late don't block forever
+	outcomes := make(chan outcome, len(c.names))
+
+	start := time.Now()
+	for _, name := range c.names {
+		go func(name string, check CheckFunc) {
+			start := time.Now()
+			err := check(ctx)
+			result := Result{
+				Status:    StatusOK,
+				LatencyMS: latencyMS(time.Since(start)),
+			}
+			if err != nil {
+				result.Status = StatusFail
+				result.Error = err.Error()
+			}
+			outcomes <- outcome{name, result}
+		}(name, c.checks[name])
+	}
+
+	report := &Report{Status: StatusOK, Checks: make(map[string]Result, len(c.names))}
+	for len(report.Checks) < len(c.names) {
+		select {
+		case o := <-outcomes:
+			report.Checks[o.name] = o.result
+			if o.result.Status != StatusOK {
+				report.Status = StatusFail
+			}
+
+		case <-ctx.Done():
+			for _, name := range c.names {
+				if _, done := report.Checks[name]; !done {
+					report.Checks[name] = Result{
+						Status:    StatusFail,
+						LatencyMS: latencyMS(time.Since(start)),
+						Error:     "timed out: " + ctx.Err().Error(),
+					}
+				}
+			}
+			report.Status = StatusFail
+		}
+	}
+
+	return report
+}
+
+func latencyMS(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,240 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"gochat-server/internal/models"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// RoomInfo summarizes a live room for the admin API.
+type RoomInfo struct {
+	ID          string           `json:"id"`
+	Name        string           `json:"name"`
+	Users       int              `json:"users"`
+	Connections int              `json:"connections"`
+	Clients     []ConnectionInfo `json:"clients,omitempty"`
+}
+
+// ConnectionInfo describes one connection, over any transport.
+type ConnectionInfo struct {
+	ID           string    `json:"id"`
+	RoomID       string    `json:"room_id"`
+	UserID       string    `json:"user_id"`
+	Username     string    `json:"username"`
+	Transport    string    `json:"transport"`
+	RemoteAddr   string    `json:"remote_addr"`
+	ConnectedAt  time.Time `json:"connected_at"`
+	SendBuffered int       `json:"send_buffered"`
+	SendCapacity int       `json:"send_capacity"`
+}
+
+// RoomInfos lists the live rooms, sorted by ID, without their connections.
+func (h *Hub) RoomInfos() []RoomInfo {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	connections := make(map[string]int, len(h.Rooms))
+	for client := range h.clients {
+		connections[client.RoomID]++
+	}
+
+	rooms := make([]RoomInfo, 0, len(h.Rooms))
+	for _, room := range h.Rooms {
+		rooms = append(rooms, RoomInfo{
+			ID:          room.ID,
+			Name:        room.Name,
+			Users:       len(room.Users),
+			Connections: connections[room.ID],
+		})
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].ID < rooms[j].ID })
+	return rooms
+}
+
+// RoomInfo describes a live room and its connections; ok is false if nobody
+// is connected to it.
+func (h *Hub) RoomInfo(roomID string) (info RoomInfo, ok bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	room := h.Rooms[roomID]
+	if room == nil {
+		return RoomInfo{}, false
+	}
+
+	info = RoomInfo{
+		ID:      room.ID,
+		Name:    room.Name,
+		Users:   len(room.Users),
+		Clients: []ConnectionInfo{},
+	}
+	for client := range h.clients {
+		if client.RoomID == roomID {
+			info.Clients = append(info.Clients, connectionInfo(client))
+		}
+	}
+	sortConnections(info.Clients)
+	info.Connections = len(info.Clients)
+	return info, true
+}
+
+// UserConnections returns how many clients userID has in roomID. In OnJoin
+// hooks it is 1 for the user's first client, and in OnLeave hooks 0 once the
+// user's last client has gone.
+func (h *Hub) UserConnections(roomID, userID string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if room := h.Rooms[roomID]; room != nil {
+		if user := room.Users[userID]; user != nil {
+			return user.Connections
+		}
+	}
+	return 0
+}
+
+// Connections lists every connection, oldest first.
+func (h *Hub) Connections() []ConnectionInfo {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	connections := make([]ConnectionInfo, 0, len(h.clients))
+	for client := range h.clients {
+		connections = append(connections, connectionInfo(client))
+	}
+	sortConnections(connections)
+	return connections
+}
+
+// Announce sends a server announcement to every connection and returns how
+// many it was queued for; connections with a full send buffer miss it.
+func (h *Hub) Announce(text string) int {
+	data, err := json.Marshal(&models.WSMessage{
+		Type:    "announcement",
+		Content: text,
+	})
+	if err != nil {
+		logrus.Error("Failed to marshal announcement: ", err)
+		return 0
+	}
+
+	// Held so unregisterClient can't close a Send channel under us
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	sent := 0
+	for client := range h.clients {
+		select {
+		case client.Send <- data:
+			sent++
+		default:
+		}
+	}
+	return sent
+}
+
+// Disconnect closes the connection with the given ID and reports whether it
+// was found. The client is told why in the close frame.
+func (h *Hub) Disconnect(connectionID, reason string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for client := range h.clients {
+		if client.ID == connectionID {
+			client.CloseWith(websocket.ClosePolicyViolation, reason)
+			return true
+		}
+	}
+	return false
+}
+
+// ErrRoomClosed is returned by Post for a room an admin has closed.
+var ErrRoomClosed = errors.New("room is closed")
+
+// CloseRoom closes the room until ReopenRoom is called: everyone in it gets a
+// room_closed event and is disconnected, and new clients and posted
+// messages are turned away. It returns how many connections were closed.
+// Closed rooms are only remembered until the server restarts.
+func (h *Hub) CloseRoom(roomID, reason string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closedRooms[roomID] = reason
+
+	closed := 0
+	for client := range h.clients {
+		if client.RoomID != roomID {
+			continue
+		}
+		rejectFromClosedRoom(client, reason)
+		closed++
+	}
+	return closed
+}
+
+// ReopenRoom lets clients join roomID again and reports whether it was closed.
+func (h *Hub) ReopenRoom(roomID string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, closed := h.closedRooms[roomID]; !closed {
+		return false
+	}
+	delete(h.closedRooms, roomID)
+	return true
+}
+
+// RoomClosed reports whether an admin has closed roomID, and why.
+func (h *Hub) RoomClosed(roomID string) (reason string, closed bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	reason, closed = h.closedRooms[roomID]
+	return reason, closed
+}
+
+// rejectFromClosedRoom tells the client its room is closed and disconnects it.
+func rejectFromClosedRoom(client *Client, reason string) {
+	data, err := json.Marshal(&models.WSMessage{
+		Type:   "room_closed",
+		RoomID: client.RoomID,
+		Data: map[string]interface{}{
+			"reason": reason,
+		},
+	})
+	if err != nil {
+		logrus.Error("Failed to marshal room_closed event: ", err)
+	} else {
+		select {
+		case client.Send <- data:
+		default:
+		}
+	}
+	client.CloseWith(websocket.ClosePolicyViolation, reason)
+}
+
+func connectionInfo(client *Client) ConnectionInfo {
+	return ConnectionInfo{
+		ID:           client.ID,
+		RoomID:       client.RoomID,
+		UserID:       client.UserID,
+		Username:     client.Username,
+		Transport:    client.Transport,
+		RemoteAddr:   client.RemoteAddr,
+		ConnectedAt:  client.ConnectedAt,
+		SendBuffered: len(client.Send),
+		SendCapacity: cap(client.Send),
+	}
+}
+
+func sortConnections(connections []ConnectionInfo) {
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].ConnectedAt.Before(connections[j].ConnectedAt)
+	})
+}
@@ -2,68 +2,159 @@
 package hub
 
 import (
-    "gochat-server/internal/models"
-    "gochat-server/internal/queue"
-    "gochat-server/internal/services"
-    "encoding/json"
-    "sync"
-    "time"
-
-    "github.com/gorilla/websocket"
-    "github.com/sirupsen/logrus"
+	"context"
+	"encoding/json"
+	"gochat-server/internal/metrics"
+	"gochat-server/internal/models"
+	"gochat-server/internal/services"
+	"gochat-server/internal/tracing"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Transports a client can be connected over
+const (
+	TransportWebSocket = "websocket"
+	TransportSSE       = "sse"
+	TransportLongPoll  = "longpoll"
+)
+
+// Client is one connection to a room. The hub only uses Send and Quit, so
+// besides WebSockets (Conn) it can stand for an SSE stream or a long-poll
+// session, which have no Conn.
 type Client struct {
-    Hub      *Hub
-    Conn     *websocket.Conn
-    Send     chan []byte
-    RoomID   string
-    UserID   string
-    Username string
+	Hub       *Hub
+	Conn      *websocket.Conn
+	Transport string
+	Send      chan []byte
+	RoomID    string
+	UserID    string
+	Username  string
+
+	// Connection details for the admin API
+	ID          string
+	RemoteAddr  string
+	ConnectedAt time.Time
+
+	// Quit is closed when the server wants the connection gone; the write
+	// pump flushes Send and sends CloseFrame.
+	Quit        chan struct{}
+	quitOnce    sync.Once
+	closeFrame  []byte
+	closeReason string
+}
+
+// CloseWith asks the client's write pump to flush and close the connection
+// with the given close code. Only the first call has any effect.
+func (c *Client) CloseWith(code int, reason string) {
+	c.quitOnce.Do(func() {
+		c.closeFrame = websocket.FormatCloseMessage(code, reason)
+		c.closeReason = reason
+		close(c.Quit)
+	})
+}
+
+// CloseFrame is the close message to send once Quit is closed.
+func (c *Client) CloseFrame() []byte {
+	return c.closeFrame
+}
+
+// CloseReason is why the client was closed, for transports without close
+// frames. Only valid once Quit is closed.
+func (c *Client) CloseReason() string {
+	return c.closeReason
 }
 
 type Hub struct {
-    Rooms          map[string]*models.Room
-    Register       chan *Client
-    Unregister     chan *Client
-    Broadcast      chan *models.WSMessage
-    MessageService *services.MessageService
-    QueueManager   *queue.Manager
-    UserService    *services.UserService
-    mu             sync.RWMutex
-}
-
-func NewHub(msgService *services.MessageService, queueMgr *queue.Manager, userService *services.UserService) *Hub {
-    return &Hub{
-        Rooms:          make(map[string]*models.Room),
-        Register:       make(chan *Client),
-        Unregister:     make(chan *Client),
-        Broadcast:      make(chan *models.WSMessage),
-        MessageService: msgService,
-        QueueManager:   queueMgr,
-        UserService:    userService,
-    }
-}
-
-func (h *Hub) Run() {
-    for {
-        select {
-        case client := <-h.Register:
-            h.registerClient(client)
-
-        case client := <-h.Unregister:
-            h.unregisterClient(client)
-
-        case message := <-h.Broadcast:
-            h.broadcastMessage(message)
-        }
-    }
-}
-
-func (h *Hub) registerClient(client *Client) {
+	Rooms               map[string]*models.Room
+	Register            chan *Client
+	Unregister          chan *Client
+	Broadcast           chan *models.WSMessage
+	MessageService      *services.MessageService
+	NotificationService *services.NotificationService
+	LinkPreviewService  *services.LinkPreviewService
+	UserService         *services.UserService
+	AttachmentService   *services.AttachmentService
+	ProfileService      *services.ProfileService
+	MembershipService   *services.MembershipService
+	mu                  sync.RWMutex
+
+	clients  map[*Client]struct{}
+	closing  atomic.Bool
+	started  atomic.Bool // set by Run, or by halt if Run never started
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	ping     chan chan struct{}
+	posts    chan *post
+	updates  chan *models.Message
+
+	// Rooms closed by an admin, with the reason; guarded by mu
+	closedRooms map[string]string
+
+	hooksMu   sync.RWMutex
+	onJoin    []func(*Client)
+	onLeave   []func(*Client)
+	onMessage []func(*models.WSMessage)
+}
+
+func NewHub(
+	msgService *services.MessageService,
+	notificationService *services.NotificationService,
+	linkPreviewService *services.LinkPreviewService,
+	userService *services.UserService,
+	attachmentService *services.AttachmentService,
+	profileService *services.ProfileService,
+	membershipService *services.MembershipService,
+) *Hub {
+	return &Hub{
+		Rooms:               make(map[string]*models.Room),
+		Register:            make(chan *Client),
+		Unregister:          make(chan *Client),
+		Broadcast:           make(chan *models.WSMessage),
+		MessageService:      msgService,
+		NotificationService: notificationService,
+		LinkPreviewService:  linkPreviewService,
+		UserService:         userService,
+		AttachmentService:   attachmentService,
+		ProfileService:      profileService,
+		MembershipService:   membershipService,
+		clients:             make(map[*Client]struct{}),
+		closedRooms:         make(map[string]string),
+		stop:                make(chan struct{}),
+		done:                make(chan struct{}),
+		ping:                make(chan chan struct{}),
+		posts:               make(chan *post),
+		updates:             make(chan *models.Message),
+	}
+}
+
+// registerClient adds the client to its room and reports whether it was
+// let in; clients of a closed room are turned away.
+func (h *Hub) registerClient(client *Client) bool {
+	if h.Closing() {
+		// Raced with Shutdown; it won't see this client, so close it here
+		h.disconnectForShutdown(client)
+	}
+
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
+	if reason, closed := h.closedRooms[client.RoomID]; closed {
+		rejectFromClosedRoom(client, reason)
+		return false
+	}
+
+	h.clients[client] = struct{}{}
+	defer h.updateGauges()
+
 	if h.Rooms[client.RoomID] == nil {
 		h.Rooms[client.RoomID] = &models.Room{
 			ID:    client.RoomID,
@@ -73,21 +164,24 @@ func (h *Hub) registerClient(client *Client) {
 	}
 
 	room := h.Rooms[client.RoomID]
-	user := &models.User{
-		ID:       client.UserID,
-		Username: client.Username,
-		RoomID:   client.RoomID,
-		Online:   true,
+	user := room.Users[client.UserID]
+	if user == nil {
+		user = &models.User{
+			ID:     client.UserID,
+			RoomID: client.RoomID,
+			Online: true,
+		}
+		room.Users[client.UserID] = user
 	}
-
-	room.Users[client.UserID] = user
+	user.Username = client.Username
+	user.Connections++
 	room.ActiveUsers = len(room.Users)
 
 	// Register client in UserService
 	h.UserService.AddClient(client.UserID, client.RoomID, client)
 
 	// Notify room about new user
-	h.broadcastToRoom(client.RoomID, &models.WSMessage{
+	h.sendToRoom(room, &models.WSMessage{
 		Type:     "user_joined",
 		RoomID:   client.RoomID,
 		UserID:   client.UserID,
@@ -99,72 +193,269 @@ func (h *Hub) registerClient(client *Client) {
 		"user_id": client.UserID,
 		"room_id": client.RoomID,
 	}).Info("User joined room")
+	return true
 }
 
-func (h *Hub) unregisterClient(client *Client) {
-    h.mu.Lock()
-    defer h.mu.Unlock()
-
-    if room := h.Rooms[client.RoomID]; room != nil {
-        if _, exists := room.Users[client.UserID]; exists {
-            delete(room.Users, client.UserID)
-            room.ActiveUsers = len(room.Users)
-            close(client.Send)
-
-            // Remove client from UserService
-            h.UserService.RemoveClient(client.UserID, client.RoomID, client)
-
-            // Clean up empty rooms
-            if len(room.Users) == 0 {
-                delete(h.Rooms, client.RoomID)
-            } else {
-                // Notify room about user leaving
-                h.broadcastToRoom(client.RoomID, &models.WSMessage{
-                    Type:     "user_left",
-                    RoomID:   client.RoomID,
-                    UserID:   client.UserID,
-                    Username: client.Username,
-                    Data:     h.getRoomUsers(client.RoomID),
-                })
-            }
-
-            logrus.WithFields(logrus.Fields{
-                "user_id": client.UserID,
-                "room_id": client.RoomID,
-            }).Info("User left room")
-        }
-    }
+// unregisterClient reports whether the client was still registered.
+func (h *Hub) unregisterClient(client *Client) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.clients[client]; !ok {
+		return false
+	}
+	delete(h.clients, client)
+	defer h.updateGauges()
+
+	close(client.Send)
+	h.UserService.RemoveClient(client.UserID, client.RoomID, client)
+
+	if room := h.Rooms[client.RoomID]; room != nil {
+		if user := room.Users[client.UserID]; user != nil {
+			user.Connections--
+			if user.Connections > 0 {
+				// Still connected from another tab or device
+				return true
+			}
+			delete(room.Users, client.UserID)
+			room.ActiveUsers = len(room.Users)
+
+			// Clean up empty rooms
+			if len(room.Users) == 0 {
+				delete(h.Rooms, client.RoomID)
+			} else {
+				// Notify room about user leaving
+				h.sendToRoom(room, &models.WSMessage{
+					Type:     "user_left",
+					RoomID:   client.RoomID,
+					UserID:   client.UserID,
+					Username: client.Username,
+					Data:     h.getRoomUsers(client.RoomID),
+				})
+			}
+
+			logrus.WithFields(logrus.Fields{
+				"user_id": client.UserID,
+				"room_id": client.RoomID,
+			}).Info("User left room")
+		}
+	}
+
+	return true
 }
 
 func (h *Hub) broadcastMessage(message *models.WSMessage) {
-    h.mu.RLock()
-    room := h.Rooms[message.RoomID]
-    h.mu.RUnlock()
+	start := time.Now()
+
+	// The sender may be long gone by the time notifications are queued, so
+	// keep its trace but not its cancellation
+	ctx := context.Background()
+	if message.Context != nil {
+		ctx = context.WithoutCancel(message.Context)
+	}
+	ctx, span := tracing.Tracer().Start(ctx, "hub.broadcast", trace.WithAttributes(
+		attribute.String("message.type", message.Type),
+		attribute.String("room.id", message.RoomID),
+	))
+	defer span.End()
+	message.Context = ctx
+	h.mu.RLock()
+	room := h.Rooms[message.RoomID]
+	_, closed := h.closedRooms[message.RoomID]
+	h.mu.RUnlock()
+
+	if closed {
+		// Sent before its client was disconnected, or posted after the check in Post
+		return
+	}
+
+	if room == nil {
+		if message.Type != "message" {
+			return
+		}
+		// Posted through the API to a room nobody is connected to: still
+		// saved, and members are notified
+		room = &models.Room{
+			ID:    message.RoomID,
+			Name:  message.RoomID,
+			Users: make(map[string]*models.User),
+		}
+	}
+
+	// Save message to database
+	if message.Type == "message" {
+		message.Attachments = nil
+		if len(message.AttachmentIDs) > 0 {
+			ctx, cancel := context.WithTimeout(message.Context, 5*time.Second)
+			attachments, err := h.AttachmentService.GetRoomAttachments(ctx, message.RoomID, message.UserID, message.AttachmentIDs)
+			cancel()
+			if err != nil {
+				logrus.Error("Failed to resolve attachments: ", err)
+			}
+			message.Attachments = attachments
+			message.AttachmentIDs = nil
+		}
+
+		if message.Content == "" && len(message.Attachments) == 0 {
+			return
+		}
+
+		message.Mentions = h.resolveMentions(message, room)
+
+		msg := &models.Message{
+			RoomID:      message.RoomID,
+			UserID:      message.UserID,
+			Username:    message.Username,
+			Content:     message.Content,
+			Attachments: message.Attachments,
+			Mentions:    message.Mentions,
+			Bot:         message.Bot,
+			Timestamp:   time.Now(),
+		}
+
+		if err := h.MessageService.SaveMessage(ctx, msg); err != nil {
+			logrus.Error("Failed to save message: ", err)
+		} else {
+			message.ID = msg.ID.Hex()
+
+			if len(services.ExtractURLs(msg.Content)) > 0 {
+				if err := h.LinkPreviewService.QueuePreviews(ctx, message.ID); err != nil {
+					logrus.Error("Failed to queue link preview: ", err)
+				}
+			}
+		}
+	}
 
-    if room == nil {
-        return
-    }
+	// Broadcast to all users in room
+	h.broadcastToRoom(message.RoomID, message)
+	if message.Type == "message" {
+		metrics.Messages.Inc()
+		metrics.BroadcastDuration.Observe(time.Since(start).Seconds())
+	}
+	h.runMessageHooks(message)
+
+	if message.Type == "message" {
+		h.queueNotifications(message, room, h.notifyMentions(message))
+	}
+}
+
+// resolveMentions turns @username, @here and @room in the message into user IDs.
+// Usernames only match members of the room, ignoring case. The author is
+// never included.
+func (h *Hub) resolveMentions(message *models.WSMessage, room *models.Room) []string {
+	mentions := services.ParseMentions(message.Content)
+	if mentions.Empty() {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(message.Context, 5*time.Second)
+	defer cancel()
+
+	userIDs := make(map[string]bool)
+
+	var members []string
+	if len(mentions.Usernames) > 0 || mentions.Room {
+		var err error
+		members, err = h.MembershipService.GetMembers(ctx, message.RoomID)
+		if err != nil {
+			logrus.Error("Failed to load room members: ", err)
+		}
+		// Connected users count even if recording their membership failed
+		known := make(map[string]bool, len(members))
+		for _, userID := range members {
+			known[userID] = true
+		}
+		h.mu.RLock()
+		for userID := range room.Users {
+			if !known[userID] {
+				members = append(members, userID)
+			}
+		}
+		h.mu.RUnlock()
+	}
+
+	if len(mentions.Usernames) > 0 && len(members) > 0 {
+		profiles, err := h.ProfileService.FindMembersByUsernames(ctx, members, mentions.Usernames)
+		if err != nil {
+			logrus.Error("Failed to resolve mentioned usernames: ", err)
+		}
+		for _, profile := range profiles {
+			userIDs[profile.ID] = true
+		}
+	}
 
-    // Save message to database
-    if message.Type == "message" {
-        msg := &models.Message{
-            RoomID:    message.RoomID,
-            UserID:    message.UserID,
-            Username:  message.Username,
-            Content:   message.Content,
-            Timestamp: time.Now(),
-        }
+	if mentions.Here {
+		h.mu.RLock()
+		for userID := range room.Users {
+			userIDs[userID] = true
+		}
+		h.mu.RUnlock()
+	}
 
-        if err := h.MessageService.SaveMessage(msg); err != nil {
-            logrus.Error("Failed to save message: ", err)
-        }
+	if mentions.Room {
+		for _, userID := range members {
+			userIDs[userID] = true
+		}
+	}
 
-        // Queue email notifications for offline users
-        h.queueEmailNotifications(message, room)
-    }
+	delete(userIDs, message.UserID)
 
-    // Broadcast to all users in room
-    h.broadcastToRoom(message.RoomID, message)
+	result := make([]string, 0, len(userIDs))
+	for userID := range userIDs {
+		result = append(result, userID)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// notifyMentions sends a mention event to every connection of online mentioned
+// users and returns the ones who are offline, to be emailed instead.
+func (h *Hub) notifyMentions(message *models.WSMessage) []string {
+	event := &models.WSMessage{
+		ID:       message.ID,
+		Type:     "mention",
+		RoomID:   message.RoomID,
+		UserID:   message.UserID,
+		Username: message.Username,
+		Content:  message.Content,
+	}
+
+	var offline []string
+	for _, userID := range message.Mentions {
+		if h.UserService.IsUserOnline(userID) {
+			h.sendToUser(userID, event)
+		} else {
+			offline = append(offline, userID)
+		}
+	}
+	return offline
+}
+
+// sendToUser delivers message to all of the user's connections, whatever room they are in.
+func (h *Hub) sendToUser(userID string, message *models.WSMessage) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		logrus.Error("Failed to marshal message: ", err)
+		return
+	}
+
+	for _, clientInterface := range h.UserService.GetAllUserClients(userID) {
+		client, ok := clientInterface.(*Client)
+		if !ok {
+			logrus.Warn("Invalid client type in user service")
+			continue
+		}
+
+		select {
+		case client.Send <- data:
+		default:
+			metrics.DroppedSends.Inc()
+			logrus.WithFields(logrus.Fields{
+				"user_id": userID,
+				"room_id": client.RoomID,
+			}).Warn("Client send buffer full, dropping message")
+		}
+	}
 }
 
 func (h *Hub) broadcastToRoom(roomID string, message *models.WSMessage) {
@@ -172,9 +463,15 @@ func (h *Hub) broadcastToRoom(roomID string, message *models.WSMessage) {
 	room := h.Rooms[roomID]
 	h.mu.RUnlock()
 
-	if room == nil {
-		return
+	if room != nil {
+		h.sendToRoom(room, message)
 	}
+}
+
+// sendToRoom delivers message to everyone in room. Unlike broadcastToRoom it
+// doesn't take h.mu, so it is safe to call while holding it.
+func (h *Hub) sendToRoom(room *models.Room, message *models.WSMessage) {
+	roomID := room.ID
 
 	data, err := json.Marshal(message)
 	if err != nil {
@@ -195,7 +492,9 @@ func (h *Hub) broadcastToRoom(roomID string, message *models.WSMessage) {
 				select {
 				case client.Send <- data:
 				default:
-					close(client.Send)
+					metrics.DroppedSends.Inc()
+					// Too slow to keep up; its read pump unregisters it once closed
+					client.CloseWith(websocket.CloseTryAgainLater, "too slow")
 					h.UserService.RemoveClient(userID, roomID, client)
 				}
 			}
@@ -203,39 +502,69 @@ func (h *Hub) broadcastToRoom(roomID string, message *models.WSMessage) {
 	}
 }
 
-func (h *Hub) queueEmailNotifications(message *models.WSMessage, room *models.Room) {
-    // In a real implementation, you'd check which users are actually offline
-    // For now, we'll simulate some offline users
-    offlineUsers := []string{"offline_user1@example.com", "offline_user2@example.com"}
+// BroadcastMessageUpdate tells clients in the message's room to re-render a
+// stored message. It is safe to call from any goroutine: the update is handed
+// to Run, which owns the rooms. It is dropped once the hub has stopped.
+func (h *Hub) BroadcastMessageUpdate(msg *models.Message) {
+	select {
+	case h.updates <- msg:
+	case <-h.done:
+	}
+}
 
-    for _, email := range offlineUsers {
-        payload := &models.EmailPayload{
-            To:      email,
-            Subject: "New message in " + room.Name,
-            Body:    message.Username + ": " + message.Content,
-        }
+func (h *Hub) broadcastMessageUpdate(msg *models.Message) {
+	update := &models.WSMessage{
+		ID:     msg.ID.Hex(),
+		Type:   "message_updated",
+		RoomID: msg.RoomID,
+		Data:   msg,
+	}
+	h.broadcastToRoom(msg.RoomID, update)
+	h.runMessageHooks(update)
+}
 
-        if err := h.QueueManager.QueueEmail(payload); err != nil {
-            logrus.Error("Failed to queue email: ", err)
-        }
-    }
+// queueNotifications hands the message to the notification worker, which
+// emails the offline mentioned users and the room's other offline members.
+func (h *Hub) queueNotifications(message *models.WSMessage, room *models.Room, offlineMentions []string) {
+	ctx, cancel := context.WithTimeout(message.Context, 5*time.Second)
+	defer cancel()
+
+	err := h.NotificationService.QueueMessageFanout(ctx, &models.MessageFanout{
+		MessageID: message.ID,
+		RoomID:    message.RoomID,
+		RoomName:  room.Name,
+		UserID:    message.UserID,
+		Username:  message.Username,
+		Content:   message.Content,
+		Mentioned: offlineMentions,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		logrus.Error("Failed to queue message notifications: ", err)
+	}
 }
 
 func (h *Hub) getRoomUsers(roomID string) []*models.User {
-    room := h.Rooms[roomID]
-    if room == nil {
-        return []*models.User{}
-    }
+	room := h.Rooms[roomID]
+	if room == nil {
+		return []*models.User{}
+	}
 
-    users := make([]*models.User, 0, len(room.Users))
-    for _, user := range room.Users {
-        users = append(users, user)
-    }
-    return users
+	users := make([]*models.User, 0, len(room.Users))
+	for _, user := range room.Users {
+		users = append(users, user)
+	}
+	return users
+}
+
+// updateGauges refreshes the connection gauges; h.mu must be held.
+func (h *Hub) updateGauges() {
+	metrics.ConnectedClients.Set(float64(len(h.clients)))
+	metrics.Rooms.Set(float64(len(h.Rooms)))
 }
 
 func (h *Hub) GetRoom(roomID string) *models.Room {
-    h.mu.RLock()
-    defer h.mu.RUnlock()
-    return h.Rooms[roomID]
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.Rooms[roomID]
 }
@@ -0,0 +1,225 @@
+package hub
+
+import (
+	"context"
+	"errors"
+
+	"gochat-server/internal/models"
+
+	"github.com/gorilla/websocket"
+)
+
+// OnJoin registers fn to run after a client has joined its room.
+func (h *Hub) OnJoin(fn func(*Client)) {
+	h.hooksMu.Lock()
+	defer h.hooksMu.Unlock()
+	h.onJoin = append(h.onJoin, fn)
+}
+
+// OnLeave registers fn to run after a client has left its room.
+func (h *Hub) OnLeave(fn func(*Client)) {
+	h.hooksMu.Lock()
+	defer h.hooksMu.Unlock()
+	h.onLeave = append(h.onLeave, fn)
+}
+
+// OnMessage registers fn to run after a message has been saved and broadcast,
+// and after a "message_updated" broadcast of a stored message.
+func (h *Hub) OnMessage(fn func(*models.WSMessage)) {
+	h.hooksMu.Lock()
+	defer h.hooksMu.Unlock()
+	h.onMessage = append(h.onMessage, fn)
+}
+
+// Hooks run on the Run goroutine, so they must not block or send to the hub's
+// channels.
+func (h *Hub) runClientHooks(hooks *[]func(*Client), client *Client) {
+	h.hooksMu.RLock()
+	fns := *hooks
+	h.hooksMu.RUnlock()
+
+	for _, fn := range fns {
+		fn(client)
+	}
+}
+
+func (h *Hub) runMessageHooks(message *models.WSMessage) {
+	h.hooksMu.RLock()
+	fns := h.onMessage
+	h.hooksMu.RUnlock()
+
+	for _, fn := range fns {
+		fn(message)
+	}
+}
+
+// Run processes registrations, departures and messages until ctx is cancelled
+// or the hub is stopped. Either way every client is closed and whatever is
+// still queued is processed before it returns. Run returns ctx.Err() when
+// cancelled and nil when stopped. Run is only meant to be called once; a
+// second call, or a call after the hub was stopped, returns nil at once.
+func (h *Hub) Run(ctx context.Context) error {
+	if !h.started.CompareAndSwap(false, true) {
+		return nil
+	}
+	defer close(h.done)
+
+	for {
+		select {
+		case <-ctx.Done():
+			h.closing.Store(true)
+			h.closeClients(websocket.CloseGoingAway, "server stopping")
+			h.drain()
+			return ctx.Err()
+
+		case <-h.stop:
+			h.closeClients(websocket.CloseGoingAway, "server stopping")
+			h.drain()
+			return nil
+
+		case client := <-h.Register:
+			if h.registerClient(client) {
+				h.runClientHooks(&h.onJoin, client)
+			}
+
+		case client := <-h.Unregister:
+			h.leave(client)
+
+		case message := <-h.Broadcast:
+			h.broadcastMessage(message)
+
+		case p := <-h.posts:
+			h.broadcastMessage(p.message)
+			close(p.done)
+
+		case msg := <-h.updates:
+			h.broadcastMessageUpdate(msg)
+
+		case reply := <-h.ping:
+			close(reply)
+		}
+	}
+}
+
+func (h *Hub) leave(client *Client) {
+	if h.unregisterClient(client) {
+		h.runClientHooks(&h.onLeave, client)
+	}
+}
+
+// Stop closes every client and stops Run, returning once it has. Unlike
+// Shutdown it doesn't warn clients or wait for them to disconnect. It may be
+// called more than once, and before Run was started.
+func (h *Hub) Stop() {
+	h.closing.Store(true)
+	h.halt()
+	<-h.done
+}
+
+// halt tells Run to stop. If Run was never started there is nothing to wait
+// for, so done is closed here and a later Run returns straight away.
+func (h *Hub) halt() {
+	h.stopOnce.Do(func() { close(h.stop) })
+	if h.started.CompareAndSwap(false, true) {
+		close(h.done)
+	}
+}
+
+// ErrStopped is returned by Ping and Post once the hub has stopped.
+var ErrStopped = errors.New("hub is not running")
+
+// Ping checks the Run goroutine is alive and not stuck, by waiting for it to
+// pick a request off its loop.
+func (h *Hub) Ping(ctx context.Context) error {
+	reply := make(chan struct{})
+	select {
+	case h.ping <- reply:
+	case <-h.done:
+		return ErrStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	<-reply
+	return nil
+}
+
+// ErrMessageNotSaved is returned by Post when the message couldn't be stored.
+var ErrMessageNotSaved = errors.New("message was not saved")
+
+type post struct {
+	message *models.WSMessage
+	done    chan struct{}
+}
+
+// Post sends a message from outside a WebSocket connection through the same
+// pipeline as client messages (saved, broadcast, notifications queued) and
+// waits until the hub has processed it. It returns the stored message's ID,
+// or ErrRoomClosed if an admin has closed the room.
+func (h *Hub) Post(ctx context.Context, message *models.WSMessage) (string, error) {
+	if h.Closing() {
+		return "", ErrStopped
+	}
+	if _, closed := h.RoomClosed(message.RoomID); closed {
+		return "", ErrRoomClosed
+	}
+
+	p := &post{message: message, done: make(chan struct{})}
+	select {
+	case h.posts <- p:
+	case <-h.done:
+		return "", ErrStopped
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	// Once handed over the message will be processed, so wait for it even if
+	// ctx ends; giving up here would invite a duplicate retry
+	<-p.done
+	if message.ID == "" {
+		if _, closed := h.RoomClosed(message.RoomID); closed {
+			return "", ErrRoomClosed
+		}
+		return "", ErrMessageNotSaved
+	}
+	return message.ID, nil
+}
+
+// Done is closed when Run has returned. Client pumps select on it so they
+// never block on a hub that has stopped.
+func (h *Hub) Done() <-chan struct{} {
+	return h.done
+}
+
+// closeClients asks every client's write pump to close its connection with
+// the given close code.
+func (h *Hub) closeClients(code int, reason string) {
+	// Held so unregisterClient can't close a Send channel under us
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for client := range h.clients {
+		client.CloseWith(code, reason)
+	}
+}
+
+// drain processes whatever is still queued for the hub once its clients have
+// been closed. Clients registering now are closed straight away.
+func (h *Hub) drain() {
+	for {
+		select {
+		case client := <-h.Register:
+			client.CloseWith(websocket.CloseGoingAway, "server stopping")
+		case client := <-h.Unregister:
+			h.leave(client)
+		case message := <-h.Broadcast:
+			h.broadcastMessage(message)
+		case p := <-h.posts:
+			h.broadcastMessage(p.message)
+			close(p.done)
+		case msg := <-h.updates:
+			h.broadcastMessageUpdate(msg)
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"gochat-server/internal/models"
+	"gochat-server/internal/queue/queuetest"
+	"gochat-server/internal/services"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// newTestHub returns a hub whose services use the mock deployment and whose
+// jobs run inline.
+func newTestHub(mt *mtest.T) *Hub {
+	q := queuetest.NewManager()
+	userService := services.NewUserService()
+	profileService := services.NewProfileService(mt.DB)
+	membershipService := services.NewMembershipService(mt.DB)
+	notificationService := services.NewNotificationService(services.NewPreferenceService(mt.DB), profileService, membershipService, userService, nil)
+	notificationService.RegisterJobs(q)
+
+	return NewHub(services.NewMessageService(mt.DB), notificationService, nil, userService, nil, profileService, membershipService)
+}
+
+// mockSavedMessage queues the mock replies for saving one message: the insert,
+// then the fan-out job finding no members to notify.
+func mockSavedMessage(mt *mtest.T) {
+	mt.AddMockResponses(
+		mtest.CreateSuccessResponse(),
+		mtest.CreateSuccessResponse(bson.E{Key: "values", Value: bson.A{}}),
+	)
+}
+
+func newTestClient(roomID, userID string) *Client {
+	return &Client{
+		ID:       userID + "-conn",
+		RoomID:   roomID,
+		UserID:   userID,
+		Username: userID,
+		Send:     make(chan []byte, 16),
+		Quit:     make(chan struct{}),
+	}
+}
+
+// startHub runs h and returns a channel that receives Run's result.
+func startHub(h *Hub) <-chan error {
+	result := make(chan error, 1)
+	go func() { result <- h.Run(context.Background()) }()
+	return result
+}
+
+func waitFor[T any](t *testing.T, ch <-chan T, what string) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+		panic("unreachable")
+	}
+}
+
+func TestStopStopsRun(t *testing.T) {
+	h := NewHub(nil, nil, nil, services.NewUserService(), nil, nil, nil)
+	result := startHub(h)
+
+	client := newTestClient("general", "u1")
+	h.Register <- client
+	h.Stop()
+
+	if err := waitFor(t, result, "Run to return"); err != nil {
+		t.Errorf("Run = %v, want nil after Stop", err)
+	}
+	waitFor(t, h.Done(), "Done")
+	waitFor(t, client.Quit, "the client to be closed")
+	if client.CloseReason() != "server stopping" {
+		t.Errorf("client closed with %q", client.CloseReason())
+	}
+	if !h.Closing() {
+		t.Error("hub doesn't report Closing after Stop")
+	}
+}
+
+func TestRunReturnsWhenCancelled(t *testing.T) {
+	h := NewHub(nil, nil, nil, services.NewUserService(), nil, nil, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() { result <- h.Run(ctx) }()
+
+	cancel()
+	if err := waitFor(t, result, "Run to return"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Run = %v, want context.Canceled", err)
+	}
+	if !h.Closing() {
+		t.Error("hub doesn't report Closing after Run was cancelled")
+	}
+}
+
+func TestStopIsIdempotent(t *testing.T) {
+	h := NewHub(nil, nil, nil, services.NewUserService(), nil, nil, nil)
+	startHub(h)
+
+	stopped := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for range 3 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				h.Stop()
+			}()
+		}
+		wg.Wait()
+		h.Stop()
+		close(stopped)
+	}()
+	waitFor(t, stopped, "Stop to return")
+}
+
+func TestStopWithoutRun(t *testing.T) {
+	h := NewHub(nil, nil, nil, services.NewUserService(), nil, nil, nil)
+
+	stopped := make(chan struct{})
+	go func() {
+		h.Stop()
+		close(stopped)
+	}()
+	waitFor(t, stopped, "Stop to return")
+	waitFor(t, h.Done(), "Done")
+
+	// A Run started after Stop has nothing to do
+	if err := waitFor(t, startHub(h), "Run to return"); err != nil {
+		t.Errorf("Run after Stop = %v, want nil", err)
+	}
+	if err := h.Ping(context.Background()); !errors.Is(err, ErrStopped) {
+		t.Errorf("Ping = %v, want ErrStopped", err)
+	}
+}
+
+func TestShutdownWithoutRun(t *testing.T) {
+	h := NewHub(nil, nil, nil, services.NewUserService(), nil, nil, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := h.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown = %v, want nil", err)
+	}
+}
+
+func TestShutdownDeliversMessagesFromClosingClients(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("drain", func(mt *mtest.T) {
+		mockSavedMessage(mt)
+		h := newTestHub(mt)
+		result := startHub(h)
+
+		client := newTestClient("general", "u1")
+		h.Register <- client
+
+		shutdown := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			shutdown <- h.Shutdown(ctx)
+		}()
+
+		// As the client's read pump does once its connection is closed: hand
+		// over what it had already read, then unregister
+		waitFor(t, client.Quit, "the client to be told to disconnect")
+		h.Broadcast <- &models.WSMessage{
+			Type:     "message",
+			RoomID:   "general",
+			UserID:   "u1",
+			Username: "u1",
+			Content:  "last words",
+			Context:  context.Background(),
+		}
+		h.Unregister <- client
+
+		if err := waitFor(t, shutdown, "Shutdown to return"); err != nil {
+			t.Fatalf("Shutdown = %v", err)
+		}
+		if err := waitFor(t, result, "Run to return"); err != nil {
+			t.Errorf("Run = %v, want nil", err)
+		}
+
+		if started := mt.GetStartedEvent(); started == nil || started.CommandName != "insert" {
+			t.Fatalf("want the message saved, got %+v", started)
+		}
+
+		var types []string
+		for frame := range client.Send {
+			var msg models.WSMessage
+			if err := json.Unmarshal(frame, &msg); err != nil {
+				t.Fatalf("bad frame %s: %v", frame, err)
+			}
+			types = append(types, msg.Type)
+			if msg.Type == "message" && (msg.ID == "" || msg.Content != "last words") {
+				t.Errorf("broadcast %+v, want the saved message", msg)
+			}
+		}
+		if fmt.Sprint(types) != "[user_joined server_shutdown message]" {
+			t.Errorf("client got %v, want its join, the shutdown notice and then its message", types)
+		}
+	})
+}
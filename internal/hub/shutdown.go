@@ -0,0 +1,99 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"time"
+
+	"gochat-server/internal/models"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Clients are told to wait a random delay in this range before
+	// reconnecting, so a restart doesn't bring them all back at once.
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = 5 * time.Second
+
+	shutdownPollInterval = 50 * time.Millisecond
+)
+
+// Closing reports whether the hub is shutting down and refusing new clients.
+func (h *Hub) Closing() bool {
+	return h.closing.Load()
+}
+
+// Shutdown stops the hub gracefully: new clients are refused, every connected
+// client gets a server_shutdown frame with a reconnect hint and is
+// disconnected, and messages already on their way to Broadcast are saved and
+// delivered before Run returns. It gives up when ctx expires.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	if !h.closing.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	// Held so unregisterClient can't close a Send channel under us
+	h.mu.RLock()
+	logrus.WithField("clients", len(h.clients)).Info("Disconnecting WebSocket clients")
+	for client := range h.clients {
+		h.disconnectForShutdown(client)
+	}
+	h.mu.RUnlock()
+
+	// Clients unregister as their connections close; anything they sent
+	// before that is still processed by Run.
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for h.clientCount() > 0 {
+		select {
+		case <-ticker.C:
+		case <-h.done:
+			return nil
+		case <-ctx.Done():
+			logrus.WithField("clients", h.clientCount()).Warn("Timed out waiting for WebSocket clients to disconnect")
+			h.halt()
+			return ctx.Err()
+		}
+	}
+
+	h.halt()
+	select {
+	case <-h.done:
+		logrus.Info("Hub drained")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// disconnectForShutdown queues the server_shutdown frame and tells the
+// client's write pump to close the connection once it has been flushed.
+func (h *Hub) disconnectForShutdown(client *Client) {
+	delay := reconnectMinDelay + time.Duration(rand.Int63n(int64(reconnectMaxDelay-reconnectMinDelay)))
+	data, err := json.Marshal(&models.WSMessage{
+		Type:   "server_shutdown",
+		RoomID: client.RoomID,
+		Data: map[string]interface{}{
+			"reason":         "server restarting",
+			"reconnect":      true,
+			"retry_after_ms": delay.Milliseconds(),
+		},
+	})
+	if err == nil {
+		select {
+		case client.Send <- data:
+		default:
+		}
+	}
+
+	client.CloseWith(websocket.CloseServiceRestart, "server restarting")
+}
+
+func (h *Hub) clientCount() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients)
+}
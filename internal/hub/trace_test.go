@@ -0,0 +1,74 @@
+package hub
+
+import (
+	"context"
+	"testing"
+
+	"gochat-server/internal/models"
+	"gochat-server/internal/services"
+	"gochat-server/internal/tracing"
+
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracePropagatesToQueuedJobs(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("ws message", func(mt *mtest.T) {
+		mockSavedMessage(mt)
+		h := newTestHub(mt)
+		go h.Run(context.Background())
+
+		// As the chat handler does for a frame read off a WebSocket
+		ctx, receive := tracing.Tracer().Start(context.Background(), "ws.receive")
+		h.Broadcast <- &models.WSMessage{
+			Type:     "message",
+			RoomID:   "general",
+			UserID:   "u1",
+			Username: "alice",
+			Content:  "hello",
+			Context:  ctx,
+		}
+		receive.End()
+		h.Stop()
+
+		spans := map[string]sdktrace.ReadOnlySpan{}
+		for _, span := range recorder.Ended() {
+			spans[span.Name()] = span
+		}
+		ws, broadcast, job := spans["ws.receive"], spans["hub.broadcast"], spans["job "+services.TypeMessageFanout]
+		if ws == nil || broadcast == nil || job == nil {
+			t.Fatalf("missing spans, got %v", spans)
+		}
+
+		if broadcast.Parent().SpanID() != ws.SpanContext().SpanID() {
+			t.Errorf("hub.broadcast isn't a child of ws.receive")
+		}
+		if job.Parent().SpanID() != broadcast.SpanContext().SpanID() {
+			t.Errorf("the fan-out job isn't a child of hub.broadcast")
+		}
+		if !job.Parent().IsRemote() {
+			t.Errorf("the fan-out job's parent should come from the task payload")
+		}
+		if job.Status().Code != codes.Unset {
+			t.Errorf("the fan-out job failed: %s", job.Status().Description)
+		}
+		if job.SpanContext().TraceID() != ws.SpanContext().TraceID() {
+			t.Errorf("the fan-out job is in trace %s, want %s", job.SpanContext().TraceID(), ws.SpanContext().TraceID())
+		}
+	})
+}
@@ -0,0 +1,47 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"gochat-server/internal/config"
+)
+
+// Mailer delivers a fully formed RFC 5322 message to its recipients.
+type Mailer interface {
+	Send(ctx context.Context, from string, to []string, msg []byte) error
+	Close() error
+}
+
+// Pinger is implemented by transports that can check their server is reachable.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// New returns the transport selected by cfg.EmailTransport.
+func New(cfg *config.Config) (Mailer, error) {
+	switch cfg.EmailTransport {
+	case "smtp", "":
+		port, err := strconv.Atoi(cfg.SMTPPort)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SMTP port %q", cfg.SMTPPort)
+		}
+		return NewSMTPMailer(SMTPOptions{
+			Host:     cfg.SMTPHost,
+			Port:     port,
+			Username: cfg.SMTPUser,
+			Password: cfg.SMTPPass,
+			Security: cfg.SMTPSecurity,
+			PoolSize: cfg.SMTPPoolSize,
+			Timeout:  30 * time.Second,
+		})
+	case "file":
+		return NewFileMailer(cfg.EmailFileDir)
+	case "memory":
+		return NewMemoryMailer(), nil
+	default:
+		return nil, fmt.Errorf("unknown email transport %q", cfg.EmailTransport)
+	}
+}
@@ -0,0 +1,51 @@
+package mailer
+
+import (
+	"context"
+	"sync"
+)
+
+type SentMessage struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+// MemoryMailer captures messages in memory so tests can inspect what was sent.
+type MemoryMailer struct {
+	mu       sync.Mutex
+	messages []SentMessage
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+func (m *MemoryMailer) Send(ctx context.Context, from string, to []string, msg []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages = append(m.messages, SentMessage{
+		From: from,
+		To:   append([]string(nil), to...),
+		Data: append([]byte(nil), msg...),
+	})
+	return nil
+}
+
+// Messages returns a copy of everything sent so far.
+func (m *MemoryMailer) Messages() []SentMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]SentMessage(nil), m.messages...)
+}
+
+func (m *MemoryMailer) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = nil
+}
+
+func (m *MemoryMailer) Close() error {
+	return nil
+}
@@ -0,0 +1,303 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SecurityNone     = "none"
+	SecuritySTARTTLS = "starttls"
+	SecurityTLS      = "tls"
+
+	// Servers commonly drop idle connections after a minute or so
+	smtpMaxIdle = 30 * time.Second
+)
+
+type SMTPOptions struct {
+	Host     string
+	Port     int
+	Username string // auth is skipped when empty
+	Password string
+	Security string // none, starttls or tls (implicit TLS, usually port 465)
+	PoolSize int
+	Timeout  time.Duration // for dialing and for each exchange with the server
+}
+
+// SMTPMailer sends over SMTP, keeping up to PoolSize idle connections for reuse.
+type SMTPMailer struct {
+	opts SMTPOptions
+	mu   sync.Mutex
+	idle []*pooledConn
+}
+
+type pooledConn struct {
+	conn     net.Conn // under client, for deadlines
+	client   *smtp.Client
+	lastUsed time.Time
+}
+
+// arm bounds the commands that follow by timeout and ctx: the connection's
+// deadline is the earlier of the two, and cancelling ctx fails pending reads
+// and writes straight away. The returned func lifts the deadline again so
+// the connection can go back to the pool.
+func (c *pooledConn) arm(ctx context.Context, timeout time.Duration) (disarm func()) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.conn.SetDeadline(deadline)
+
+	stop := context.AfterFunc(ctx, func() {
+		c.conn.SetDeadline(time.Unix(1, 0))
+	})
+	return func() {
+		stop()
+		c.conn.SetDeadline(time.Time{})
+	}
+}
+
+// quit says goodbye to the server, giving up after timeout.
+func (c *pooledConn) quit(timeout time.Duration) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	c.client.Quit()
+}
+
+func NewSMTPMailer(opts SMTPOptions) (*SMTPMailer, error) {
+	switch opts.Security {
+	case "":
+		opts.Security = SecurityNone
+	case SecurityNone, SecuritySTARTTLS, SecurityTLS:
+	default:
+		return nil, fmt.Errorf("unknown SMTP security mode %q", opts.Security)
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 30 * time.Second
+	}
+	return &SMTPMailer{opts: opts}, nil
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, from string, to []string, msg []byte) error {
+	conn, err := m.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	disarm := conn.arm(ctx, m.opts.Timeout)
+	err = deliver(conn.client, from, to, msg)
+	disarm()
+	if err != nil {
+		// The session state is unknown after a failure, don't reuse it
+		conn.client.Close()
+		return err
+	}
+
+	m.put(conn)
+	return nil
+}
+
+func (m *SMTPMailer) Close() error {
+	m.mu.Lock()
+	idle := m.idle
+	m.idle = nil
+	m.mu.Unlock()
+
+	for _, conn := range idle {
+		conn.quit(m.opts.Timeout)
+	}
+	return nil
+}
+
+// Ping checks the server answers, reusing a pooled connection when there is one.
+func (m *SMTPMailer) Ping(ctx context.Context) error {
+	conn, err := m.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	disarm := conn.arm(ctx, m.opts.Timeout)
+	err = conn.client.Noop()
+	disarm()
+	if err != nil {
+		conn.client.Close()
+		return err
+	}
+	m.put(conn)
+	return nil
+}
+
+func (m *SMTPMailer) get(ctx context.Context) (*pooledConn, error) {
+	for {
+		m.mu.Lock()
+		if len(m.idle) == 0 {
+			m.mu.Unlock()
+			break
+		}
+		conn := m.idle[len(m.idle)-1]
+		m.idle = m.idle[:len(m.idle)-1]
+		m.mu.Unlock()
+
+		if time.Since(conn.lastUsed) < smtpMaxIdle {
+			disarm := conn.arm(ctx, m.opts.Timeout)
+			err := conn.client.Reset()
+			disarm()
+			if err == nil {
+				return conn, nil
+			}
+		}
+		conn.client.Close()
+	}
+
+	return m.dial(ctx)
+}
+
+func (m *SMTPMailer) put(conn *pooledConn) {
+	conn.lastUsed = time.Now()
+
+	m.mu.Lock()
+	if len(m.idle) < m.opts.PoolSize {
+		m.idle = append(m.idle, conn)
+		m.mu.Unlock()
+		return
+	}
+	m.mu.Unlock()
+
+	conn.quit(m.opts.Timeout)
+}
+
+func (m *SMTPMailer) dial(ctx context.Context) (*pooledConn, error) {
+	addr := net.JoinHostPort(m.opts.Host, strconv.Itoa(m.opts.Port))
+	dialer := &net.Dialer{Timeout: m.opts.Timeout}
+	tlsConfig := &tls.Config{ServerName: m.opts.Host}
+
+	var conn net.Conn
+	var err error
+	if m.opts.Security == SecurityTLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The greeting, STARTTLS and AUTH are bounded like any other command
+	pooled := &pooledConn{conn: conn}
+	disarm := pooled.arm(ctx, m.opts.Timeout)
+	defer disarm()
+
+	client, err := smtp.NewClient(conn, m.opts.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	pooled.client = client
+
+	if m.opts.Security == SecuritySTARTTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			client.Close()
+			return nil, fmt.Errorf("smtp server %s does not support STARTTLS", addr)
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	if m.opts.Username != "" {
+		// Sending unauthenticated would at best be rejected later and at
+		// worst relay through a server we didn't mean to use
+		if ok, _ := client.Extension("AUTH"); !ok {
+			client.Close()
+			return nil, fmt.Errorf("smtp server %s does not support AUTH", addr)
+		}
+		auth := smtp.PlainAuth("", m.opts.Username, m.opts.Password, m.opts.Host)
+		if err := client.Auth(auth); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	return pooled, nil
+}
+
+func deliver(client *smtp.Client, from string, to []string, msg []byte) error {
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return &RecipientError{Recipient: rcpt, Err: err}
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// RecipientError reports that the server refused a recipient.
+type RecipientError struct {
+	Recipient string
+	Err       error
+}
+
+func (e *RecipientError) Error() string {
+	return fmt.Sprintf("recipient %s rejected: %v", e.Recipient, e.Err)
+}
+
+func (e *RecipientError) Unwrap() error {
+	return e.Err
+}
+
+// MailboxUnavailable reports whether the server rejected the mailbox itself,
+// i.e. the address should not be retried. That is an enhanced status of 5.1.x
+// or 5.2.1, or without one a 550, 551 or 553. Other 5xx replies, like
+// "550 5.7.1 relaying denied" or "530 authentication required", are about the
+// relay's own policy and say nothing about the recipient.
+func (e *RecipientError) MailboxUnavailable() bool {
+	var protoErr *textproto.Error
+	if !errors.As(e.Err, &protoErr) || protoErr.Code < 500 {
+		return false
+	}
+
+	if class, subject, detail, ok := enhancedStatus(protoErr.Msg); ok {
+		return class == "5" && (subject == "1" || subject == "2" && detail == "1")
+	}
+	switch protoErr.Code {
+	case 550, 551, 553:
+		return true
+	}
+	return false
+}
+
+// enhancedStatus splits the RFC 3463 status code ("5.1.1") at the start of an
+// SMTP reply text.
+func enhancedStatus(msg string) (class, subject, detail string, ok bool) {
+	code, _, _ := strings.Cut(msg, " ")
+	parts := strings.Split(code, ".")
+	if len(parts) != 3 {
+		return "", "", "", false
+	}
+	for _, part := range parts {
+		if _, err := strconv.Atoi(part); err != nil {
+			return "", "", "", false
+		}
+	}
+	return parts[0], parts[1], parts[2], true
+}
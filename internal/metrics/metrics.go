@@ -0,0 +1,87 @@
+// Package metrics defines the Prometheus metrics exported on /metrics.
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "gochat"
+
+var (
+	ConnectedClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "hub",
+		Name:      "connected_clients",
+		Help:      "Clients currently registered with the hub, over WebSocket, SSE or long polling.",
+	})
+
+	Rooms = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "hub",
+		Name:      "rooms",
+		Help:      "Rooms with at least one connected user.",
+	})
+
+	// Room IDs are unbounded, so the hub counters aren't labelled by room
+	Messages = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "hub",
+		Name:      "messages_total",
+		Help:      "Chat messages broadcast.",
+	})
+
+	BroadcastDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "hub",
+		Name:      "broadcast_duration_seconds",
+		Help:      "Time from the hub receiving a message to queueing it for every recipient, including persistence.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	})
+
+	DroppedSends = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "hub",
+		Name:      "dropped_sends_total",
+		Help:      "Frames not delivered because the client's send buffer was full.",
+	})
+
+	MongoDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "mongo",
+		Name:      "operation_duration_seconds",
+		Help:      "Latency of MongoDB operations, by operation.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"operation"})
+
+	JobsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "queue",
+		Name:      "jobs_processed_total",
+		Help:      "Background job attempts, by job type and outcome (success, retry, dead).",
+	}, []string{"type", "outcome"})
+
+	JobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "queue",
+		Name:      "job_duration_seconds",
+		Help:      "Time spent running background jobs, by job type.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"type"})
+
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "HTTP request latency, by method, route and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+)
+
+// ObserveMongo records the time since start for a MongoDB operation. Use it
+// with defer: defer metrics.ObserveMongo("find_messages", time.Now()).
+func ObserveMongo(operation string, start time.Time) {
+	MongoDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
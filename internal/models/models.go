@@ -1,18 +1,51 @@
 package models
 
 import (
+    "context"
     "time"
 
     "go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type Message struct {
-    ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-    RoomID    string             `bson:"room_id" json:"room_id"`
-    UserID    string             `bson:"user_id" json:"user_id"`
-    Username  string             `bson:"username" json:"username"`
-    Content   string             `bson:"content" json:"content"`
-    Timestamp time.Time          `bson:"timestamp" json:"timestamp"`
+    ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+    RoomID       string             `bson:"room_id" json:"room_id"`
+    UserID       string             `bson:"user_id" json:"user_id"`
+    Username     string             `bson:"username" json:"username"`
+    Content      string             `bson:"content" json:"content"`
+    Attachments  []Attachment       `bson:"attachments,omitempty" json:"attachments,omitempty"`
+    LinkPreviews []LinkPreview      `bson:"link_previews,omitempty" json:"link_previews,omitempty"`
+    Mentions     []string           `bson:"mentions,omitempty" json:"mentions,omitempty"`
+    Bot          bool               `bson:"bot,omitempty" json:"bot,omitempty"`
+    Timestamp    time.Time          `bson:"timestamp" json:"timestamp"`
+}
+
+type LinkPreview struct {
+    URL         string `bson:"url" json:"url"`
+    Title       string `bson:"title" json:"title"`
+    Description string `bson:"description,omitempty" json:"description,omitempty"`
+    Image       string `bson:"image,omitempty" json:"image,omitempty"`
+    SiteName    string `bson:"site_name,omitempty" json:"site_name,omitempty"`
+}
+
+type Attachment struct {
+    ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+    RoomID       string             `bson:"room_id" json:"room_id"`
+    UserID       string             `bson:"user_id" json:"user_id"`
+    Name         string             `bson:"name" json:"name"`
+    Size         int64              `bson:"size" json:"size"`
+    MimeType     string             `bson:"mime_type" json:"mime_type"`
+    Checksum     string             `bson:"checksum" json:"checksum"`
+    StorageKey   string             `bson:"storage_key" json:"-"`
+    ThumbnailKey string             `bson:"thumbnail_key,omitempty" json:"-"`
+    HasThumbnail bool               `bson:"has_thumbnail" json:"has_thumbnail"`
+    CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
+}
+
+type AttachmentLimits struct {
+    RoomID       string   `bson:"room_id" json:"room_id"`
+    MaxSize      int64    `bson:"max_size" json:"max_size"`
+    AllowedTypes []string `bson:"allowed_types" json:"allowed_types"`
 }
 
 type User struct {
@@ -20,6 +53,21 @@ type User struct {
     Username string `json:"username"`
     RoomID   string `json:"room_id"`
     Online   bool   `json:"online"`
+
+    // Connections counts the user's clients in the room; the user leaves
+    // the room when the last one goes
+    Connections int `json:"-"`
+}
+
+// UserProfile.Email is only set once the user has confirmed it; until then a
+// new address waits in PendingEmail and gets no notifications.
+type UserProfile struct {
+    ID           string    `bson:"_id" json:"id"`
+    Username     string    `bson:"username" json:"username"`
+    Email        string    `bson:"email,omitempty" json:"email,omitempty"`
+    PendingEmail string    `bson:"pending_email,omitempty" json:"pending_email,omitempty"`
+    CreatedAt    time.Time `bson:"created_at" json:"created_at"`
+    LastSeen     time.Time `bson:"last_seen,omitempty" json:"last_seen,omitempty"`
 }
 
 type Room struct {
@@ -30,16 +78,187 @@ type Room struct {
 }
 
 type WSMessage struct {
+    ID       string      `json:"id,omitempty"`
     Type     string      `json:"type"`
     RoomID   string      `json:"room_id,omitempty"`
     UserID   string      `json:"user_id,omitempty"`
     Username string      `json:"username,omitempty"`
     Content  string      `json:"content,omitempty"`
     Data     interface{} `json:"data,omitempty"`
+
+    // AttachmentIDs is sent by clients; Attachments is filled in by the hub
+    AttachmentIDs []string     `json:"attachment_ids,omitempty"`
+    Attachments   []Attachment `json:"attachments,omitempty"`
+
+    // Mentions holds the resolved user IDs mentioned in Content
+    Mentions []string `json:"mentions,omitempty"`
+
+    // Bot marks messages posted through the bot API; the server sets it
+    Bot bool `json:"bot,omitempty"`
+
+    // Context carries the trace of whatever produced the message through the
+    // hub. It is never serialized and may be nil.
+    Context context.Context `json:"-"`
+}
+
+const (
+    NotifyAll      = "all"
+    NotifyMentions = "mentions"
+    NotifyDigest   = "digest"
+    NotifyNone     = "none"
+
+    DigestHourly = "hourly"
+    DigestDaily  = "daily"
+)
+
+type NotificationPreferences struct {
+    UserID         string                    `bson:"_id" json:"user_id"`
+    Mode           string                    `bson:"mode" json:"mode"`
+    DigestInterval string                    `bson:"digest_interval,omitempty" json:"digest_interval,omitempty"`
+    TimeZone       string                    `bson:"time_zone,omitempty" json:"time_zone,omitempty"`
+    QuietHours     *QuietHours               `bson:"quiet_hours,omitempty" json:"quiet_hours,omitempty"`
+    Rooms          []RoomNotificationSetting `bson:"rooms,omitempty" json:"rooms,omitempty"`
+}
+
+// RoomNotificationSetting overrides the global mode for a single room.
+type RoomNotificationSetting struct {
+    RoomID         string `bson:"room_id" json:"room_id"`
+    Mode           string `bson:"mode" json:"mode"`
+    DigestInterval string `bson:"digest_interval,omitempty" json:"digest_interval,omitempty"`
+}
+
+// QuietHours are "HH:MM" wall-clock times in the user's time zone. A window
+// may wrap past midnight (e.g. 22:00-07:00).
+type QuietHours struct {
+    Start string `bson:"start" json:"start"`
+    End   string `bson:"end" json:"end"`
+}
+
+// MessageNotification is one missed message for an offline room member.
+// The queue batches these per user into a single email.
+type MessageNotification struct {
+    UserID    string    `json:"user_id"`
+    Email     string    `json:"email"`
+    RoomID    string    `json:"room_id"`
+    RoomName  string    `json:"room_name"`
+    Username  string    `json:"username"`
+    Content   string    `json:"content"`
+    Mentioned bool      `json:"mentioned,omitempty"`
+    Timestamp time.Time `json:"timestamp"`
 }
 
+// MessageFanout is queued once per chat message; the worker works out which
+// offline members to email about it. Mentioned holds the mentioned users who
+// were offline when the message was sent.
+type MessageFanout struct {
+    MessageID string    `json:"message_id"`
+    RoomID    string    `json:"room_id"`
+    RoomName  string    `json:"room_name"`
+    UserID    string    `json:"user_id"`
+    Username  string    `json:"username"`
+    Content   string    `json:"content"`
+    Mentioned []string  `json:"mentioned,omitempty"`
+    Timestamp time.Time `json:"timestamp"`
+}
+
+// EmailPayload is either a literal Subject/Body or a named Template rendered
+// with Data. Notification emails set UserID (and RoomID when they are about a
+// single room) so they can carry an unsubscribe link.
 type EmailPayload struct {
-    To      string `json:"to"`
-    Subject string `json:"subject"`
-    Body    string `json:"body"`
+    To       string                 `json:"to"`
+    UserID   string                 `json:"user_id,omitempty"`
+    RoomID   string                 `json:"room_id,omitempty"`
+    Subject  string                 `json:"subject,omitempty"`
+    Body     string                 `json:"body,omitempty"`
+    Template string                 `json:"template,omitempty"`
+    Data     map[string]interface{} `json:"data,omitempty"`
+}
+
+const (
+    EmailPending  = "pending"
+    EmailRetrying = "retrying"
+    EmailSent     = "sent"
+    EmailFailed   = "failed"
+)
+
+type EmailStatus struct {
+    ID            string    `json:"id"`
+    State         string    `json:"state"`
+    To            string    `json:"to"`
+    Subject       string    `json:"subject,omitempty"`
+    Template      string    `json:"template,omitempty"`
+    Retried       int       `json:"retried"`
+    MaxRetry      int       `json:"max_retry"`
+    LastError     string    `json:"last_error,omitempty"`
+    LastFailedAt  time.Time `json:"last_failed_at,omitempty"`
+    NextAttemptAt time.Time `json:"next_attempt_at,omitempty"`
+    CompletedAt   time.Time `json:"completed_at,omitempty"`
+}
+
+// AuditEvent is one entry of the append-only audit trail.
+type AuditEvent struct {
+    ID        primitive.ObjectID     `bson:"_id,omitempty" json:"id"`
+    Action    string                 `bson:"action" json:"action"`
+    Actor     string                 `bson:"actor" json:"actor"`
+    Target    string                 `bson:"target,omitempty" json:"target,omitempty"`
+    IP        string                 `bson:"ip,omitempty" json:"ip,omitempty"`
+    Details   map[string]interface{} `bson:"details,omitempty" json:"details,omitempty"`
+    Timestamp time.Time              `bson:"timestamp" json:"timestamp"`
+}
+
+// Bot is an integration account that posts through the REST API with a token
+// limited to Rooms ("*" for every room) and Scopes.
+type Bot struct {
+    ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+    Name       string             `bson:"name" json:"name"`
+    Rooms      []string           `bson:"rooms" json:"rooms"`
+    Scopes     []string           `bson:"scopes" json:"scopes"`
+    TokenHash  string             `bson:"token_hash" json:"-"`
+    CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+    LastUsedAt time.Time          `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
+}
+
+// Webhook subscribes URL to events in a room. Deliveries are signed with
+// Secret, which is only shown when the webhook is created.
+type Webhook struct {
+    ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+    RoomID    string             `bson:"room_id" json:"room_id"`
+    URL       string             `bson:"url" json:"url"`
+    Events    []string           `bson:"events" json:"events"`
+    Secret    string             `bson:"secret" json:"-"`
+    CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// WebhookEvent is the JSON body POSTed to webhooks.
+type WebhookEvent struct {
+    ID        string      `json:"id"`
+    Event     string      `json:"event"`
+    RoomID    string      `json:"room_id"`
+    Data      interface{} `json:"data,omitempty"`
+    Timestamp time.Time   `json:"timestamp"`
+}
+
+// WebhookDelivery records one attempt to deliver an event to a webhook.
+type WebhookDelivery struct {
+    ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+    WebhookID  primitive.ObjectID `bson:"webhook_id" json:"webhook_id"`
+    EventID    string             `bson:"event_id" json:"event_id"`
+    Event      string             `bson:"event" json:"event"`
+    Attempt    int                `bson:"attempt" json:"attempt"`
+    Success    bool               `bson:"success" json:"success"`
+    StatusCode int                `bson:"status_code,omitempty" json:"status_code,omitempty"`
+    Error      string             `bson:"error,omitempty" json:"error,omitempty"`
+    DurationMs int64              `bson:"duration_ms" json:"duration_ms"`
+    Timestamp  time.Time          `bson:"timestamp" json:"timestamp"`
+}
+
+// IncomingWebhook lets an external system post into RoomID through a secret
+// URL. Only a hash of the URL's token is stored.
+type IncomingWebhook struct {
+    ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+    RoomID     string             `bson:"room_id" json:"room_id"`
+    Name       string             `bson:"name" json:"name"`
+    TokenHash  string             `bson:"token_hash" json:"-"`
+    CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+    LastUsedAt time.Time          `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
 }
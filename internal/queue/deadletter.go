@@ -0,0 +1,310 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"gochat-server/internal/metrics"
+
+	"github.com/hibiken/asynq"
+	"github.com/sirupsen/logrus"
+)
+
+// Queues lists every queue the worker consumes, highest priority first.
+var Queues = []string{QueueCritical, QueueDefault, QueueLow}
+
+// ErrPermanent marks failures that will not go away on retry.
+var ErrPermanent = asynq.SkipRetry
+
+// Permanent wraps err so the task skips its remaining retries and goes
+// straight to the dead-letter archive. Use it for malformed payloads and
+// other failures a retry cannot fix.
+func Permanent(err error) error {
+	if err == nil || errors.Is(err, ErrPermanent) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrPermanent, err)
+}
+
+// DeadLetter describes a task that was archived after its final attempt.
+type DeadLetter struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Queue     string    `json:"queue"`
+	Reason    string    `json:"reason"`
+	Permanent bool      `json:"permanent"`
+	Retried   int       `json:"retried"`
+	FailedAt  time.Time `json:"failed_at"`
+}
+
+// ArchiveAlert is raised when a queue's dead-letter archive reaches the
+// configured threshold.
+type ArchiveAlert struct {
+	Queue     string    `json:"queue"`
+	Archived  int       `json:"archived"`
+	Threshold int       `json:"threshold"`
+	At        time.Time `json:"at"`
+}
+
+// deadLetters tracks the hooks fired when tasks are archived.
+type deadLetters struct {
+	mu          sync.Mutex
+	onArchived  []func(DeadLetter)
+	onAlert     []func(ArchiveAlert)
+	threshold   int
+	alertEvery  time.Duration
+	lastAlerted map[string]time.Time
+}
+
+// OnDeadLetter registers fn to run whenever a task is archived.
+func (m *Manager) OnDeadLetter(fn func(DeadLetter)) {
+	m.dead.mu.Lock()
+	defer m.dead.mu.Unlock()
+	m.dead.onArchived = append(m.dead.onArchived, fn)
+}
+
+// SetArchiveAlert raises an alert when a queue holds at least threshold
+// archived tasks, at most once per every for the same queue. A threshold of
+// zero turns alerting off.
+func (m *Manager) SetArchiveAlert(threshold int, every time.Duration) {
+	m.dead.mu.Lock()
+	defer m.dead.mu.Unlock()
+	m.dead.threshold = threshold
+	m.dead.alertEvery = every
+}
+
+// OnArchiveAlert registers fn to run with every archive alert. Alerts are
+// logged whether or not any hook is registered.
+func (m *Manager) OnArchiveAlert(fn func(ArchiveAlert)) {
+	m.dead.mu.Lock()
+	defer m.dead.mu.Unlock()
+	m.dead.onAlert = append(m.dead.onAlert, fn)
+}
+
+// WebhookAlert returns an alert hook that POSTs the alert as JSON to url.
+// Alerts are raised from the worker's error handler, so the request is sent
+// in the background and given up after 10 seconds.
+func WebhookAlert(url string) func(ArchiveAlert) {
+	client := &http.Client{}
+	return func(alert ArchiveAlert) {
+		body, _ := json.Marshal(alert)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+			if err != nil {
+				logrus.Error("Failed to send dead-letter alert: ", err)
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err := client.Do(req)
+			if err != nil {
+				logrus.Error("Failed to send dead-letter alert: ", err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				logrus.WithField("status", resp.StatusCode).Error("Dead-letter alert webhook rejected the alert")
+			}
+		}()
+	}
+}
+
+// handleError runs after every failed attempt and reports the ones that
+// ended in the archive.
+func (m *Manager) handleError(ctx context.Context, t *asynq.Task, err error) {
+	retried, _ := asynq.GetRetryCount(ctx)
+	maxRetry, _ := asynq.GetMaxRetry(ctx)
+	permanent := errors.Is(err, ErrPermanent)
+
+	fields := logrus.Fields{
+		"type":    t.Type(),
+		"retried": retried,
+		"error":   err.Error(),
+	}
+	if !permanent && retried < maxRetry {
+		metrics.JobsProcessed.WithLabelValues(t.Type(), "retry").Inc()
+		logrus.WithFields(fields).Warn("Task failed, will retry")
+		return
+	}
+	metrics.JobsProcessed.WithLabelValues(t.Type(), "dead").Inc()
+
+	id, _ := asynq.GetTaskID(ctx)
+	queue, _ := asynq.GetQueueName(ctx)
+	logrus.WithFields(fields).WithField("task_id", id).Error("Task moved to dead-letter archive")
+
+	letter := DeadLetter{
+		ID:        id,
+		Type:      t.Type(),
+		Queue:     queue,
+		Reason:    err.Error(),
+		Permanent: permanent,
+		Retried:   retried,
+		FailedAt:  time.Now(),
+	}
+
+	m.dead.mu.Lock()
+	hooks := append([]func(DeadLetter){}, m.dead.onArchived...)
+	m.dead.mu.Unlock()
+	for _, fn := range hooks {
+		fn(letter)
+	}
+
+	m.checkArchive(queue)
+}
+
+func (m *Manager) checkArchive(queue string) {
+	m.dead.mu.Lock()
+	threshold, every := m.dead.threshold, m.dead.alertEvery
+	hooks := append([]func(ArchiveAlert){}, m.dead.onAlert...)
+	last := m.dead.lastAlerted[queue]
+	m.dead.mu.Unlock()
+
+	if threshold <= 0 || time.Since(last) < every {
+		return
+	}
+
+	info, err := m.inspector.GetQueueInfo(queue)
+	if err != nil {
+		logrus.Error("Failed to inspect dead-letter archive: ", err)
+		return
+	}
+	if info.Archived < threshold {
+		return
+	}
+
+	alert := ArchiveAlert{Queue: queue, Archived: info.Archived, Threshold: threshold, At: time.Now()}
+
+	m.dead.mu.Lock()
+	m.dead.lastAlerted[queue] = alert.At
+	m.dead.mu.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"queue":     queue,
+		"archived":  info.Archived,
+		"threshold": threshold,
+	}).Warn("Dead-letter archive is growing")
+
+	for _, fn := range hooks {
+		fn(alert)
+	}
+}
+
+// ListDeadLetters returns the archived tasks of queue, newest failures first.
+func (m *Manager) ListDeadLetters(queue string, page, pageSize int) ([]*TaskStatus, error) {
+	infos, err := m.inspector.ListArchivedTasks(queue, asynq.Page(page), asynq.PageSize(pageSize))
+	if errors.Is(err, asynq.ErrQueueNotFound) {
+		return []*TaskStatus{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]*TaskStatus, 0, len(infos))
+	for _, info := range infos {
+		statuses = append(statuses, taskStatus(info))
+	}
+	return statuses, nil
+}
+
+// GetDeadLetter looks up an archived task by queue and ID.
+func (m *Manager) GetDeadLetter(queue, id string) (*TaskStatus, error) {
+	info, err := m.inspector.GetTaskInfo(queue, id)
+	if errors.Is(err, asynq.ErrTaskNotFound) || errors.Is(err, asynq.ErrQueueNotFound) {
+		return nil, ErrTaskNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.State != asynq.TaskStateArchived {
+		return nil, ErrTaskNotFound
+	}
+	return taskStatus(info), nil
+}
+
+// ReplayDeadLetter enqueues a new task with the payload of an archived one
+// and drops the archived copy, so the replay starts with a fresh set of
+// retries. It returns the ID of the new task.
+func (m *Manager) ReplayDeadLetter(queue, id string) (string, error) {
+	info, err := m.inspector.GetTaskInfo(queue, id)
+	if errors.Is(err, asynq.ErrTaskNotFound) || errors.Is(err, asynq.ErrQueueNotFound) {
+		return "", ErrTaskNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if info.State != asynq.TaskStateArchived {
+		return "", ErrTaskNotFound
+	}
+	return m.replay(info)
+}
+
+// ReplayDeadLetters replays every archived task of queue and returns how
+// many were requeued.
+func (m *Manager) ReplayDeadLetters(queue string) (int, error) {
+	var archived []*asynq.TaskInfo
+	for page := 1; ; page++ {
+		infos, err := m.inspector.ListArchivedTasks(queue, asynq.Page(page), asynq.PageSize(100))
+		if errors.Is(err, asynq.ErrQueueNotFound) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		archived = append(archived, infos...)
+		if len(infos) < 100 {
+			break
+		}
+	}
+
+	n := 0
+	for _, info := range archived {
+		if _, err := m.replay(info); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// replay re-enqueues an archived task. asynq's own RunTask would keep the
+// retry count, sending the task back to the archive after one more failure.
+func (m *Manager) replay(info *asynq.TaskInfo) (string, error) {
+	job, ok := m.jobs[info.Type]
+	if !ok {
+		return "", fmt.Errorf("queue: unknown job type %q", info.Type)
+	}
+
+	replayed, err := m.client.EnqueueContext(context.Background(), asynq.NewTask(info.Type, info.Payload), job.taskOptions()...)
+	if err != nil {
+		return "", err
+	}
+	if err := m.inspector.DeleteTask(info.Queue, info.ID); err != nil {
+		return "", err
+	}
+	return replayed.ID, nil
+}
+
+func (m *Manager) PurgeDeadLetter(queue, id string) error {
+	if _, err := m.GetDeadLetter(queue, id); err != nil {
+		return err
+	}
+	return m.inspector.DeleteTask(queue, id)
+}
+
+// PurgeDeadLetters deletes every archived task of queue.
+func (m *Manager) PurgeDeadLetters(queue string) (int, error) {
+	n, err := m.inspector.DeleteAllArchivedTasks(queue)
+	if errors.Is(err, asynq.ErrQueueNotFound) {
+		return 0, nil
+	}
+	return n, err
+}
@@ -0,0 +1,206 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+var ErrTaskNotFound = errors.New("task not found")
+
+// Task states as reported by TaskStatus.
+const (
+	StatePending     = "pending"
+	StateScheduled   = "scheduled"
+	StateActive      = "active"
+	StateRetry       = "retry"
+	StateArchived    = "archived"
+	StateCompleted   = "completed"
+	StateAggregating = "aggregating"
+)
+
+// TaskStatus is a snapshot of one task in the queue.
+type TaskStatus struct {
+	ID            string
+	Type          string
+	Queue         string
+	State         string
+	Payload       []byte
+	Retried       int
+	MaxRetry      int
+	LastError     string
+	LastFailedAt  time.Time
+	NextProcessAt time.Time
+	CompletedAt   time.Time
+}
+
+// Ping checks Redis is reachable. The inspector takes no context, so it
+// returns when ctx is done even if Redis hasn't answered; the call itself is
+// still bounded by the Redis client's read and write timeouts.
+func (m *Manager) Ping(ctx context.Context) error {
+	return withContext(ctx, func() error {
+		_, err := m.inspector.Queues()
+		return err
+	})
+}
+
+// Backlog returns the number of tasks waiting to run in each queue.
+func (m *Manager) Backlog() (map[string]int, error) {
+	backlog := make(map[string]int, len(Queues))
+	for _, name := range Queues {
+		info, err := m.inspector.GetQueueInfo(name)
+		if errors.Is(err, asynq.ErrQueueNotFound) {
+			backlog[name] = 0
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		backlog[name] = info.Pending
+	}
+	return backlog, nil
+}
+
+// CheckBacklog fails when any queue has more than threshold tasks waiting.
+// Like Ping, it gives up when ctx is done.
+func (m *Manager) CheckBacklog(ctx context.Context, threshold int) error {
+	return withContext(ctx, func() error {
+		backlog, err := m.Backlog()
+		if err != nil {
+			return err
+		}
+		for _, name := range Queues {
+			if backlog[name] > threshold {
+				return fmt.Errorf("queue %s has %d pending tasks (threshold %d)", name, backlog[name], threshold)
+			}
+		}
+		return nil
+	})
+}
+
+// withContext runs fn, returning early with ctx.Err() if ctx is done first.
+func withContext(ctx context.Context, fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// GetTask looks up a task of jobType by ID.
+func (m *Manager) GetTask(jobType, id string) (*TaskStatus, error) {
+	job, ok := m.jobs[jobType]
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+
+	info, err := m.inspector.GetTaskInfo(job.Queue, id)
+	if errors.Is(err, asynq.ErrTaskNotFound) || errors.Is(err, asynq.ErrQueueNotFound) {
+		return nil, ErrTaskNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.Type != jobType {
+		return nil, ErrTaskNotFound
+	}
+
+	return taskStatus(info), nil
+}
+
+// ListArchived returns tasks of jobType that exhausted their retries.
+func (m *Manager) ListArchived(jobType string, page, pageSize int) ([]*TaskStatus, error) {
+	job, ok := m.jobs[jobType]
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+
+	infos, err := m.inspector.ListArchivedTasks(job.Queue, asynq.Page(page), asynq.PageSize(pageSize))
+	if errors.Is(err, asynq.ErrQueueNotFound) {
+		return []*TaskStatus{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]*TaskStatus, 0, len(infos))
+	for _, info := range infos {
+		if info.Type == jobType {
+			statuses = append(statuses, taskStatus(info))
+		}
+	}
+	return statuses, nil
+}
+
+// ReplayTask re-enqueues an archived task of jobType with a fresh set of
+// retries, like ReplayDeadLetter, and returns the ID of the new task.
+func (m *Manager) ReplayTask(jobType, id string) (string, error) {
+	job, ok := m.jobs[jobType]
+	if !ok {
+		return "", ErrTaskNotFound
+	}
+
+	info, err := m.inspector.GetTaskInfo(job.Queue, id)
+	if errors.Is(err, asynq.ErrTaskNotFound) || errors.Is(err, asynq.ErrQueueNotFound) {
+		return "", ErrTaskNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if info.Type != jobType || info.State != asynq.TaskStateArchived {
+		return "", ErrTaskNotFound
+	}
+	return m.replay(info)
+}
+
+func (m *Manager) DeleteTask(jobType, id string) error {
+	status, err := m.GetTask(jobType, id)
+	if err != nil {
+		return err
+	}
+	return m.inspector.DeleteTask(status.Queue, id)
+}
+
+func taskStatus(info *asynq.TaskInfo) *TaskStatus {
+	_, payload := unwrap(info.Payload)
+	status := &TaskStatus{
+		ID:            info.ID,
+		Type:          info.Type,
+		Queue:         info.Queue,
+		Payload:       payload,
+		Retried:       info.Retried,
+		MaxRetry:      info.MaxRetry,
+		LastError:     info.LastErr,
+		LastFailedAt:  info.LastFailedAt,
+		NextProcessAt: info.NextProcessAt,
+		CompletedAt:   info.CompletedAt,
+	}
+
+	switch info.State {
+	case asynq.TaskStateActive:
+		status.State = StateActive
+	case asynq.TaskStateScheduled:
+		status.State = StateScheduled
+	case asynq.TaskStateRetry:
+		status.State = StateRetry
+	case asynq.TaskStateArchived:
+		status.State = StateArchived
+	case asynq.TaskStateCompleted:
+		status.State = StateCompleted
+	case asynq.TaskStateAggregating:
+		status.State = StateAggregating
+	default:
+		status.State = StatePending
+	}
+
+	return status
+}
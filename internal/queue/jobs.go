@@ -0,0 +1,221 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/sirupsen/logrus"
+)
+
+// HandlerFunc processes the raw JSON payload of a task.
+type HandlerFunc func(ctx context.Context, payload []byte) error
+
+// Job describes a task type and how its tasks are queued and retried.
+type Job struct {
+	Type     string
+	Queue    string        // defaults to QueueDefault
+	MaxRetry int           // retries after the first attempt
+	Timeout  time.Duration // defaults to 30s
+
+	// Retention keeps completed tasks around for inspection.
+	Retention time.Duration
+
+	// Unique drops duplicate tasks (same type and payload) enqueued within
+	// this window.
+	Unique time.Duration
+
+	// RetryDelay overrides asynq's default backoff.
+	RetryDelay func(retried int, err error) time.Duration
+
+	// Handler may be nil for jobs whose tasks are only ever aggregated.
+	Handler HandlerFunc
+
+	// Aggregate folds a batch of tasks enqueued with InGroup into a single
+	// task of another registered job type.
+	Aggregate func(group string, payloads [][]byte) (jobType string, payload interface{})
+}
+
+// Handle adapts a typed handler to a HandlerFunc that decodes the JSON payload.
+// A payload that doesn't decode is a permanent failure.
+func Handle[T any](fn func(ctx context.Context, payload *T) error) HandlerFunc {
+	return func(ctx context.Context, data []byte) error {
+		var payload T
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return Permanent(fmt.Errorf("malformed payload: %w", err))
+		}
+		return fn(ctx, &payload)
+	}
+}
+
+// Retried returns how many times the task being handled has been retried
+// before this attempt. It is only meaningful inside a handler.
+func Retried(ctx context.Context) int {
+	retried, _ := asynq.GetRetryCount(ctx)
+	return retried
+}
+
+// Register adds a job type. Registering the same type twice is a programming
+// error and panics.
+func (m *Manager) Register(job Job) {
+	if _, exists := m.jobs[job.Type]; exists {
+		panic(fmt.Sprintf("queue: job %q registered twice", job.Type))
+	}
+	if job.Queue == "" {
+		job.Queue = QueueDefault
+	}
+	if job.Timeout == 0 {
+		job.Timeout = 30 * time.Second
+	}
+	m.jobs[job.Type] = &job
+}
+
+type enqueueOptions struct {
+	processAt time.Time
+	uniqueKey string
+	group     string
+}
+
+type EnqueueOption func(*enqueueOptions)
+
+// Delay runs the task no earlier than d from now.
+func Delay(d time.Duration) EnqueueOption {
+	return func(o *enqueueOptions) { o.processAt = time.Now().Add(d) }
+}
+
+// At runs the task no earlier than t. A zero t is ignored.
+func At(t time.Time) EnqueueOption {
+	return func(o *enqueueOptions) { o.processAt = t }
+}
+
+// UniqueKey makes the task ID deterministic, so enqueueing the same key again
+// while the task is still known to the queue is a no-op.
+func UniqueKey(key string) EnqueueOption {
+	return func(o *enqueueOptions) { o.uniqueKey = key }
+}
+
+// InGroup batches the task with others of the same group; the job's
+// Aggregate function turns the batch into one task.
+func InGroup(name string) EnqueueOption {
+	return func(o *enqueueOptions) { o.group = name }
+}
+
+// Enqueue queues a task for a registered job and returns its ID. The trace
+// in ctx is carried along and continued by the worker.
+func (m *Manager) Enqueue(ctx context.Context, jobType string, payload interface{}, opts ...EnqueueOption) (string, error) {
+	task, taskOpts, err := m.newTask(ctx, jobType, payload, opts...)
+	if err != nil {
+		return "", err
+	}
+	info, err := m.client.EnqueueContext(ctx, task, taskOpts...)
+	if errors.Is(err, asynq.ErrTaskIDConflict) {
+		return jobType + ":" + enqueueOptionsFrom(opts).uniqueKey, nil
+	}
+	if errors.Is(err, asynq.ErrDuplicateTask) {
+		// Dropped by the job's Unique window; the earlier task will do the work
+		return "", nil
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"type":  jobType,
+			"error": err.Error(),
+		}).Error("Failed to enqueue task")
+		return "", err
+	}
+
+	return info.ID, nil
+}
+
+// Schedule enqueues the job periodically according to cronspec.
+func (m *Manager) Schedule(cronspec, jobType string, payload interface{}) error {
+	task, taskOpts, err := m.newTask(context.Background(), jobType, payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.scheduler.Register(cronspec, task, taskOpts...)
+	return err
+}
+
+func (m *Manager) newTask(ctx context.Context, jobType string, payload interface{}, opts ...EnqueueOption) (*asynq.Task, []asynq.Option, error) {
+	job, ok := m.jobs[jobType]
+	if !ok {
+		return nil, nil, fmt.Errorf("queue: unknown job type %q", jobType)
+	}
+
+	data, err := wrap(ctx, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	o := enqueueOptionsFrom(opts)
+
+	taskOpts := job.taskOptions()
+	if job.Unique > 0 {
+		taskOpts = append(taskOpts, asynq.Unique(job.Unique))
+	}
+	if !o.processAt.IsZero() {
+		taskOpts = append(taskOpts, asynq.ProcessAt(o.processAt))
+	}
+	if o.uniqueKey != "" {
+		taskOpts = append(taskOpts, asynq.TaskID(jobType+":"+o.uniqueKey))
+	}
+	if o.group != "" {
+		taskOpts = append(taskOpts, asynq.Group(o.group))
+	}
+
+	return asynq.NewTask(jobType, data), taskOpts, nil
+}
+
+// taskOptions returns the asynq options every task of the job gets.
+func (job *Job) taskOptions() []asynq.Option {
+	opts := []asynq.Option{
+		asynq.Queue(job.Queue),
+		asynq.MaxRetry(job.MaxRetry),
+		asynq.Timeout(job.Timeout),
+	}
+	if job.Retention > 0 {
+		opts = append(opts, asynq.Retention(job.Retention))
+	}
+	return opts
+}
+
+func enqueueOptionsFrom(opts []EnqueueOption) *enqueueOptions {
+	o := &enqueueOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// Aggregate hands a batch to the Aggregate function of the batched job type.
+// The Manager is the asynq server's GroupAggregator.
+func (m *Manager) Aggregate(group string, tasks []*asynq.Task) *asynq.Task {
+	job := m.jobs[tasks[0].Type()]
+	if job == nil || job.Aggregate == nil {
+		logrus.WithField("type", tasks[0].Type()).Error("No aggregator registered for grouped task")
+		return asynq.NewTask(tasks[0].Type(), tasks[0].Payload())
+	}
+
+	payloads := make([][]byte, len(tasks))
+	carriers := make([]map[string]string, len(tasks))
+	for i, t := range tasks {
+		carriers[i], payloads[i] = unwrap(t.Payload())
+	}
+
+	jobType, payload := job.Aggregate(group, payloads)
+
+	ctx, span := aggregateContext(jobType, carriers)
+	task, taskOpts, err := m.newTask(ctx, jobType, payload)
+	endSpan(span, err)
+	if err != nil {
+		logrus.WithField("type", jobType).Error("Failed to build aggregated task: ", err)
+		return asynq.NewTask(jobType, nil, asynq.MaxRetry(0))
+	}
+
+	// asynq enqueues the result into the group's queue, overriding the job's
+	return asynq.NewTask(task.Type(), task.Payload(), taskOpts...)
+}
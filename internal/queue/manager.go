@@ -2,96 +2,143 @@ package queue
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
 	"time"
 
-	"gochat-server/internal/models"
-	"gochat-server/internal/services"
+	"gochat-server/internal/metrics"
 
 	"github.com/hibiken/asynq"
-	"github.com/sirupsen/logrus"
 )
 
+// Queue names, highest priority first.
 const (
-	TypeEmailNotification = "email:notification"
+	QueueCritical = "critical"
+	QueueDefault  = "default"
+	QueueLow      = "low"
 )
 
+// Enqueuer puts tasks on the queue. NewManager uses an asynq.Client;
+// queuetest has one that runs each task straight away.
+type Enqueuer interface {
+	EnqueueContext(ctx context.Context, task *asynq.Task, opts ...asynq.Option) (*asynq.TaskInfo, error)
+	Close() error
+}
+
+// Manager runs background jobs on asynq. It knows nothing about the jobs
+// themselves: features register them with Register and enqueue them with
+// Enqueue, and the worker dispatches each task to its registered handler.
 type Manager struct {
-	client       *asynq.Client
-	server       *asynq.Server
-	emailService *services.EmailService
+	client    Enqueuer
+	server    *asynq.Server
+	scheduler *asynq.Scheduler
+	inspector *asynq.Inspector
+	jobs      map[string]*Job
+	dead      deadLetters
 }
 
-func NewManager(redisAddr string, emailService *services.EmailService) *Manager {
-	client := asynq.NewClient(asynq.RedisClientOpt{Addr: redisAddr})
+func NewManager(redisAddr string, concurrency int) *Manager {
+	redis := asynq.RedisClientOpt{Addr: redisAddr}
 
-	server := asynq.NewServer(
-		asynq.RedisClientOpt{Addr: redisAddr},
+	m := &Manager{
+		client:    asynq.NewClient(redis),
+		scheduler: asynq.NewScheduler(redis, nil),
+		inspector: asynq.NewInspector(redis),
+		jobs:      make(map[string]*Job),
+		dead:      deadLetters{lastAlerted: make(map[string]time.Time)},
+	}
+
+	m.server = asynq.NewServer(
+		redis,
 		asynq.Config{
-			Concurrency: 10,
+			Concurrency: concurrency,
 			Queues: map[string]int{
-				"critical": 6,
-				"default":  3,
-				"low":      1,
+				QueueCritical: 6,
+				QueueDefault:  3,
+				QueueLow:      1,
 			},
-			RetryDelayFunc: asynq.DefaultRetryDelayFunc,
+			RetryDelayFunc:   m.retryDelay,
+			ErrorHandler:     asynq.ErrorHandlerFunc(m.handleError),
+			GroupGracePeriod: 2 * time.Minute,
+			GroupMaxDelay:    10 * time.Minute,
+			GroupMaxSize:     50,
+			GroupAggregator:  m,
 		},
 	)
 
-	return &Manager{
-		client:       client,
-		server:       server,
-		emailService: emailService,
-	}
+	return m
 }
 
-func (m *Manager) QueueEmail(payload *models.EmailPayload) error {
-	data, err := json.Marshal(payload)
-	if err != nil {
-		return err
+// NewEnqueueOnlyManager returns a Manager without Redis that hands tasks to
+// client. Only Register and Enqueue may be used.
+func NewEnqueueOnlyManager(client Enqueuer) *Manager {
+	return &Manager{
+		client: client,
+		jobs:   make(map[string]*Job),
+		dead:   deadLetters{lastAlerted: make(map[string]time.Time)},
 	}
+}
 
-	task := asynq.NewTask(TypeEmailNotification, data)
-
-	_, err = m.client.Enqueue(
-		task,
-		asynq.MaxRetry(3),
-		asynq.Queue("default"),
-		asynq.Timeout(30*time.Second),
-	)
-
-	if err != nil {
-		logrus.Error("Failed to enqueue email task: ", err)
+// StartWorker starts processing tasks for every registered job and runs the
+// periodic schedule. All jobs must be registered before it is called.
+func (m *Manager) StartWorker() error {
+	if err := m.scheduler.Start(); err != nil {
 		return err
 	}
 
-	logrus.WithFields(logrus.Fields{
-		"to":      payload.To,
-		"subject": payload.Subject,
-	}).Info("Email queued successfully")
-
-	return nil
+	return m.server.Start(m)
 }
 
-func (m *Manager) StartWorker() {
-	mux := asynq.NewServeMux()
-	mux.HandleFunc(TypeEmailNotification, m.handleEmailNotification)
-
-	if err := m.server.Run(mux); err != nil {
-		logrus.Fatal("Failed to start worker: ", err)
+// ProcessTask dispatches a task to its job's handler; the Manager is the
+// asynq server's Handler.
+func (m *Manager) ProcessTask(ctx context.Context, t *asynq.Task) error {
+	job := m.jobs[t.Type()]
+	if job == nil || job.Handler == nil {
+		return fmt.Errorf("queue: no handler for job type %q", t.Type())
 	}
+	return m.handler(job)(ctx, t)
 }
 
-func (m *Manager) handleEmailNotification(ctx context.Context, t *asynq.Task) error {
-	var payload models.EmailPayload
-	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+func (m *Manager) handler(job *Job) asynq.HandlerFunc {
+	return func(ctx context.Context, t *asynq.Task) error {
+		carrier, payload := unwrap(t.Payload())
+		ctx, span := startJobSpan(ctx, job.Type, carrier)
+
+		start := time.Now()
+		err := job.Handler(ctx, payload)
+		endSpan(span, err)
+		metrics.JobDuration.WithLabelValues(job.Type).Observe(time.Since(start).Seconds())
+		if err == nil {
+			metrics.JobsProcessed.WithLabelValues(job.Type, "success").Inc()
+		}
 		return err
 	}
+}
 
-	return (*m.emailService).SendEmail(&payload)
+func (m *Manager) retryDelay(n int, err error, t *asynq.Task) time.Duration {
+	if job := m.jobs[t.Type()]; job != nil && job.RetryDelay != nil {
+		return job.RetryDelay(n, err)
+	}
+	return asynq.DefaultRetryDelayFunc(n, err, t)
 }
 
-func (m *Manager) Shutdown() {
-	m.client.Close()
-	m.server.Shutdown()
+// Shutdown stops the scheduler, waits for in-flight tasks to finish and
+// closes the Redis connections. Tasks still running when ctx expires are
+// handed back to Redis by asynq and retried after a restart.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.scheduler.Shutdown()
+
+	stopped := make(chan struct{})
+	go func() {
+		m.server.Shutdown()
+		m.inspector.Close()
+		m.client.Close()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
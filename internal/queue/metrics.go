@@ -0,0 +1,49 @@
+package queue
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var queueTasksDesc = prometheus.NewDesc(
+	"gochat_queue_tasks",
+	"Tasks in each queue, by state.",
+	[]string{"queue", "state"}, nil,
+)
+
+// Collector reports queue depth per state, read from Redis at scrape time.
+func (m *Manager) Collector() prometheus.Collector {
+	return queueCollector{m}
+}
+
+type queueCollector struct {
+	m *Manager
+}
+
+func (c queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueTasksDesc
+}
+
+func (c queueCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, name := range Queues {
+		info, err := c.m.inspector.GetQueueInfo(name)
+		if err != nil {
+			// A queue that has never seen a task doesn't exist yet
+			logrus.WithField("queue", name).Debug("Skipping queue metrics: ", err)
+			continue
+		}
+
+		states := map[string]int{
+			StatePending:     info.Pending,
+			StateActive:      info.Active,
+			StateScheduled:   info.Scheduled,
+			StateRetry:       info.Retry,
+			StateArchived:    info.Archived,
+			StateCompleted:   info.Completed,
+			StateAggregating: info.Aggregating,
+		}
+		for state, n := range states {
+			ch <- prometheus.MustNewConstMetric(queueTasksDesc, prometheus.GaugeValue, float64(n), name, state)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+// Package queuetest provides a queue.Manager for tests that runs jobs
+// without Redis.
+package queuetest
+
+import (
+	"context"
+
+	"gochat-server/internal/queue"
+
+	"github.com/hibiken/asynq"
+)
+
+// NewManager returns a Manager that runs each task on the enqueuing goroutine
+// as soon as it is enqueued, through the same handler wrapper as the worker.
+// Tasks run once, without retries, delays or uniqueness, and as with Redis a
+// handler's error isn't returned by Enqueue. A grouped task is aggregated on
+// its own and the aggregated task is run instead. Only Register and Enqueue
+// may be used.
+func NewManager() *queue.Manager {
+	c := &inlineClient{}
+	c.m = queue.NewEnqueueOnlyManager(c)
+	return c.m
+}
+
+type inlineClient struct {
+	m *queue.Manager
+}
+
+func (c *inlineClient) EnqueueContext(_ context.Context, task *asynq.Task, opts ...asynq.Option) (*asynq.TaskInfo, error) {
+	for _, opt := range opts {
+		if opt.Type() == asynq.GroupOpt {
+			task = c.m.Aggregate(opt.Value().(string), []*asynq.Task{task})
+		}
+	}
+
+	// The handler gets a fresh context, as it would on the worker
+	c.m.ProcessTask(context.Background(), task)
+	return &asynq.TaskInfo{Type: task.Type(), Payload: task.Payload()}, nil
+}
+
+func (c *inlineClient) Close() error {
+	return nil
+}
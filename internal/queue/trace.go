@@ -0,0 +1,77 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+
+	"gochat-server/internal/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// envelope is what is actually stored in Redis: the job's payload plus the
+// trace context of whoever enqueued it, so the worker's span continues the
+// same trace.
+type envelope struct {
+	Trace   map[string]string `json:"trace,omitempty"`
+	Payload json.RawMessage   `json:"payload"`
+}
+
+func wrap(ctx context.Context, payload interface{}) ([]byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&envelope{Trace: tracing.Inject(ctx), Payload: data})
+}
+
+// unwrap splits a stored task payload. Tasks enqueued before payloads were
+// wrapped are returned as they are.
+func unwrap(data []byte) (map[string]string, []byte) {
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil || env.Payload == nil {
+		return nil, data
+	}
+	return env.Trace, env.Payload
+}
+
+// startJobSpan starts the consumer span for a task, continuing the trace it
+// was enqueued from.
+func startJobSpan(ctx context.Context, jobType string, carrier map[string]string) (context.Context, trace.Span) {
+	ctx = tracing.Extract(ctx, carrier)
+	return tracing.Tracer().Start(ctx, "job "+jobType,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "asynq"),
+			attribute.String("job.type", jobType),
+		),
+	)
+}
+
+// endSpan records err on span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// aggregateContext starts a new trace for an aggregated task, linked to the
+// traces of every task in the batch.
+func aggregateContext(jobType string, carriers []map[string]string) (context.Context, trace.Span) {
+	links := make([]trace.Link, 0, len(carriers))
+	for _, carrier := range carriers {
+		if sc := trace.SpanContextFromContext(tracing.Extract(context.Background(), carrier)); sc.IsValid() {
+			links = append(links, trace.Link{SpanContext: sc})
+		}
+	}
+
+	return tracing.Tracer().Start(context.Background(), "aggregate "+jobType,
+		trace.WithNewRoot(),
+		trace.WithLinks(links...),
+		trace.WithAttributes(attribute.Int("job.batch_size", len(carriers))),
+	)
+}
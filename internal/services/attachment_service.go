@@ -0,0 +1,319 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"gochat-server/internal/models"
+	"gochat-server/internal/queue"
+	"gochat-server/internal/storage"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/image/draw"
+)
+
+const (
+	TypeAttachmentThumbnail = "attachment:thumbnail"
+
+	thumbnailMaxDimension = 256
+
+	// Decoding allocates about 4 bytes per pixel up front, so images larger
+	// than this (whatever their file size) get no thumbnail
+	thumbnailMaxPixels = 40_000_000
+)
+
+var (
+	ErrAttachmentNotFound       = errors.New("attachment not found")
+	ErrAttachmentTooLarge       = errors.New("attachment exceeds the room's size limit")
+	ErrAttachmentTypeNotAllowed = errors.New("attachment type is not allowed in this room")
+	ErrAttachmentLimitTooHigh   = errors.New("max_size exceeds the server's upload limit")
+)
+
+type AttachmentService struct {
+	collection *mongo.Collection
+	limits     *mongo.Collection
+	store      storage.BlobStore
+	defaults   models.AttachmentLimits
+	queue      *queue.Manager
+}
+
+type thumbnailPayload struct {
+	AttachmentID string `json:"attachment_id"`
+}
+
+func NewAttachmentService(db *mongo.Database, store storage.BlobStore, defaults models.AttachmentLimits) *AttachmentService {
+	return &AttachmentService{
+		collection: db.Collection("attachments"),
+		limits:     db.Collection("attachment_limits"),
+		store:      store,
+		defaults:   defaults,
+	}
+}
+
+// RegisterJobs registers thumbnail generation, which Upload then queues for images.
+func (s *AttachmentService) RegisterJobs(q *queue.Manager) {
+	s.queue = q
+	q.Register(queue.Job{
+		Type:     TypeAttachmentThumbnail,
+		Queue:    queue.QueueLow,
+		MaxRetry: 3,
+		Timeout:  time.Minute,
+		Handler: queue.Handle(func(ctx context.Context, p *thumbnailPayload) error {
+			err := s.GenerateThumbnail(ctx, p.AttachmentID)
+			if errors.Is(err, ErrAttachmentNotFound) || errors.Is(err, image.ErrFormat) {
+				return queue.Permanent(err)
+			}
+			return err
+		}),
+	})
+}
+
+// GetRoomLimits returns the room's upload limits, falling back to the server defaults.
+func (s *AttachmentService) GetRoomLimits(ctx context.Context, roomID string) (*models.AttachmentLimits, error) {
+	limits := &models.AttachmentLimits{}
+	err := s.limits.FindOne(ctx, bson.M{"room_id": roomID}).Decode(limits)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		defaults := s.defaults
+		defaults.RoomID = roomID
+		return &defaults, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return limits, nil
+}
+
+// SetRoomLimits overrides the room's limits. The server default size is the
+// ceiling: uploads larger than it are cut off before they reach the service.
+func (s *AttachmentService) SetRoomLimits(ctx context.Context, limits *models.AttachmentLimits) error {
+	if limits.MaxSize > s.defaults.MaxSize {
+		return ErrAttachmentLimitTooHigh
+	}
+
+	_, err := s.limits.ReplaceOne(ctx,
+		bson.M{"room_id": limits.RoomID},
+		limits,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+// Upload streams r into the blob store, enforcing the room's limits, and records its metadata.
+func (s *AttachmentService) Upload(ctx context.Context, roomID, userID, name string, r io.Reader) (*models.Attachment, error) {
+	limits, err := s.GetRoomLimits(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sniff the type from content rather than trusting the client's header
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	head = head[:n]
+
+	mimeType := http.DetectContentType(head)
+	if i := strings.Index(mimeType, ";"); i >= 0 {
+		mimeType = mimeType[:i]
+	}
+	if !typeAllowed(mimeType, limits.AllowedTypes) {
+		return nil, ErrAttachmentTypeNotAllowed
+	}
+
+	attachment := &models.Attachment{
+		ID:        primitive.NewObjectID(),
+		RoomID:    roomID,
+		UserID:    userID,
+		Name:      path.Base(name),
+		MimeType:  mimeType,
+		CreatedAt: time.Now(),
+	}
+	attachment.StorageKey = "attachments/" + roomID + "/" + attachment.ID.Hex()
+
+	hash := sha256.New()
+	counter := &countingReader{r: io.LimitReader(io.MultiReader(bytes.NewReader(head), r), limits.MaxSize+1)}
+	if err := s.store.Put(ctx, attachment.StorageKey, io.TeeReader(counter, hash), -1, mimeType); err != nil {
+		return nil, err
+	}
+
+	if counter.n > limits.MaxSize {
+		s.store.Delete(ctx, attachment.StorageKey)
+		return nil, ErrAttachmentTooLarge
+	}
+
+	attachment.Size = counter.n
+	attachment.Checksum = hex.EncodeToString(hash.Sum(nil))
+
+	if _, err := s.collection.InsertOne(ctx, attachment); err != nil {
+		s.store.Delete(ctx, attachment.StorageKey)
+		return nil, err
+	}
+
+	if s.queue != nil && strings.HasPrefix(mimeType, "image/") {
+		// The thumbnail is a nicety; the upload itself has succeeded
+		if _, err := s.queue.Enqueue(ctx, TypeAttachmentThumbnail, &thumbnailPayload{AttachmentID: attachment.ID.Hex()}); err != nil {
+			logrus.Error("Failed to queue thumbnail: ", err)
+		}
+	}
+
+	return attachment, nil
+}
+
+func (s *AttachmentService) GetAttachment(ctx context.Context, id string) (*models.Attachment, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrAttachmentNotFound
+	}
+
+	attachment := &models.Attachment{}
+	err = s.collection.FindOne(ctx, bson.M{"_id": objectID}).Decode(attachment)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrAttachmentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return attachment, nil
+}
+
+// GetRoomAttachments resolves client-supplied IDs, dropping any that belong to another room or user.
+func (s *AttachmentService) GetRoomAttachments(ctx context.Context, roomID, userID string, ids []string) ([]models.Attachment, error) {
+	objectIDs := make([]primitive.ObjectID, 0, len(ids))
+	for _, id := range ids {
+		if objectID, err := primitive.ObjectIDFromHex(id); err == nil {
+			objectIDs = append(objectIDs, objectID)
+		}
+	}
+	if len(objectIDs) == 0 {
+		return nil, nil
+	}
+
+	cursor, err := s.collection.Find(ctx, bson.M{
+		"_id":     bson.M{"$in": objectIDs},
+		"room_id": roomID,
+		"user_id": userID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var attachments []models.Attachment
+	if err := cursor.All(ctx, &attachments); err != nil {
+		return nil, err
+	}
+	return attachments, nil
+}
+
+func (s *AttachmentService) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.store.Get(ctx, key)
+}
+
+// GenerateThumbnail renders a JPEG preview for image attachments. Non-images are ignored.
+func (s *AttachmentService) GenerateThumbnail(ctx context.Context, id string) error {
+	attachment, err := s.GetAttachment(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(attachment.MimeType, "image/") || attachment.HasThumbnail {
+		return nil
+	}
+
+	blob, err := s.store.Get(ctx, attachment.StorageKey)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	// Check the declared size before decoding: a tiny file can claim to be
+	// 60000x60000 pixels
+	var header bytes.Buffer
+	config, _, err := image.DecodeConfig(io.TeeReader(blob, &header))
+	if err != nil {
+		return err
+	}
+	if int64(config.Width)*int64(config.Height) > thumbnailMaxPixels {
+		logrus.WithFields(logrus.Fields{
+			"attachment_id": id,
+			"width":         config.Width,
+			"height":        config.Height,
+		}).Warn("Image too large to thumbnail")
+		return nil
+	}
+
+	src, _, err := image.Decode(io.MultiReader(&header, blob))
+	if err != nil {
+		return err
+	}
+
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > thumbnailMaxDimension || height > thumbnailMaxDimension {
+		if width >= height {
+			height = height * thumbnailMaxDimension / width
+			width = thumbnailMaxDimension
+		} else {
+			width = width * thumbnailMaxDimension / height
+			height = thumbnailMaxDimension
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, max(width, 1), max(height, 1)))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80}); err != nil {
+		return err
+	}
+
+	thumbnailKey := attachment.StorageKey + "_thumb"
+	if err := s.store.Put(ctx, thumbnailKey, &buf, int64(buf.Len()), "image/jpeg"); err != nil {
+		return err
+	}
+
+	_, err = s.collection.UpdateByID(ctx, attachment.ID, bson.M{"$set": bson.M{
+		"thumbnail_key": thumbnailKey,
+		"has_thumbnail": true,
+	}})
+	return err
+}
+
+func typeAllowed(mimeType string, allowed []string) bool {
+	for _, pattern := range allowed {
+		if pattern == "*/*" || pattern == mimeType {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,168 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"gochat-server/internal/metrics"
+	"gochat-server/internal/models"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Audit actions
+const (
+	AuditRoomJoin         = "room.join"
+	AuditAdminAuthFailed  = "admin.auth_failed"
+	AuditConfigReload     = "config.reload"
+	AuditAnnouncement     = "admin.announcement"
+	AuditConnectionKick   = "admin.connection.kick"
+	AuditRoomClose        = "admin.room.close"
+	AuditRoomReopen       = "admin.room.reopen"
+	AuditEmailRetry       = "admin.email.retry"
+	AuditEmailDelete      = "admin.email.delete"
+	AuditDeadLetterReplay = "admin.dead_letter.replay"
+	AuditDeadLetterPurge  = "admin.dead_letter.purge"
+	AuditBotCreate        = "admin.bot.create"
+	AuditBotTokenRotate   = "admin.bot.token_rotate"
+	AuditBotDelete        = "admin.bot.delete"
+	AuditWebhookCreate    = "admin.webhook.create"
+	AuditWebhookDelete    = "admin.webhook.delete"
+	AuditWebhookTest      = "admin.webhook.test"
+	AuditAttachmentLimits = "admin.attachment_limits"
+
+	AuditIncomingWebhookCreate = "admin.incoming_webhook.create"
+	AuditIncomingWebhookDelete = "admin.incoming_webhook.delete"
+)
+
+// Actors for events not caused by a known user
+const (
+	AuditActorAdmin     = "admin"
+	AuditActorSystem    = "system"
+	AuditActorAnonymous = "anonymous"
+)
+
+// AuditFilter narrows an audit query; zero fields match everything.
+type AuditFilter struct {
+	Action string
+	Actor  string
+	Target string
+	Since  time.Time
+	Until  time.Time
+	Limit  int64
+}
+
+// AuditService is the append-only audit trail of security-relevant and
+// moderation events. There is deliberately no way to change or delete events.
+type AuditService struct {
+	collection *mongo.Collection
+}
+
+func NewAuditService(db *mongo.Database) *AuditService {
+	return &AuditService{
+		collection: db.Collection("audit_log"),
+	}
+}
+
+// Record appends event, stamping it with the current time.
+func (s *AuditService) Record(ctx context.Context, event *models.AuditEvent) error {
+	defer metrics.ObserveMongo("record_audit_event", time.Now())
+
+	event.Timestamp = time.Now()
+	_, err := s.collection.InsertOne(ctx, event)
+	return err
+}
+
+// Log records event in the background of whatever caused it: a failed write
+// is logged rather than returned, and ctx's cancellation is ignored.
+func (s *AuditService) Log(ctx context.Context, event *models.AuditEvent) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+
+	if err := s.Record(ctx, event); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"action": event.Action,
+			"actor":  event.Actor,
+			"target": event.Target,
+		}).Error("Failed to record audit event: ", err)
+	}
+}
+
+// Find returns the events matching filter, newest first.
+func (s *AuditService) Find(ctx context.Context, filter AuditFilter) ([]*models.AuditEvent, error) {
+	defer metrics.ObserveMongo("find_audit_events", time.Now())
+
+	opts := options.Find().SetSort(bson.M{"timestamp": -1})
+	if filter.Limit > 0 {
+		opts.SetLimit(filter.Limit)
+	}
+
+	cursor, err := s.collection.Find(ctx, filter.query(), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	events := []*models.AuditEvent{}
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// Export writes the events matching filter to w as JSON Lines, oldest first,
+// streaming them rather than loading them all.
+func (s *AuditService) Export(ctx context.Context, filter AuditFilter, w io.Writer) error {
+	opts := options.Find().SetSort(bson.M{"timestamp": 1})
+	if filter.Limit > 0 {
+		opts.SetLimit(filter.Limit)
+	}
+
+	cursor, err := s.collection.Find(ctx, filter.query(), opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	enc := json.NewEncoder(w)
+	for cursor.Next(ctx) {
+		var event models.AuditEvent
+		if err := cursor.Decode(&event); err != nil {
+			return err
+		}
+		if err := enc.Encode(&event); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (f AuditFilter) query() bson.M {
+	query := bson.M{}
+	if f.Action != "" {
+		query["action"] = f.Action
+	}
+	if f.Actor != "" {
+		query["actor"] = f.Actor
+	}
+	if f.Target != "" {
+		query["target"] = f.Target
+	}
+
+	timestamp := bson.M{}
+	if !f.Since.IsZero() {
+		timestamp["$gte"] = f.Since
+	}
+	if !f.Until.IsZero() {
+		timestamp["$lt"] = f.Until
+	}
+	if len(timestamp) > 0 {
+		query["timestamp"] = timestamp
+	}
+	return query
+}
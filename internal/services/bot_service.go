@@ -0,0 +1,208 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"gochat-server/internal/metrics"
+	"gochat-server/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Bot token scopes
+const (
+	BotScopeMessagesWrite = "messages:write"
+)
+
+// BotScopes lists every scope a bot can be granted.
+var BotScopes = []string{BotScopeMessagesWrite}
+
+// botTokenPrefix makes leaked tokens easy to recognize (and to scan for).
+const botTokenPrefix = "gcb_"
+
+var (
+	ErrBotNotFound     = errors.New("bot not found")
+	ErrInvalidBotToken = errors.New("invalid bot token")
+	ErrUnknownBotScope = errors.New("unknown bot scope")
+)
+
+// BotService manages bot accounts and their API tokens. Only a hash of each
+// token is stored; the token itself is returned once, when it is issued.
+type BotService struct {
+	collection *mongo.Collection
+}
+
+func NewBotService(db *mongo.Database) *BotService {
+	return &BotService{
+		collection: db.Collection("bots"),
+	}
+}
+
+// CreateBot creates a bot and issues its first token.
+func (s *BotService) CreateBot(ctx context.Context, name string, rooms, scopes []string) (*models.Bot, string, error) {
+	defer metrics.ObserveMongo("create_bot", time.Now())
+
+	if err := validateBotScopes(scopes); err != nil {
+		return nil, "", err
+	}
+
+	token, hash, err := newToken(botTokenPrefix)
+	if err != nil {
+		return nil, "", err
+	}
+
+	bot := &models.Bot{
+		ID:        primitive.NewObjectID(),
+		Name:      name,
+		Rooms:     rooms,
+		Scopes:    scopes,
+		TokenHash: hash,
+		CreatedAt: time.Now(),
+	}
+	if _, err := s.collection.InsertOne(ctx, bot); err != nil {
+		return nil, "", err
+	}
+	return bot, token, nil
+}
+
+func (s *BotService) ListBots(ctx context.Context) ([]*models.Bot, error) {
+	defer metrics.ObserveMongo("list_bots", time.Now())
+
+	cursor, err := s.collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"created_at": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	bots := []*models.Bot{}
+	if err := cursor.All(ctx, &bots); err != nil {
+		return nil, err
+	}
+	return bots, nil
+}
+
+func (s *BotService) GetBot(ctx context.Context, id string) (*models.Bot, error) {
+	defer metrics.ObserveMongo("get_bot", time.Now())
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrBotNotFound
+	}
+
+	bot := &models.Bot{}
+	err = s.collection.FindOne(ctx, bson.M{"_id": objectID}).Decode(bot)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrBotNotFound
+	}
+	return bot, err
+}
+
+// RotateToken issues a new token for the bot; the old one stops working.
+func (s *BotService) RotateToken(ctx context.Context, id string) (string, error) {
+	defer metrics.ObserveMongo("rotate_bot_token", time.Now())
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return "", ErrBotNotFound
+	}
+
+	token, hash, err := newToken(botTokenPrefix)
+	if err != nil {
+		return "", err
+	}
+
+	result, err := s.collection.UpdateByID(ctx, objectID, bson.M{"$set": bson.M{"token_hash": hash}})
+	if err != nil {
+		return "", err
+	}
+	if result.MatchedCount == 0 {
+		return "", ErrBotNotFound
+	}
+	return token, nil
+}
+
+// DeleteBot removes the bot, revoking its token.
+func (s *BotService) DeleteBot(ctx context.Context, id string) error {
+	defer metrics.ObserveMongo("delete_bot", time.Now())
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrBotNotFound
+	}
+
+	result, err := s.collection.DeleteOne(ctx, bson.M{"_id": objectID})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrBotNotFound
+	}
+	return nil
+}
+
+// Authenticate returns the bot the token belongs to and records its use.
+func (s *BotService) Authenticate(ctx context.Context, token string) (*models.Bot, error) {
+	defer metrics.ObserveMongo("authenticate_bot", time.Now())
+
+	if !strings.HasPrefix(token, botTokenPrefix) {
+		return nil, ErrInvalidBotToken
+	}
+
+	bot := &models.Bot{}
+	err := s.collection.FindOneAndUpdate(ctx,
+		bson.M{"token_hash": hashToken(token)},
+		bson.M{"$set": bson.M{"last_used_at": time.Now()}},
+	).Decode(bot)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrInvalidBotToken
+	}
+	return bot, err
+}
+
+// BotCan reports whether bot has scope in roomID.
+func BotCan(bot *models.Bot, scope, roomID string) bool {
+	return slices.Contains(bot.Scopes, scope) &&
+		(slices.Contains(bot.Rooms, "*") || slices.Contains(bot.Rooms, roomID))
+}
+
+// BotUserID is the user ID bot messages are posted under. The prefix keeps
+// bots apart from real users.
+func BotUserID(bot *models.Bot) string {
+	return "bot:" + bot.ID.Hex()
+}
+
+func validateBotScopes(scopes []string) error {
+	for _, scope := range scopes {
+		if !slices.Contains(BotScopes, scope) {
+			return fmt.Errorf("%w %q", ErrUnknownBotScope, scope)
+		}
+	}
+	return nil
+}
+
+// newToken generates a random API token and the hash stored in its place.
+func newToken(prefix string) (token, hash string, err error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	token = prefix + base64.RawURLEncoding.EncodeToString(secret)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
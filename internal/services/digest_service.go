@@ -0,0 +1,253 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gochat-server/internal/models"
+	"gochat-server/internal/queue"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	TypeEmailDigest = "email:digest"
+
+	digestSnippetsPerRoom = 3
+	digestSnippetLength   = 120
+)
+
+// DigestSection summarises one room's activity in a digest email.
+type DigestSection struct {
+	RoomID   string
+	Count    int64
+	Messages []*models.Message
+}
+
+// DigestService emails digest subscribers a summary of what they missed since
+// their last digest. The per-user watermark lives in Mongo so a digest is never
+// sent twice for the same messages, even if the job is retried.
+type DigestService struct {
+	watermarks        *mongo.Collection
+	messageService    *MessageService
+	profileService    *ProfileService
+	membershipService *MembershipService
+	preferenceService *PreferenceService
+	emailService      *EmailService
+}
+
+func NewDigestService(
+	db *mongo.Database,
+	messageService *MessageService,
+	profileService *ProfileService,
+	membershipService *MembershipService,
+	preferenceService *PreferenceService,
+	emailService *EmailService,
+) *DigestService {
+	return &DigestService{
+		watermarks:        db.Collection("digest_watermarks"),
+		messageService:    messageService,
+		profileService:    profileService,
+		membershipService: membershipService,
+		preferenceService: preferenceService,
+		emailService:      emailService,
+	}
+}
+
+type digestPayload struct {
+	Interval string `json:"interval"`
+}
+
+// RegisterJobs registers the digest job and its hourly and daily schedule.
+// Uniqueness keeps several server instances from sending the same digest twice.
+func (s *DigestService) RegisterJobs(q *queue.Manager) error {
+	q.Register(queue.Job{
+		Type:     TypeEmailDigest,
+		Queue:    queue.QueueLow,
+		MaxRetry: 3,
+		Timeout:  10 * time.Minute,
+		Unique:   50 * time.Minute,
+		Handler: queue.Handle(func(ctx context.Context, p *digestPayload) error {
+			return s.SendDigests(ctx, p.Interval)
+		}),
+	})
+
+	schedule := map[string]string{
+		models.DigestHourly: "@hourly",
+		models.DigestDaily:  "@daily",
+	}
+	for interval, cronspec := range schedule {
+		if err := q.Schedule(cronspec, TypeEmailDigest, &digestPayload{Interval: interval}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendDigests sends the interval ("hourly" or "daily") digest to every subscriber.
+func (s *DigestService) SendDigests(ctx context.Context, interval string) error {
+	subscribers, err := s.preferenceService.FindDigestSubscribers(ctx, interval)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	failed := 0
+	for _, prefs := range subscribers {
+		if err := s.sendDigest(ctx, prefs, interval, now); err != nil {
+			failed++
+			logrus.WithFields(logrus.Fields{
+				"user_id": prefs.UserID,
+				"error":   err.Error(),
+			}).Error("Failed to send digest")
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"interval":    interval,
+		"subscribers": len(subscribers),
+		"failed":      failed,
+	}).Info("Digest run finished")
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d digests failed", failed, len(subscribers))
+	}
+	return nil
+}
+
+func (s *DigestService) sendDigest(ctx context.Context, prefs *models.NotificationPreferences, interval string, now time.Time) error {
+	// Held back digests are picked up by the next run, the watermark stays put
+	if !s.preferenceService.QuietUntil(prefs, now).IsZero() {
+		return nil
+	}
+
+	profile, err := s.profileService.GetProfile(ctx, prefs.UserID)
+	if errors.Is(err, ErrProfileNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if profile.Email == "" {
+		return nil
+	}
+
+	if suppressed, err := s.emailService.IsSuppressed(ctx, profile.Email); err != nil || suppressed {
+		return err
+	}
+
+	since, err := s.watermark(ctx, prefs.UserID, interval, now)
+	if err != nil {
+		return err
+	}
+
+	rooms, err := s.membershipService.GetUserRooms(ctx, prefs.UserID)
+	if err != nil {
+		return err
+	}
+
+	var sections []DigestSection
+	for _, roomID := range rooms {
+		mode, roomInterval := s.preferenceService.ModeFor(prefs, roomID)
+		if mode != models.NotifyDigest || roomInterval != interval {
+			continue
+		}
+
+		count, messages, err := s.messageService.GetRoomActivitySince(ctx, roomID, since, prefs.UserID, digestSnippetsPerRoom)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			sections = append(sections, DigestSection{RoomID: roomID, Count: count, Messages: messages})
+		}
+	}
+
+	if len(sections) > 0 {
+		if err := s.emailService.SendEmail(ctx, renderDigest(profile, interval, sections)); err != nil {
+			return err
+		}
+	}
+
+	return s.setWatermark(ctx, prefs.UserID, interval, now)
+}
+
+// Watermarks are kept per user and interval: a user can get hourly digests
+// for some rooms and daily ones for others, and an hourly run must not move
+// the daily watermark.
+func watermarkID(userID, interval string) string {
+	return userID + ":" + interval
+}
+
+func (s *DigestService) watermark(ctx context.Context, userID, interval string, now time.Time) (time.Time, error) {
+	var doc struct {
+		LastSentAt time.Time `bson:"last_sent_at"`
+	}
+
+	err := s.watermarks.FindOne(ctx, bson.M{"_id": watermarkID(userID, interval)}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if interval == models.DigestDaily {
+			return now.Add(-24 * time.Hour), nil
+		}
+		return now.Add(-time.Hour), nil
+	}
+	return doc.LastSentAt, err
+}
+
+func (s *DigestService) setWatermark(ctx context.Context, userID, interval string, at time.Time) error {
+	_, err := s.watermarks.UpdateOne(ctx,
+		bson.M{"_id": watermarkID(userID, interval)},
+		bson.M{"$set": bson.M{"last_sent_at": at}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func renderDigest(profile *models.UserProfile, interval string, sections []DigestSection) *models.EmailPayload {
+	var total int64
+	rooms := make([]map[string]interface{}, 0, len(sections))
+
+	for _, section := range sections {
+		total += section.Count
+
+		messages := make([]map[string]interface{}, 0, len(section.Messages))
+		for _, msg := range section.Messages {
+			messages = append(messages, map[string]interface{}{
+				"Username": msg.Username,
+				"Content":  snippet(msg.Content),
+			})
+		}
+
+		rooms = append(rooms, map[string]interface{}{
+			"RoomID":   section.RoomID,
+			"Count":    section.Count,
+			"Messages": messages,
+			"More":     section.Count - int64(len(section.Messages)),
+		})
+	}
+
+	return &models.EmailPayload{
+		To:       profile.Email,
+		UserID:   profile.ID,
+		Template: TemplateDigest,
+		Data: map[string]interface{}{
+			"Username": profile.Username,
+			"Interval": interval,
+			"Total":    total,
+			"Sections": rooms,
+		},
+	}
+}
+
+func snippet(content string) string {
+	runes := []rune(strings.Join(strings.Fields(content), " "))
+	if len(runes) <= digestSnippetLength {
+		return string(runes)
+	}
+	return string(runes[:digestSnippetLength-1]) + "…"
+}
@@ -0,0 +1,162 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"time"
+
+	"gochat-server/internal/mailer"
+	"gochat-server/internal/models"
+	"gochat-server/internal/queue"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	TypeEmailNotification = "email:notification"
+
+	// Sent emails stay inspectable for this long
+	emailRetention = 7 * 24 * time.Hour
+)
+
+var ErrEmailNotFound = errors.New("email task not found")
+
+// RegisterJobs registers the email delivery job with the queue.
+func (s *EmailService) RegisterJobs(q *queue.Manager) {
+	s.queue = q
+	q.Register(queue.Job{
+		Type:      TypeEmailNotification,
+		Queue:     queue.QueueDefault,
+		MaxRetry:  3,
+		Timeout:   30 * time.Second,
+		Retention: emailRetention,
+		Handler:   queue.Handle(s.deliver),
+	})
+}
+
+// QueueEmail enqueues an email and returns its task ID for GetEmailStatus.
+func (s *EmailService) QueueEmail(ctx context.Context, payload *models.EmailPayload, opts ...queue.EnqueueOption) (string, error) {
+	id, err := s.queue.Enqueue(ctx, TypeEmailNotification, payload, opts...)
+	if err != nil {
+		return "", err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"task_id": id,
+		"to":      payload.To,
+		"subject": payload.Subject,
+	}).Info("Email queued successfully")
+
+	return id, nil
+}
+
+func (s *EmailService) deliver(ctx context.Context, payload *models.EmailPayload) error {
+	if payload.To == "" {
+		return queue.Permanent(errors.New("email has no recipient"))
+	}
+	if _, err := mail.ParseAddress(payload.To); err != nil {
+		return queue.Permanent(fmt.Errorf("invalid recipient %q: %w", payload.To, err))
+	}
+	if payload.Template != "" && !s.HasTemplate(payload.Template) {
+		return queue.Permanent(fmt.Errorf("unknown email template %q", payload.Template))
+	}
+
+	suppressed, err := s.IsSuppressed(ctx, payload.To)
+	if err != nil {
+		return err
+	}
+	if suppressed {
+		logrus.WithFields(logrus.Fields{
+			"to": payload.To,
+		}).Info("Skipping email to suppressed address")
+		return nil
+	}
+
+	err = s.SendEmail(ctx, payload)
+	var rcptErr *mailer.RecipientError
+	if errors.As(err, &rcptErr) && rcptErr.MailboxUnavailable() {
+		// The address is suppressed now; retrying would only bounce again
+		return queue.Permanent(err)
+	}
+	return err
+}
+
+// GetEmailStatus reports the delivery state of an email task.
+func (s *EmailService) GetEmailStatus(id string) (*models.EmailStatus, error) {
+	task, err := s.queue.GetTask(TypeEmailNotification, id)
+	if errors.Is(err, queue.ErrTaskNotFound) {
+		return nil, ErrEmailNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return emailStatus(task), nil
+}
+
+// ListFailedEmails returns email tasks that exhausted their retries.
+func (s *EmailService) ListFailedEmails(page, pageSize int) ([]*models.EmailStatus, error) {
+	tasks, err := s.queue.ListArchived(TypeEmailNotification, page, pageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]*models.EmailStatus, 0, len(tasks))
+	for _, task := range tasks {
+		statuses = append(statuses, emailStatus(task))
+	}
+	return statuses, nil
+}
+
+// RetryEmail queues a failed email again with a fresh set of retries. The
+// retry is a new task; RetryEmail returns its ID.
+func (s *EmailService) RetryEmail(id string) (string, error) {
+	newID, err := s.queue.ReplayTask(TypeEmailNotification, id)
+	return newID, emailTaskError(err)
+}
+
+func (s *EmailService) DeleteEmail(id string) error {
+	return emailTaskError(s.queue.DeleteTask(TypeEmailNotification, id))
+}
+
+func emailTaskError(err error) error {
+	if errors.Is(err, queue.ErrTaskNotFound) {
+		return ErrEmailNotFound
+	}
+	return err
+}
+
+func emailStatus(task *queue.TaskStatus) *models.EmailStatus {
+	status := &models.EmailStatus{
+		ID:           task.ID,
+		Retried:      task.Retried,
+		MaxRetry:     task.MaxRetry,
+		LastError:    task.LastError,
+		LastFailedAt: task.LastFailedAt,
+		CompletedAt:  task.CompletedAt,
+	}
+
+	switch task.State {
+	case queue.StateRetry:
+		status.State = models.EmailRetrying
+		status.NextAttemptAt = task.NextProcessAt
+	case queue.StateArchived:
+		status.State = models.EmailFailed
+	case queue.StateCompleted:
+		status.State = models.EmailSent
+	default:
+		status.State = models.EmailPending
+		status.NextAttemptAt = task.NextProcessAt
+	}
+
+	var payload models.EmailPayload
+	if json.Unmarshal(task.Payload, &payload) == nil {
+		status.To = payload.To
+		status.Subject = payload.Subject
+		status.Template = payload.Template
+	}
+
+	return status
+}
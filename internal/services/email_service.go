@@ -2,37 +2,172 @@ package services
 
 import (
     "gochat-server/internal/config"
+    "gochat-server/internal/mailer"
     "gochat-server/internal/models"
+    "gochat-server/internal/queue"
+    "gochat-server/internal/tracing"
+    "bytes"
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
     "fmt"
-    "net/smtp"
+    "mime"
+    "mime/quotedprintable"
+    "net/mail"
+    "net/url"
+    "strings"
+    "time"
 
     "github.com/sirupsen/logrus"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/codes"
+    "go.opentelemetry.io/otel/trace"
 )
 
+// ErrInvalidEmailHeader is returned by BuildMessage for a header value that
+// would break out of its header, such as one containing a line break.
+var ErrInvalidEmailHeader = errors.New("invalid email header value")
+
 type EmailService struct {
-    config *config.Config
+    mailer       mailer.Mailer
+    templates    *EmailTemplates
+    from         mail.Address
+    publicURL    string
+    unsubscribe  *UnsubscribeSigner
+    suppressions *SuppressionService
+    queue        *queue.Manager
 }
 
-func NewEmailService(cfg *config.Config) *EmailService {
+func NewEmailService(cfg *config.Config, m mailer.Mailer, suppressions *SuppressionService) *EmailService {
+    templates, err := LoadEmailTemplates()
+    if err != nil {
+        // Templates are embedded in the binary, so this is a programming error
+        panic(err)
+    }
+
+    secret := []byte(cfg.UnsubscribeSecret)
+    if len(secret) == 0 {
+        logrus.Warn("UNSUBSCRIBE_SECRET not set, unsubscribe links will stop working after a restart")
+        secret = make([]byte, 32)
+        rand.Read(secret)
+    }
+
     return &EmailService{
-        config: cfg,
+        mailer:       m,
+        templates:    templates,
+        from:         mail.Address{Name: cfg.EmailFromName, Address: cfg.EmailFrom},
+        publicURL:    strings.TrimRight(cfg.PublicURL, "/"),
+        unsubscribe:  NewUnsubscribeSigner(secret),
+        suppressions: suppressions,
     }
 }
 
-func (s *EmailService) SendEmail(payload *models.EmailPayload) error {
-    // Mock SMTP implementation for MailHog
-    auth := smtp.PlainAuth("", s.config.SMTPUser, s.config.SMTPPass, s.config.SMTPHost)
+// UnsubscribeURL returns the signed one-click link that turns off emails for
+// the user, for a single room when roomID is set.
+func (s *EmailService) UnsubscribeURL(userID, roomID string) string {
+    return s.publicURL + "/unsubscribe?token=" + url.QueryEscape(s.unsubscribe.Sign(userID, roomID))
+}
+
+// QueueEmailVerification emails the profile's pending address a link that
+// confirms it with token.
+func (s *EmailService) QueueEmailVerification(ctx context.Context, profile *models.UserProfile, token string) (string, error) {
+    return s.QueueEmail(ctx, &models.EmailPayload{
+        To:       profile.PendingEmail,
+        Template: TemplateVerifyEmail,
+        Data: map[string]interface{}{
+            "Username":  profile.Username,
+            "ExpiresIn": "24 hours",
+            "VerifyURL": s.publicURL + "/verify-email?token=" + url.QueryEscape(token),
+        },
+    })
+}
+
+func (s *EmailService) VerifyUnsubscribeToken(token string) (userID, roomID string, err error) {
+    return s.unsubscribe.Verify(token)
+}
+
+// IsSuppressed reports whether the address bounced or opted out.
+func (s *EmailService) IsSuppressed(ctx context.Context, email string) (bool, error) {
+    return s.suppressions.IsSuppressed(ctx, email)
+}
 
-    to := []string{payload.To}
-    msg := []byte("To: " + payload.To + "\r\n" +
-        "Subject: " + payload.Subject + "\r\n" +
-        "\r\n" +
-        payload.Body + "\r\n")
+// HasTemplate reports whether name is a known email template.
+func (s *EmailService) HasTemplate(name string) bool {
+    return s.templates.Has(name)
+}
 
-    addr := fmt.Sprintf("%s:%s", s.config.SMTPHost, s.config.SMTPPort)
-    err := smtp.SendMail(addr, auth, "noreply@chatserver.com", to, msg)
+// Render turns payload into a subject and text/HTML bodies, using its named
+// template if it has one and its literal Subject/Body otherwise.
+func (s *EmailService) Render(payload *models.EmailPayload) (*RenderedEmail, error) {
+    if payload.Template == "" {
+        return &RenderedEmail{Subject: payload.Subject, Text: payload.Body}, nil
+    }
+    return s.templates.Render(payload.Template, payload.Data)
+}
 
+func (s *EmailService) SendEmail(ctx context.Context, payload *models.EmailPayload) (err error) {
+    ctx, span := tracing.Tracer().Start(ctx, "email.send", trace.WithAttributes(
+        attribute.String("email.template", payload.Template),
+    ))
+    defer func() {
+        if err != nil {
+            span.RecordError(err)
+            span.SetStatus(codes.Error, err.Error())
+        }
+        span.End()
+    }()
+
+    // Notification emails carry a user and get unsubscribe links
+    var unsubscribeURL string
+    if payload.UserID != "" {
+        unsubscribeURL = s.UnsubscribeURL(payload.UserID, payload.RoomID)
+
+        data := make(map[string]interface{}, len(payload.Data)+1)
+        for k, v := range payload.Data {
+            data[k] = v
+        }
+        data["UnsubscribeURL"] = unsubscribeURL
+
+        withLink := *payload
+        withLink.Data = data
+        payload = &withLink
+    }
+
+    rendered, err := s.Render(payload)
     if err != nil {
+        logrus.WithFields(logrus.Fields{
+            "to":       payload.To,
+            "template": payload.Template,
+            "error":    err.Error(),
+        }).Error("Failed to render email")
+        return err
+    }
+
+    if unsubscribeURL != "" {
+        rendered.UnsubscribeURL = unsubscribeURL
+        rendered.Text += "\n--\nUnsubscribe: " + unsubscribeURL + "\n"
+    }
+
+    to, err := mail.ParseAddress(payload.To)
+    if err != nil {
+        return fmt.Errorf("invalid recipient %q: %w", payload.To, err)
+    }
+
+    msg, err := BuildMessage(s.from, to.Address, rendered, time.Now(), newMessageID(s.from.Address))
+    if err != nil {
+        return err
+    }
+
+    if err := s.mailer.Send(ctx, s.from.Address, []string{to.Address}, msg); err != nil {
+        var rcptErr *mailer.RecipientError
+        if errors.As(err, &rcptErr) && rcptErr.MailboxUnavailable() {
+            if err := s.suppressions.Suppress(ctx, rcptErr.Recipient, SuppressionBounce, rcptErr.Err.Error()); err != nil {
+                logrus.Error("Failed to record bounce: ", err)
+            }
+        }
+
         logrus.WithFields(logrus.Fields{
             "to":    payload.To,
             "error": err.Error(),
@@ -42,8 +177,100 @@ func (s *EmailService) SendEmail(payload *models.EmailPayload) error {
 
     logrus.WithFields(logrus.Fields{
         "to":      payload.To,
-        "subject": payload.Subject,
+        "subject": rendered.Subject,
     }).Info("Email sent successfully")
 
     return nil
 }
+
+// BuildMessage assembles an RFC 5322 message. Bodies are quoted-printable; when
+// there is an HTML body it is sent as multipart/alternative next to the text.
+// The output depends only on its arguments so it can be compared byte for byte.
+// to must be a bare address, and no header value may contain CR or LF.
+func BuildMessage(from mail.Address, to string, email *RenderedEmail, date time.Time, messageID string) ([]byte, error) {
+    if addr, err := mail.ParseAddress(to); err != nil || addr.Address != to {
+        return nil, fmt.Errorf("%w: To %q", ErrInvalidEmailHeader, to)
+    }
+
+    var buf bytes.Buffer
+    var headerErr error
+
+    header := func(key, value string) {
+        if strings.ContainsAny(value, "\r\n") {
+            if headerErr == nil {
+                headerErr = fmt.Errorf("%w: %s", ErrInvalidEmailHeader, key)
+            }
+            return
+        }
+        buf.WriteString(key + ": " + value + "\r\n")
+    }
+
+    header("From", from.String())
+    header("To", to)
+    header("Subject", mime.QEncoding.Encode("utf-8", email.Subject))
+    header("Date", date.Format(time.RFC1123Z))
+    header("Message-ID", messageID)
+    header("MIME-Version", "1.0")
+    if email.UnsubscribeURL != "" {
+        // RFC 8058 one-click unsubscribe
+        header("List-Unsubscribe", "<"+email.UnsubscribeURL+">")
+        header("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+    }
+
+    if headerErr != nil {
+        return nil, headerErr
+    }
+
+    if email.HTML == "" {
+        header("Content-Type", "text/plain; charset=utf-8")
+        header("Content-Transfer-Encoding", "quoted-printable")
+        buf.WriteString("\r\n")
+        if err := writeQuotedPrintable(&buf, email.Text); err != nil {
+            return nil, err
+        }
+        return buf.Bytes(), nil
+    }
+
+    sum := sha256.Sum256([]byte(messageID))
+    boundary := "gochat-" + hex.EncodeToString(sum[:12])
+
+    header("Content-Type", `multipart/alternative; boundary="`+boundary+`"`)
+    buf.WriteString("\r\n")
+
+    parts := []struct{ contentType, body string }{
+        {"text/plain; charset=utf-8", email.Text},
+        {"text/html; charset=utf-8", email.HTML},
+    }
+    for _, part := range parts {
+        buf.WriteString("--" + boundary + "\r\n")
+        header("Content-Type", part.contentType)
+        header("Content-Transfer-Encoding", "quoted-printable")
+        buf.WriteString("\r\n")
+        if err := writeQuotedPrintable(&buf, part.body); err != nil {
+            return nil, err
+        }
+        buf.WriteString("\r\n")
+    }
+    buf.WriteString("--" + boundary + "--\r\n")
+
+    return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(buf *bytes.Buffer, body string) error {
+    w := quotedprintable.NewWriter(buf)
+    if _, err := w.Write([]byte(body)); err != nil {
+        return err
+    }
+    return w.Close()
+}
+
+func newMessageID(from string) string {
+    domain := "localhost"
+    if at := strings.LastIndex(from, "@"); at >= 0 {
+        domain = from[at+1:]
+    }
+
+    b := make([]byte, 16)
+    rand.Read(b)
+    return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(b), domain)
+}
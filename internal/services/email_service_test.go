@@ -0,0 +1,170 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+var goldenEmailData = map[string]map[string]interface{}{
+	TemplateNewMessage: {
+		"Count":  3,
+		"Plural": true,
+		"Rooms": []map[string]interface{}{
+			{"Name": "general", "Messages": []map[string]interface{}{
+				{"Username": "alice", "Content": "Lunch at noon?"},
+				{"Username": "bob", "Content": "Sounds good <3"},
+			}},
+			{"Name": "random", "Messages": []map[string]interface{}{
+				{"Username": "carol", "Content": "Café opens at 8"},
+			}},
+		},
+		"UnsubscribeURL": "https://chat.example.com/unsubscribe?token=abc",
+	},
+	TemplateMention: {
+		"Username":       "alice",
+		"RoomName":       "general",
+		"Content":        "@bob can you review <script>this</script>?",
+		"UnsubscribeURL": "https://chat.example.com/unsubscribe?token=abc",
+	},
+	TemplateDigest: {
+		"Username": "bob",
+		"Interval": "daily",
+		"Total":    12,
+		"Sections": []map[string]interface{}{
+			{"RoomID": "general", "Count": 10, "More": 8, "Messages": []map[string]interface{}{
+				{"Username": "alice", "Content": "Morning all"},
+				{"Username": "carol", "Content": "Release is out"},
+			}},
+			{"RoomID": "random", "Count": 2, "More": 0, "Messages": []map[string]interface{}{
+				{"Username": "dave", "Content": "Anyone seen my keys?"},
+				{"Username": "erin", "Content": "Check the fridge"},
+			}},
+		},
+		"UnsubscribeURL": "https://chat.example.com/unsubscribe?token=abc",
+	},
+	TemplateInvite: {
+		"InviterName": "alice",
+		"RoomName":    "general",
+		"InviteURL":   "https://chat.example.com/rooms/general",
+	},
+	TemplatePasswordReset: {
+		"Username":  "bob",
+		"ExpiresIn": "1 hour",
+		"ResetURL":  "https://chat.example.com/reset?token=xyz",
+	},
+	TemplateVerifyEmail: {
+		"Username":  "bob",
+		"ExpiresIn": "24 hours",
+		"VerifyURL": "https://chat.example.com/verify-email?token=gcv_xyz",
+	},
+}
+
+func TestBuildMessageGolden(t *testing.T) {
+	templates, err := LoadEmailTemplates()
+	if err != nil {
+		t.Fatalf("LoadEmailTemplates: %v", err)
+	}
+
+	from := mail.Address{Name: "GoChat", Address: "noreply@chat.example.com"}
+	date := time.Date(2024, time.March, 1, 9, 30, 0, 0, time.UTC)
+
+	for _, name := range EmailTemplateNames {
+		t.Run(name, func(t *testing.T) {
+			data, ok := goldenEmailData[name]
+			if !ok {
+				t.Fatalf("no golden data for template %q", name)
+			}
+
+			rendered, err := templates.Render(name, data)
+			if err != nil {
+				t.Fatalf("Render: %v", err)
+			}
+			if url, ok := data["UnsubscribeURL"].(string); ok {
+				rendered.UnsubscribeURL = url
+			}
+
+			got, err := BuildMessage(from, "bob@example.com", rendered, date, "<1.golden@chat.example.com>")
+			if err != nil {
+				t.Fatalf("BuildMessage: %v", err)
+			}
+
+			path := filepath.Join("testdata", "email", name+".golden")
+			if *updateGolden {
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("reading golden file (run with -update to create it): %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("message differs from %s (run with -update if the change is intended)\ngot:\n%s", path, got)
+			}
+		})
+	}
+}
+
+func TestBuildMessagePlainText(t *testing.T) {
+	from := mail.Address{Address: "noreply@chat.example.com"}
+	date := time.Date(2024, time.March, 1, 9, 30, 0, 0, time.UTC)
+
+	got, err := BuildMessage(from, "bob@example.com", &RenderedEmail{Subject: "Hi", Text: "Plain body"}, date, "<2@chat.example.com>")
+	if err != nil {
+		t.Fatalf("BuildMessage: %v", err)
+	}
+	if !bytes.Contains(got, []byte("Content-Type: text/plain; charset=utf-8\r\n")) {
+		t.Errorf("want a single text/plain part, got:\n%s", got)
+	}
+	if bytes.Contains(got, []byte("multipart")) {
+		t.Errorf("want no multipart without an HTML body, got:\n%s", got)
+	}
+}
+
+func TestBuildMessageRejectsHeaderInjection(t *testing.T) {
+	from := mail.Address{Address: "noreply@chat.example.com"}
+	date := time.Now()
+
+	tests := []struct {
+		name  string
+		to    string
+		email *RenderedEmail
+	}{
+		{"CRLF in To", "bob@example.com\r\nBcc: eve@example.com", &RenderedEmail{Subject: "Hi", Text: "x"}},
+		{"display name in To", "Bob <bob@example.com>", &RenderedEmail{Subject: "Hi", Text: "x"}},
+		{"CRLF in unsubscribe URL", "bob@example.com", &RenderedEmail{Subject: "Hi", Text: "x", UnsubscribeURL: "https://x\r\nBcc: eve@example.com"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := BuildMessage(from, tt.to, tt.email, date, "<3@chat.example.com>")
+			if !errors.Is(err, ErrInvalidEmailHeader) {
+				t.Fatalf("BuildMessage error = %v, want ErrInvalidEmailHeader", err)
+			}
+		})
+	}
+}
+
+func TestBuildMessageEncodesSubjectLineBreaks(t *testing.T) {
+	from := mail.Address{Address: "noreply@chat.example.com"}
+
+	got, err := BuildMessage(from, "bob@example.com", &RenderedEmail{Subject: "Hi\r\nBcc: eve@example.com", Text: "x"}, time.Now(), "<4@chat.example.com>")
+	if err != nil {
+		t.Fatalf("BuildMessage: %v", err)
+	}
+	if bytes.Contains(got, []byte("\r\nBcc:")) {
+		t.Errorf("subject broke out of its header:\n%s", got)
+	}
+}
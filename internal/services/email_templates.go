@@ -0,0 +1,104 @@
+package services
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+)
+
+const (
+	TemplateNewMessage    = "new_message"
+	TemplateMention       = "mention"
+	TemplateDigest        = "digest"
+	TemplateInvite        = "invite"
+	TemplatePasswordReset = "password_reset"
+	TemplateVerifyEmail   = "verify_email"
+)
+
+var EmailTemplateNames = []string{
+	TemplateNewMessage,
+	TemplateMention,
+	TemplateDigest,
+	TemplateInvite,
+	TemplatePasswordReset,
+	TemplateVerifyEmail,
+}
+
+//go:embed templates/email/*.tmpl
+var emailTemplateFS embed.FS
+
+// RenderedEmail is the output of a named template: a subject plus plain-text
+// and HTML alternatives of the body.
+type RenderedEmail struct {
+	Subject        string
+	Text           string
+	HTML           string
+	UnsubscribeURL string
+}
+
+// EmailTemplates holds the parsed template pair for each named email. Every
+// <name>.txt.tmpl defines "subject" and "body"; every <name>.html.tmpl defines
+// "title" and "content", which are wrapped by layout.html.tmpl.
+type EmailTemplates struct {
+	text map[string]*texttemplate.Template
+	html map[string]*htmltemplate.Template
+}
+
+func LoadEmailTemplates() (*EmailTemplates, error) {
+	t := &EmailTemplates{
+		text: make(map[string]*texttemplate.Template),
+		html: make(map[string]*htmltemplate.Template),
+	}
+
+	for _, name := range EmailTemplateNames {
+		text, err := texttemplate.New(name).Option("missingkey=zero").
+			ParseFS(emailTemplateFS, "templates/email/"+name+".txt.tmpl")
+		if err != nil {
+			return nil, err
+		}
+
+		html, err := htmltemplate.New(name).Option("missingkey=zero").
+			ParseFS(emailTemplateFS, "templates/email/layout.html.tmpl", "templates/email/"+name+".html.tmpl")
+		if err != nil {
+			return nil, err
+		}
+
+		t.text[name] = text
+		t.html[name] = html
+	}
+
+	return t, nil
+}
+
+func (t *EmailTemplates) Has(name string) bool {
+	_, ok := t.text[name]
+	return ok
+}
+
+func (t *EmailTemplates) Render(name string, data interface{}) (*RenderedEmail, error) {
+	text, ok := t.text[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown email template %q", name)
+	}
+
+	var subject, body, html bytes.Buffer
+	if err := text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err := text.ExecuteTemplate(&body, "body", data); err != nil {
+		return nil, err
+	}
+	if err := t.html[name].ExecuteTemplate(&html, "layout", data); err != nil {
+		return nil, err
+	}
+
+	return &RenderedEmail{
+		// Headers can't carry line breaks
+		Subject: strings.Join(strings.Fields(subject.String()), " "),
+		Text:    strings.TrimLeft(body.String(), "\n"),
+		HTML:    html.String(),
+	}, nil
+}
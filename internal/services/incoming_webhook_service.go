@@ -0,0 +1,270 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"gochat-server/internal/metrics"
+	"gochat-server/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const incomingWebhookTokenPrefix = "gcw_"
+
+var ErrIncomingWebhookNotFound = errors.New("incoming webhook not found")
+
+// IncomingWebhookService manages the secret URLs external systems use to post
+// into rooms.
+type IncomingWebhookService struct {
+	collection *mongo.Collection
+}
+
+func NewIncomingWebhookService(db *mongo.Database) *IncomingWebhookService {
+	return &IncomingWebhookService{
+		collection: db.Collection("incoming_webhooks"),
+	}
+}
+
+// CreateIncomingWebhook creates a webhook posting into roomID as name and
+// returns the token for its URL.
+func (s *IncomingWebhookService) CreateIncomingWebhook(ctx context.Context, roomID, name string) (*models.IncomingWebhook, string, error) {
+	defer metrics.ObserveMongo("create_incoming_webhook", time.Now())
+
+	token, hash, err := newToken(incomingWebhookTokenPrefix)
+	if err != nil {
+		return nil, "", err
+	}
+
+	webhook := &models.IncomingWebhook{
+		ID:        primitive.NewObjectID(),
+		RoomID:    roomID,
+		Name:      name,
+		TokenHash: hash,
+		CreatedAt: time.Now(),
+	}
+	if _, err := s.collection.InsertOne(ctx, webhook); err != nil {
+		return nil, "", err
+	}
+	return webhook, token, nil
+}
+
+func (s *IncomingWebhookService) ListIncomingWebhooks(ctx context.Context, roomID string) ([]*models.IncomingWebhook, error) {
+	defer metrics.ObserveMongo("list_incoming_webhooks", time.Now())
+
+	cursor, err := s.collection.Find(ctx, bson.M{"room_id": roomID}, options.Find().SetSort(bson.M{"created_at": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	webhooks := []*models.IncomingWebhook{}
+	if err := cursor.All(ctx, &webhooks); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+// DeleteIncomingWebhook removes the webhook; its URL stops working.
+func (s *IncomingWebhookService) DeleteIncomingWebhook(ctx context.Context, id string) error {
+	defer metrics.ObserveMongo("delete_incoming_webhook", time.Now())
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrIncomingWebhookNotFound
+	}
+
+	result, err := s.collection.DeleteOne(ctx, bson.M{"_id": objectID})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrIncomingWebhookNotFound
+	}
+	return nil
+}
+
+// Authenticate returns the webhook the URL token belongs to and records its use.
+func (s *IncomingWebhookService) Authenticate(ctx context.Context, token string) (*models.IncomingWebhook, error) {
+	defer metrics.ObserveMongo("authenticate_incoming_webhook", time.Now())
+
+	if !strings.HasPrefix(token, incomingWebhookTokenPrefix) {
+		return nil, ErrIncomingWebhookNotFound
+	}
+
+	webhook := &models.IncomingWebhook{}
+	err := s.collection.FindOneAndUpdate(ctx,
+		bson.M{"token_hash": hashToken(token)},
+		bson.M{"$set": bson.M{"last_used_at": time.Now()}},
+	).Decode(webhook)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrIncomingWebhookNotFound
+	}
+	return webhook, err
+}
+
+// IncomingWebhookUserID is the user ID incoming webhook messages are posted under.
+func IncomingWebhookUserID(webhook *models.IncomingWebhook) string {
+	return "webhook:" + webhook.ID.Hex()
+}
+
+// IncomingMessage is the body incoming webhooks accept: {"text": "..."} at
+// its simplest, or a Slack incoming-webhook payload with attachments and
+// blocks.
+type IncomingMessage struct {
+	Text        string               `json:"text"`
+	Username    string               `json:"username"`
+	Attachments []IncomingAttachment `json:"attachments"`
+	Blocks      []IncomingBlock      `json:"blocks"`
+}
+
+// IncomingAttachment is a Slack message attachment.
+type IncomingAttachment struct {
+	Fallback  string          `json:"fallback"`
+	Pretext   string          `json:"pretext"`
+	Title     string          `json:"title"`
+	TitleLink string          `json:"title_link"`
+	Text      string          `json:"text"`
+	Fields    []IncomingField `json:"fields"`
+	Footer    string          `json:"footer"`
+}
+
+type IncomingField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+}
+
+// IncomingBlock is a Slack Block Kit block. Only the text of header,
+// section, context and divider blocks is used.
+type IncomingBlock struct {
+	Type     string         `json:"type"`
+	Text     *IncomingText  `json:"text"`
+	Fields   []IncomingText `json:"fields"`
+	Elements []IncomingText `json:"elements"`
+}
+
+type IncomingText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// Content renders the message as plain chat text. As in Slack, blocks take
+// the place of text when present; attachments follow. Slack markup for
+// links, mentions and escaped characters is converted.
+func (m *IncomingMessage) Content() string {
+	var parts []string
+	if len(m.Blocks) > 0 {
+		parts = append(parts, renderBlocks(m.Blocks)...)
+	} else if m.Text != "" {
+		parts = append(parts, m.Text)
+	}
+	for _, attachment := range m.Attachments {
+		if text := renderAttachment(attachment); text != "" {
+			parts = append(parts, text)
+		}
+	}
+	return strings.TrimSpace(slackMarkup(strings.Join(parts, "\n\n")))
+}
+
+func renderBlocks(blocks []IncomingBlock) []string {
+	var parts []string
+	for _, block := range blocks {
+		var lines []string
+		switch block.Type {
+		case "header", "section":
+			if block.Text != nil && block.Text.Text != "" {
+				lines = append(lines, block.Text.Text)
+			}
+			for _, field := range block.Fields {
+				if field.Text != "" {
+					lines = append(lines, field.Text)
+				}
+			}
+		case "context":
+			var texts []string
+			for _, element := range block.Elements {
+				if element.Text != "" {
+					texts = append(texts, element.Text)
+				}
+			}
+			if len(texts) > 0 {
+				lines = append(lines, strings.Join(texts, " "))
+			}
+		case "divider":
+			lines = append(lines, "---")
+		}
+		if len(lines) > 0 {
+			parts = append(parts, strings.Join(lines, "\n"))
+		}
+	}
+	return parts
+}
+
+func renderAttachment(attachment IncomingAttachment) string {
+	var lines []string
+	if attachment.Pretext != "" {
+		lines = append(lines, attachment.Pretext)
+	}
+	switch {
+	case attachment.Title != "" && attachment.TitleLink != "":
+		lines = append(lines, attachment.Title+" ("+attachment.TitleLink+")")
+	case attachment.Title != "":
+		lines = append(lines, attachment.Title)
+	}
+	if attachment.Text != "" {
+		lines = append(lines, attachment.Text)
+	}
+	for _, field := range attachment.Fields {
+		if field.Title != "" || field.Value != "" {
+			lines = append(lines, field.Title+": "+field.Value)
+		}
+	}
+	if attachment.Footer != "" {
+		lines = append(lines, attachment.Footer)
+	}
+	if len(lines) == 0 {
+		return attachment.Fallback
+	}
+	return strings.Join(lines, "\n")
+}
+
+// slackLink matches Slack's <target|label> and <target> markup.
+var slackLink = regexp.MustCompile(`<([^<>|]+)(?:\|([^<>]*))?>`)
+
+var slackEscapes = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&")
+
+// slackMarkup turns <!here>, <!channel> and <!everyone> into our @here and
+// @room mentions, <@U123> into @U123, <url|label> into "label (url)" and
+// other special commands into their fallback label, then unescapes &lt;,
+// &gt; and &amp;.
+func slackMarkup(text string) string {
+	text = slackLink.ReplaceAllStringFunc(text, func(match string) string {
+		groups := slackLink.FindStringSubmatch(match)
+		target, label := groups[1], groups[2]
+		switch {
+		case target == "!here":
+			return "@here"
+		case target == "!channel" || target == "!everyone":
+			return "@room"
+		case strings.HasPrefix(target, "!"):
+			// Dates, user groups and the like; the label is their fallback
+			return label
+		case strings.HasPrefix(target, "@") || strings.HasPrefix(target, "#"):
+			if label != "" {
+				return target[:1] + label
+			}
+			return target
+		case label != "" && label != target:
+			return label + " (" + target + ")"
+		default:
+			return target
+		}
+	})
+	return slackEscapes.Replace(text)
+}
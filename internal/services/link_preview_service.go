@@ -0,0 +1,320 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"gochat-server/internal/models"
+	"gochat-server/internal/queue"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/net/html"
+)
+
+const (
+	TypeLinkPreview = "message:link_preview"
+
+	linkPreviewTimeout      = 5 * time.Second
+	linkPreviewMaxBody      = 1 << 20
+	linkPreviewMaxRedirects = 3
+	linkPreviewMaxURLs      = 3
+)
+
+var (
+	urlPattern = regexp.MustCompile(`https?://[^\s<>"']+`)
+
+	ErrLinkPreviewBlocked = errors.New("link preview target is not allowed")
+)
+
+// LinkPreviewService fetches OpenGraph/Twitter card metadata for URLs posted in messages.
+// Requests are bounded in time and size and never reach private or loopback addresses.
+type LinkPreviewService struct {
+	client           *http.Client
+	messageService   *MessageService
+	queue            *queue.Manager
+	onMessageUpdated func(*models.Message)
+}
+
+type linkPreviewPayload struct {
+	MessageID string `json:"message_id"`
+}
+
+// LinkPreviewOption customises a LinkPreviewService.
+type LinkPreviewOption func(*linkPreviewOptions)
+
+type linkPreviewOptions struct {
+	dial func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// WithLinkPreviewDialer replaces the dialer previews are fetched with, which
+// by default refuses non-public addresses. Meant for tests against local
+// servers.
+func WithLinkPreviewDialer(dial func(ctx context.Context, network, address string) (net.Conn, error)) LinkPreviewOption {
+	return func(o *linkPreviewOptions) {
+		o.dial = dial
+	}
+}
+
+func NewLinkPreviewService(messageService *MessageService, opts ...LinkPreviewOption) *LinkPreviewService {
+	dialer := &net.Dialer{
+		Timeout: linkPreviewTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			// Checked after DNS resolution so rebinding tricks can't slip through
+			addr, err := netip.ParseAddrPort(address)
+			if err != nil || !isPublicIP(addr.Addr()) {
+				return ErrLinkPreviewBlocked
+			}
+			return nil
+		},
+	}
+	options := &linkPreviewOptions{dial: dialer.DialContext}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	return &LinkPreviewService{
+		messageService: messageService,
+		client: &http.Client{
+			Timeout: linkPreviewTimeout,
+			Transport: &http.Transport{
+				Proxy:                 nil,
+				DialContext:           options.dial,
+				TLSHandshakeTimeout:   linkPreviewTimeout,
+				ResponseHeaderTimeout: linkPreviewTimeout,
+				MaxIdleConns:          10,
+				IdleConnTimeout:       30 * time.Second,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= linkPreviewMaxRedirects {
+					return errors.New("too many redirects")
+				}
+				if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+					return ErrLinkPreviewBlocked
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// RegisterJobs registers the job that attaches previews to stored messages.
+func (s *LinkPreviewService) RegisterJobs(q *queue.Manager) {
+	s.queue = q
+	q.Register(queue.Job{
+		Type:     TypeLinkPreview,
+		Queue:    queue.QueueLow,
+		MaxRetry: 2,
+		Timeout:  30 * time.Second,
+		Handler:  queue.Handle(s.attachPreviews),
+	})
+}
+
+// SetMessageUpdateHandler registers the callback invoked when a message has
+// been enriched with previews and clients should re-render it.
+func (s *LinkPreviewService) SetMessageUpdateHandler(fn func(*models.Message)) {
+	s.onMessageUpdated = fn
+}
+
+// QueuePreviews fetches previews for the links in a stored message in the background.
+func (s *LinkPreviewService) QueuePreviews(ctx context.Context, messageID string) error {
+	_, err := s.queue.Enqueue(ctx, TypeLinkPreview, &linkPreviewPayload{MessageID: messageID})
+	return err
+}
+
+func (s *LinkPreviewService) attachPreviews(ctx context.Context, payload *linkPreviewPayload) error {
+	message, err := s.messageService.GetMessage(ctx, payload.MessageID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// Deleted before we got to it
+		return queue.Permanent(err)
+	}
+	if err != nil {
+		return err
+	}
+
+	var previews []models.LinkPreview
+	for _, url := range ExtractURLs(message.Content) {
+		preview, err := s.Fetch(ctx, url)
+		if err != nil {
+			// One broken link shouldn't block previews for the others
+			logrus.WithFields(logrus.Fields{
+				"url":   url,
+				"error": err.Error(),
+			}).Warn("Failed to fetch link preview")
+			continue
+		}
+		previews = append(previews, *preview)
+	}
+
+	if len(previews) == 0 {
+		return nil
+	}
+
+	if err := s.messageService.SetLinkPreviews(ctx, message.ID, previews); err != nil {
+		return err
+	}
+
+	message.LinkPreviews = previews
+	if s.onMessageUpdated != nil {
+		s.onMessageUpdated(message)
+	}
+
+	return nil
+}
+
+// ExtractURLs returns the distinct http(s) URLs in content, capped at a few per message.
+func ExtractURLs(content string) []string {
+	seen := make(map[string]bool)
+	var urls []string
+	for _, match := range urlPattern.FindAllString(content, -1) {
+		match = strings.TrimRight(match, ".,;:!?)")
+		if seen[match] {
+			continue
+		}
+		seen[match] = true
+		urls = append(urls, match)
+		if len(urls) == linkPreviewMaxURLs {
+			break
+		}
+	}
+	return urls
+}
+
+func (s *LinkPreviewService) Fetch(ctx context.Context, rawURL string) (*models.LinkPreview, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, ErrLinkPreviewBlocked
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "GoChatLinkPreview/1.0")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !strings.Contains(contentType, "html") {
+		return nil, fmt.Errorf("unsupported content type %q", contentType)
+	}
+
+	preview := parsePreview(io.LimitReader(resp.Body, linkPreviewMaxBody), resp.Request.URL)
+	preview.URL = rawURL
+	if preview.Title == "" && preview.Description == "" {
+		return nil, errors.New("no preview metadata found")
+	}
+	return preview, nil
+}
+
+func parsePreview(r io.Reader, base *url.URL) *models.LinkPreview {
+	var title string
+	meta := make(map[string]string)
+
+	tokenizer := html.NewTokenizer(r)
+	// Everything we need lives in <head>; stop there, at EOF, at the size
+	// limit or on malformed markup and use whatever we collected.
+	for done := false; !done; {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			done = true
+
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			done = string(name) == "head"
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.Data {
+			case "meta":
+				var key, content string
+				for _, attr := range token.Attr {
+					switch attr.Key {
+					case "property", "name":
+						key = strings.ToLower(attr.Val)
+					case "content":
+						content = strings.TrimSpace(attr.Val)
+					}
+				}
+				if key != "" && meta[key] == "" {
+					meta[key] = content
+				}
+			case "title":
+				if tokenizer.Next() == html.TextToken && title == "" {
+					title = strings.TrimSpace(tokenizer.Token().Data)
+				}
+			}
+		}
+	}
+
+	preview := &models.LinkPreview{
+		Title:       firstNonEmpty(meta["og:title"], meta["twitter:title"], title),
+		Description: firstNonEmpty(meta["og:description"], meta["twitter:description"], meta["description"]),
+		SiteName:    firstNonEmpty(meta["og:site_name"], base.Hostname()),
+	}
+	if image := firstNonEmpty(meta["og:image"], meta["twitter:image"]); image != "" {
+		if ref, err := base.Parse(image); err == nil && (ref.Scheme == "http" || ref.Scheme == "https") {
+			preview.Image = ref.String()
+		}
+	}
+	return preview
+}
+
+// nonPublicPrefixes are special-purpose ranges netip doesn't classify as
+// private or local but which previews must not reach either.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "this network"
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64, can embed any IPv4 address
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local-use NAT64
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4, can embed any IPv4 address
+}
+
+func isPublicIP(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
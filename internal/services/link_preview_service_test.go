@@ -0,0 +1,186 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+// newLocalLinkPreviewService returns a service allowed to reach the loopback
+// servers httptest starts.
+func newLocalLinkPreviewService() *LinkPreviewService {
+	dialer := &net.Dialer{}
+	return NewLinkPreviewService(nil, WithLinkPreviewDialer(dialer.DialContext))
+}
+
+func TestFetchReadsOpenGraph(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, `<html><head>
+<title>Fallback title</title>
+<meta property="og:title" content="Open Graph title">
+<meta name="twitter:description" content="Twitter description">
+<meta property="og:image" content="/images/card.png">
+</head><body><meta property="og:title" content="ignored"></body></html>`)
+	}))
+	defer srv.Close()
+
+	preview, err := newLocalLinkPreviewService().Fetch(context.Background(), srv.URL+"/post")
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+
+	if preview.URL != srv.URL+"/post" {
+		t.Errorf("URL = %q", preview.URL)
+	}
+	if preview.Title != "Open Graph title" {
+		t.Errorf("Title = %q, want the og:title", preview.Title)
+	}
+	if preview.Description != "Twitter description" {
+		t.Errorf("Description = %q, want the twitter:description", preview.Description)
+	}
+	if preview.Image != srv.URL+"/images/card.png" {
+		t.Errorf("Image = %q, want it resolved against the page", preview.Image)
+	}
+	if preview.SiteName != "127.0.0.1" {
+		t.Errorf("SiteName = %q, want the host name", preview.SiteName)
+	}
+}
+
+func TestFetchFallsBackToTitle(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><head><title> Plain page </title></head></html>`)
+	}))
+	defer srv.Close()
+
+	preview, err := newLocalLinkPreviewService().Fetch(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if preview.Title != "Plain page" {
+		t.Errorf("Title = %q, want the <title>", preview.Title)
+	}
+}
+
+func TestFetchRejectsUnusableResponses(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"not found", func(w http.ResponseWriter, r *http.Request) {
+			http.NotFound(w, r)
+		}},
+		{"not html", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"title": "nope"}`)
+		}},
+		{"no metadata", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<html><body>hello</body></html>`)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handler)
+			defer srv.Close()
+
+			if _, err := newLocalLinkPreviewService().Fetch(context.Background(), srv.URL); err == nil {
+				t.Fatal("Fetch succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestFetchLimitsRedirects(t *testing.T) {
+	var hops int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hops++
+		http.Redirect(w, r, fmt.Sprintf("/hop/%d", hops), http.StatusFound)
+	}))
+	defer srv.Close()
+
+	if _, err := newLocalLinkPreviewService().Fetch(context.Background(), srv.URL); err == nil {
+		t.Fatal("Fetch followed an endless redirect chain")
+	}
+	if hops != linkPreviewMaxRedirects {
+		t.Errorf("server saw %d requests, want %d", hops, linkPreviewMaxRedirects)
+	}
+}
+
+func TestFetchRefusesRedirectToOtherSchemes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	_, err := newLocalLinkPreviewService().Fetch(context.Background(), srv.URL)
+	if !errors.Is(err, ErrLinkPreviewBlocked) {
+		t.Fatalf("Fetch error = %v, want ErrLinkPreviewBlocked", err)
+	}
+}
+
+func TestFetchRefusesLoopbackByDefault(t *testing.T) {
+	var called bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer srv.Close()
+
+	_, err := NewLinkPreviewService(nil).Fetch(context.Background(), srv.URL)
+	if !errors.Is(err, ErrLinkPreviewBlocked) {
+		t.Fatalf("Fetch error = %v, want ErrLinkPreviewBlocked", err)
+	}
+	if called {
+		t.Error("request reached the loopback server")
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"100.64.0.1", false},
+		{"198.18.0.1", false},
+		{"198.19.255.255", false},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		{"224.0.0.1", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"64:ff9b::a00:1", false},
+		{"2002:a00:1::", false},
+	}
+
+	for _, tt := range tests {
+		if got := isPublicIP(netip.MustParseAddr(tt.ip)); got != tt.public {
+			t.Errorf("isPublicIP(%s) = %v, want %v", tt.ip, got, tt.public)
+		}
+	}
+}
+
+func TestExtractURLs(t *testing.T) {
+	got := ExtractURLs("see https://a.example/x, http://b.example/y). and https://a.example/x again; https://c.example https://d.example")
+	want := []string{"https://a.example/x", "http://b.example/y", "https://c.example"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("ExtractURLs = %v, want %v", got, want)
+	}
+}
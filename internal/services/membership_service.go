@@ -0,0 +1,54 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MembershipService remembers which users have joined which rooms, so that
+// members can be reached (mentions, notifications) while they are offline.
+type MembershipService struct {
+	collection *mongo.Collection
+}
+
+func NewMembershipService(db *mongo.Database) *MembershipService {
+	return &MembershipService{
+		collection: db.Collection("room_members"),
+	}
+}
+
+func (s *MembershipService) AddMember(ctx context.Context, roomID, userID string) error {
+	_, err := s.collection.UpdateOne(ctx,
+		bson.M{"room_id": roomID, "user_id": userID},
+		bson.M{"$setOnInsert": bson.M{"joined_at": time.Now()}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *MembershipService) GetMembers(ctx context.Context, roomID string) ([]string, error) {
+	return s.distinct(ctx, "user_id", bson.M{"room_id": roomID})
+}
+
+func (s *MembershipService) GetUserRooms(ctx context.Context, userID string) ([]string, error) {
+	return s.distinct(ctx, "room_id", bson.M{"user_id": userID})
+}
+
+func (s *MembershipService) distinct(ctx context.Context, field string, filter bson.M) ([]string, error) {
+	values, err := s.collection.Distinct(ctx, field, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0, len(values))
+	for _, v := range values {
+		if id, ok := v.(string); ok {
+			result = append(result, id)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,47 @@
+package services
+
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	MentionRoom = "room"
+	MentionHere = "here"
+)
+
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@([\w.-]{1,32})`)
+
+// Mentions is the result of scanning message content for @-mentions.
+type Mentions struct {
+	Usernames []string
+	Room      bool // @room: every member of the room
+	Here      bool // @here: members currently connected to the room
+}
+
+func ParseMentions(content string) Mentions {
+	var mentions Mentions
+	seen := make(map[string]bool)
+
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		name := strings.TrimRight(match[1], ".-")
+		switch strings.ToLower(name) {
+		case MentionRoom:
+			mentions.Room = true
+		case MentionHere:
+			mentions.Here = true
+		case "":
+		default:
+			if !seen[name] {
+				seen[name] = true
+				mentions.Usernames = append(mentions.Usernames, name)
+			}
+		}
+	}
+
+	return mentions
+}
+
+func (m Mentions) Empty() bool {
+	return len(m.Usernames) == 0 && !m.Room && !m.Here
+}
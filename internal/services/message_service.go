@@ -1,11 +1,13 @@
 package services
 
 import (
+    "gochat-server/internal/metrics"
     "gochat-server/internal/models"
     "context"
     "time"
 
     "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
     "go.mongodb.org/mongo-driver/mongo"
     "go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -20,15 +22,45 @@ func NewMessageService(db *mongo.Database) *MessageService {
     }
 }
 
-func (s *MessageService) SaveMessage(message *models.Message) error {
-    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (s *MessageService) SaveMessage(ctx context.Context, message *models.Message) error {
+    defer metrics.ObserveMongo("save_message", time.Now())
+
+    ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
     defer cancel()
 
+    if message.ID.IsZero() {
+        message.ID = primitive.NewObjectID()
+    }
+
     _, err := s.collection.InsertOne(ctx, message)
     return err
 }
 
+func (s *MessageService) GetMessage(ctx context.Context, id string) (*models.Message, error) {
+    defer metrics.ObserveMongo("get_message", time.Now())
+
+    objectID, err := primitive.ObjectIDFromHex(id)
+    if err != nil {
+        return nil, err
+    }
+
+    message := &models.Message{}
+    if err := s.collection.FindOne(ctx, bson.M{"_id": objectID}).Decode(message); err != nil {
+        return nil, err
+    }
+    return message, nil
+}
+
+func (s *MessageService) SetLinkPreviews(ctx context.Context, id primitive.ObjectID, previews []models.LinkPreview) error {
+    defer metrics.ObserveMongo("set_link_previews", time.Now())
+
+    _, err := s.collection.UpdateByID(ctx, id, bson.M{"$set": bson.M{"link_previews": previews}})
+    return err
+}
+
 func (s *MessageService) GetRoomMessages(roomID string, limit int) ([]*models.Message, error) {
+    defer metrics.ObserveMongo("get_room_messages", time.Now())
+
     ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
     defer cancel()
 
@@ -54,3 +86,41 @@ func (s *MessageService) GetRoomMessages(roomID string, limit int) ([]*models.Me
 
     return messages, nil
 }
+
+// GetRoomActivitySince counts messages in roomID newer than since (excluding
+// excludeUserID's own) and returns up to limit of the most recent ones.
+func (s *MessageService) GetRoomActivitySince(ctx context.Context, roomID string, since time.Time, excludeUserID string, limit int) (int64, []*models.Message, error) {
+    defer metrics.ObserveMongo("get_room_activity", time.Now())
+
+    filter := bson.M{
+        "room_id":   roomID,
+        "timestamp": bson.M{"$gt": since},
+        "user_id":   bson.M{"$ne": excludeUserID},
+    }
+
+    count, err := s.collection.CountDocuments(ctx, filter)
+    if err != nil || count == 0 {
+        return count, nil, err
+    }
+
+    opts := options.Find().
+    SetSort(bson.M{"timestamp": -1}).
+    SetLimit(int64(limit))
+
+    cursor, err := s.collection.Find(ctx, filter, opts)
+    if err != nil {
+        return 0, nil, err
+    }
+    defer cursor.Close(ctx)
+
+    var messages []*models.Message
+    if err := cursor.All(ctx, &messages); err != nil {
+        return 0, nil, err
+    }
+
+    for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+        messages[i], messages[j] = messages[j], messages[i]
+    }
+
+    return count, messages, nil
+}
@@ -0,0 +1,240 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"gochat-server/internal/models"
+	"gochat-server/internal/queue"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// TypeMessageFanout tasks turn one chat message into notifications for
+	// the room's offline members.
+	TypeMessageFanout = "notification:message_fanout"
+
+	// TypeMessageNotification tasks are never processed individually: they
+	// are grouped per user and aggregated into a single TypeEmailNotification.
+	TypeMessageNotification = "email:message_notification"
+)
+
+// NotificationService turns chat activity into notification emails according
+// to each user's preferences.
+type NotificationService struct {
+	preferenceService *PreferenceService
+	profileService    *ProfileService
+	membershipService *MembershipService
+	userService       *UserService
+	emailService      *EmailService
+	queue             *queue.Manager
+}
+
+func NewNotificationService(
+	preferenceService *PreferenceService,
+	profileService *ProfileService,
+	membershipService *MembershipService,
+	userService *UserService,
+	emailService *EmailService,
+) *NotificationService {
+	return &NotificationService{
+		preferenceService: preferenceService,
+		profileService:    profileService,
+		membershipService: membershipService,
+		userService:       userService,
+		emailService:      emailService,
+	}
+}
+
+// RegisterJobs registers the message fan-out and the per-user batching of
+// message notifications.
+func (s *NotificationService) RegisterJobs(q *queue.Manager) {
+	s.queue = q
+	q.Register(queue.Job{
+		Type:     TypeMessageFanout,
+		Queue:    queue.QueueDefault,
+		MaxRetry: 3,
+		Handler:  queue.Handle(s.fanOut),
+	})
+	q.Register(queue.Job{
+		Type:      TypeMessageNotification,
+		Queue:     queue.QueueDefault,
+		Aggregate: aggregateMessageNotifications,
+	})
+}
+
+// QueueMessageFanout schedules notification emails for a message. The member,
+// preference and profile lookups happen in the worker, so this is a single
+// enqueue and cheap enough for the hub to call for every message.
+func (s *NotificationService) QueueMessageFanout(ctx context.Context, fanout *models.MessageFanout) error {
+	_, err := s.queue.Enqueue(ctx, TypeMessageFanout, fanout)
+	return err
+}
+
+// fanOut queues a notification for each offline mentioned user and for each
+// offline room member who wants emails for all messages. Mentioned users only
+// get the mention, not the same message twice.
+func (s *NotificationService) fanOut(ctx context.Context, fanout *models.MessageFanout) error {
+	members, err := s.membershipService.GetMembers(ctx, fanout.RoomID)
+	if err != nil {
+		return err
+	}
+
+	mentioned := make(map[string]bool, len(fanout.Mentioned))
+	recipients := make([]string, 0, len(fanout.Mentioned)+len(members))
+	for _, userID := range fanout.Mentioned {
+		mentioned[userID] = true
+		recipients = append(recipients, userID)
+	}
+	for _, userID := range members {
+		if userID == fanout.UserID || mentioned[userID] || s.userService.IsUserOnline(userID) {
+			continue
+		}
+		recipients = append(recipients, userID)
+	}
+
+	if len(recipients) == 0 {
+		return nil
+	}
+
+	prefs, err := s.preferenceService.GetPreferencesFor(ctx, recipients)
+	if err != nil {
+		return err
+	}
+
+	profiles, err := s.profileService.GetProfiles(ctx, recipients)
+	if err != nil {
+		return err
+	}
+
+	// Retrying after some were queued would send those twice, so failures
+	// for one user are only logged
+	for _, profile := range profiles {
+		if profile.Email == "" {
+			continue
+		}
+
+		notification := &models.MessageNotification{
+			UserID:    profile.ID,
+			Email:     profile.Email,
+			RoomID:    fanout.RoomID,
+			RoomName:  fanout.RoomName,
+			Username:  fanout.Username,
+			Content:   fanout.Content,
+			Mentioned: mentioned[profile.ID],
+			Timestamp: fanout.Timestamp,
+		}
+
+		if err := s.queueNotification(ctx, notification, prefs[profile.ID]); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"user_id":    profile.ID,
+				"message_id": fanout.MessageID,
+			}).Error("Failed to queue message notification: ", err)
+		}
+	}
+
+	return nil
+}
+
+// queueNotification emails an offline user about a message if prefs allow
+// it. Mentions go out on their own; other messages are added to the user's
+// pending batch so messages arriving close together are sent as one email.
+// During quiet hours delivery is deferred until they end.
+func (s *NotificationService) queueNotification(ctx context.Context, notification *models.MessageNotification, prefs *models.NotificationPreferences) error {
+	if !s.preferenceService.WantsEmail(prefs, notification.RoomID, notification.Mentioned) {
+		return nil
+	}
+
+	var opts []queue.EnqueueOption
+	if until := s.preferenceService.QuietUntil(prefs, time.Now()); !until.IsZero() {
+		opts = append(opts, queue.At(until))
+	}
+
+	if notification.Mentioned {
+		_, err := s.emailService.QueueEmail(ctx, &models.EmailPayload{
+			To:       notification.Email,
+			UserID:   notification.UserID,
+			RoomID:   notification.RoomID,
+			Template: TemplateMention,
+			Data: map[string]interface{}{
+				"Username": notification.Username,
+				"RoomName": notification.RoomName,
+				"Content":  notification.Content,
+			},
+		}, opts...)
+		return err
+	}
+
+	opts = append(opts, queue.InGroup("user:"+notification.UserID))
+	_, err := s.queue.Enqueue(ctx, TypeMessageNotification, notification, opts...)
+	return err
+}
+
+// aggregateMessageNotifications folds a user's batched message notifications
+// into one email.
+func aggregateMessageNotifications(group string, payloads [][]byte) (string, interface{}) {
+	var (
+		to     string
+		userID string
+		rooms  []string
+		byRoom = make(map[string][]*models.MessageNotification)
+		names  = make(map[string]string)
+	)
+
+	for _, data := range payloads {
+		var n models.MessageNotification
+		if err := json.Unmarshal(data, &n); err != nil {
+			logrus.Error("Dropping malformed message notification: ", err)
+			continue
+		}
+
+		to = n.Email
+		userID = n.UserID
+		if _, ok := byRoom[n.RoomID]; !ok {
+			rooms = append(rooms, n.RoomID)
+			names[n.RoomID] = n.RoomName
+		}
+		byRoom[n.RoomID] = append(byRoom[n.RoomID], &n)
+	}
+
+	if len(rooms) == 0 {
+		// Nothing usable in the batch; the empty payload is rejected as
+		// permanent and lands in the dead-letter archive.
+		return TypeEmailNotification, &models.EmailPayload{}
+	}
+
+	count := 0
+	sections := make([]map[string]interface{}, 0, len(rooms))
+	for _, roomID := range rooms {
+		messages := make([]map[string]interface{}, 0, len(byRoom[roomID]))
+		for _, n := range byRoom[roomID] {
+			messages = append(messages, map[string]interface{}{
+				"Username": n.Username,
+				"Content":  n.Content,
+			})
+		}
+		count += len(messages)
+		sections = append(sections, map[string]interface{}{
+			"Name":     names[roomID],
+			"Messages": messages,
+		})
+	}
+
+	payload := &models.EmailPayload{
+		To:       to,
+		UserID:   userID,
+		Template: TemplateNewMessage,
+		Data: map[string]interface{}{
+			"Rooms":  sections,
+			"Count":  count,
+			"Plural": count > 1,
+		},
+	}
+	if len(rooms) == 1 {
+		payload.RoomID = rooms[0]
+	}
+
+	return TypeEmailNotification, payload
+}
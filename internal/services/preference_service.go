@@ -0,0 +1,259 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gochat-server/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrInvalidPreferences = errors.New("invalid notification preferences")
+
+type PreferenceService struct {
+	collection *mongo.Collection
+}
+
+func NewPreferenceService(db *mongo.Database) *PreferenceService {
+	return &PreferenceService{
+		collection: db.Collection("notification_preferences"),
+	}
+}
+
+func (s *PreferenceService) GetPreferences(ctx context.Context, userID string) (*models.NotificationPreferences, error) {
+	prefs := &models.NotificationPreferences{}
+	err := s.collection.FindOne(ctx, bson.M{"_id": userID}).Decode(prefs)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return defaultPreferences(userID), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return prefs, nil
+}
+
+// GetPreferencesFor returns preferences for each of userIDs, using the
+// defaults for users who never saved any.
+func (s *PreferenceService) GetPreferencesFor(ctx context.Context, userIDs []string) (map[string]*models.NotificationPreferences, error) {
+	result := make(map[string]*models.NotificationPreferences, len(userIDs))
+	for _, userID := range userIDs {
+		result[userID] = defaultPreferences(userID)
+	}
+
+	cursor, err := s.collection.Find(ctx, bson.M{"_id": bson.M{"$in": userIDs}})
+	if err != nil {
+		return result, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		prefs := &models.NotificationPreferences{}
+		if err := cursor.Decode(prefs); err != nil {
+			return result, err
+		}
+		result[prefs.UserID] = prefs
+	}
+	return result, cursor.Err()
+}
+
+// SavePreferences replaces the user's global settings, keeping room overrides
+// unless prefs carries its own.
+func (s *PreferenceService) SavePreferences(ctx context.Context, prefs *models.NotificationPreferences) error {
+	if err := ValidatePreferences(prefs); err != nil {
+		return err
+	}
+
+	set := bson.M{
+		"mode":            prefs.Mode,
+		"digest_interval": prefs.DigestInterval,
+		"time_zone":       prefs.TimeZone,
+		"quiet_hours":     prefs.QuietHours,
+	}
+	if prefs.Rooms != nil {
+		set["rooms"] = prefs.Rooms
+	}
+
+	_, err := s.collection.UpdateOne(ctx,
+		bson.M{"_id": prefs.UserID},
+		bson.M{"$set": set},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *PreferenceService) SetRoomPreference(ctx context.Context, userID string, setting *models.RoomNotificationSetting) error {
+	if err := validateMode(setting.Mode, setting.DigestInterval); err != nil {
+		return err
+	}
+
+	prefs, err := s.GetPreferences(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	rooms := []models.RoomNotificationSetting{*setting}
+	for _, room := range prefs.Rooms {
+		if room.RoomID != setting.RoomID {
+			rooms = append(rooms, room)
+		}
+	}
+
+	_, err = s.collection.UpdateOne(ctx,
+		bson.M{"_id": userID},
+		bson.M{
+			"$set":         bson.M{"rooms": rooms},
+			"$setOnInsert": bson.M{"mode": models.NotifyAll},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *PreferenceService) ClearRoomPreference(ctx context.Context, userID, roomID string) error {
+	_, err := s.collection.UpdateOne(ctx,
+		bson.M{"_id": userID},
+		bson.M{"$pull": bson.M{"rooms": bson.M{"room_id": roomID}}},
+	)
+	return err
+}
+
+// FindDigestSubscribers returns users who get interval digests globally or for any room.
+func (s *PreferenceService) FindDigestSubscribers(ctx context.Context, interval string) ([]*models.NotificationPreferences, error) {
+	cursor, err := s.collection.Find(ctx, bson.M{"$or": bson.A{
+		bson.M{"mode": models.NotifyDigest, "digest_interval": interval},
+		bson.M{"rooms": bson.M{"$elemMatch": bson.M{"mode": models.NotifyDigest, "digest_interval": interval}}},
+	}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var prefs []*models.NotificationPreferences
+	if err := cursor.All(ctx, &prefs); err != nil {
+		return nil, err
+	}
+	return prefs, nil
+}
+
+// ModeFor returns the effective mode and digest interval for a room.
+func (s *PreferenceService) ModeFor(prefs *models.NotificationPreferences, roomID string) (string, string) {
+	for _, room := range prefs.Rooms {
+		if room.RoomID == roomID {
+			return room.Mode, room.DigestInterval
+		}
+	}
+	return prefs.Mode, prefs.DigestInterval
+}
+
+// WantsEmail reports whether a message in roomID should be emailed right away.
+// Digest users are covered by the digest job instead.
+func (s *PreferenceService) WantsEmail(prefs *models.NotificationPreferences, roomID string, mentioned bool) bool {
+	mode, _ := s.ModeFor(prefs, roomID)
+	switch mode {
+	case models.NotifyAll:
+		return true
+	case models.NotifyMentions:
+		return mentioned
+	default:
+		return false
+	}
+}
+
+// QuietUntil returns when the user's quiet hours end if now falls inside
+// them, or the zero time otherwise.
+func (s *PreferenceService) QuietUntil(prefs *models.NotificationPreferences, now time.Time) time.Time {
+	if prefs.QuietHours == nil {
+		return time.Time{}
+	}
+
+	loc, err := time.LoadLocation(prefs.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	local := now.In(loc)
+
+	start, err1 := clockOn(local, prefs.QuietHours.Start)
+	end, err2 := clockOn(local, prefs.QuietHours.End)
+	if err1 != nil || err2 != nil || start.Equal(end) {
+		return time.Time{}
+	}
+
+	if start.Before(end) {
+		if !local.Before(start) && local.Before(end) {
+			return end
+		}
+		return time.Time{}
+	}
+
+	// Window wraps midnight
+	switch {
+	case !local.Before(start):
+		return end.AddDate(0, 0, 1)
+	case local.Before(end):
+		return end
+	}
+	return time.Time{}
+}
+
+func ValidatePreferences(prefs *models.NotificationPreferences) error {
+	if err := validateMode(prefs.Mode, prefs.DigestInterval); err != nil {
+		return err
+	}
+
+	if prefs.TimeZone != "" {
+		if _, err := time.LoadLocation(prefs.TimeZone); err != nil {
+			return fmt.Errorf("%w: unknown time zone %q", ErrInvalidPreferences, prefs.TimeZone)
+		}
+	}
+
+	if prefs.QuietHours != nil {
+		if _, err := time.Parse("15:04", prefs.QuietHours.Start); err != nil {
+			return fmt.Errorf("%w: quiet_hours.start must be HH:MM", ErrInvalidPreferences)
+		}
+		if _, err := time.Parse("15:04", prefs.QuietHours.End); err != nil {
+			return fmt.Errorf("%w: quiet_hours.end must be HH:MM", ErrInvalidPreferences)
+		}
+	}
+
+	for i := range prefs.Rooms {
+		if err := validateMode(prefs.Rooms[i].Mode, prefs.Rooms[i].DigestInterval); err != nil {
+			return fmt.Errorf("room %s: %w", prefs.Rooms[i].RoomID, err)
+		}
+	}
+
+	return nil
+}
+
+func validateMode(mode, digestInterval string) error {
+	switch mode {
+	case models.NotifyAll, models.NotifyMentions, models.NotifyNone:
+		return nil
+	case models.NotifyDigest:
+		if digestInterval != models.DigestHourly && digestInterval != models.DigestDaily {
+			return fmt.Errorf("%w: digest_interval must be %q or %q", ErrInvalidPreferences, models.DigestHourly, models.DigestDaily)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: invalid mode %q", ErrInvalidPreferences, mode)
+	}
+}
+
+func clockOn(day time.Time, clock string) (time.Time, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Date(day.Year(), day.Month(), day.Day(), t.Hour(), t.Minute(), 0, 0, day.Location()), nil
+}
+
+func defaultPreferences(userID string) *models.NotificationPreferences {
+	return &models.NotificationPreferences{
+		UserID: userID,
+		Mode:   models.NotifyAll,
+	}
+}
@@ -0,0 +1,195 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"gochat-server/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	emailVerificationTokenPrefix = "gcv_"
+
+	// EmailVerificationTTL is how long an email verification link works.
+	EmailVerificationTTL = 24 * time.Hour
+)
+
+var (
+	ErrProfileNotFound          = errors.New("profile not found")
+	ErrInvalidVerificationToken = errors.New("verification link is invalid or has expired")
+)
+
+type ProfileService struct {
+	collection *mongo.Collection
+}
+
+func NewProfileService(db *mongo.Database) *ProfileService {
+	return &ProfileService{
+		collection: db.Collection("users"),
+	}
+}
+
+// Touch records that userID connected under username, creating the profile on first sight.
+func (s *ProfileService) Touch(ctx context.Context, userID, username string) error {
+	now := time.Now()
+	_, err := s.collection.UpdateOne(ctx,
+		bson.M{"_id": userID},
+		bson.M{
+			"$set":         bson.M{"username": username, "last_seen": now},
+			"$setOnInsert": bson.M{"created_at": now},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *ProfileService) GetProfile(ctx context.Context, userID string) (*models.UserProfile, error) {
+	profile := &models.UserProfile{}
+	err := s.collection.FindOne(ctx, bson.M{"_id": userID}).Decode(profile)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrProfileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// UpdateProfile changes the username and, when email is set, starts
+// verifying it. The address only replaces Email once ConfirmEmail is called
+// with the returned token; until then it is kept as PendingEmail. The token is
+// empty when email is empty or already confirmed.
+func (s *ProfileService) UpdateProfile(ctx context.Context, userID, username, email string) (*models.UserProfile, string, error) {
+	set := bson.M{}
+	if username != "" {
+		set["username"] = username
+	}
+
+	var token string
+	if email != "" {
+		current, err := s.GetProfile(ctx, userID)
+		if err != nil && !errors.Is(err, ErrProfileNotFound) {
+			return nil, "", err
+		}
+		if current == nil || !strings.EqualFold(current.Email, email) {
+			var hash string
+			token, hash, err = newToken(emailVerificationTokenPrefix)
+			if err != nil {
+				return nil, "", err
+			}
+			set["pending_email"] = email
+			set["email_verification"] = bson.M{
+				"token_hash": hash,
+				"expires_at": time.Now().Add(EmailVerificationTTL),
+			}
+		}
+	}
+
+	update := bson.M{"$setOnInsert": bson.M{"created_at": time.Now()}}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+
+	profile := &models.UserProfile{}
+	err := s.collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": userID},
+		update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(profile)
+	if err != nil {
+		return nil, "", err
+	}
+	return profile, token, nil
+}
+
+// ConfirmEmail makes the pending address the token was issued for the
+// profile's email.
+func (s *ProfileService) ConfirmEmail(ctx context.Context, token string) (*models.UserProfile, error) {
+	if !strings.HasPrefix(token, emailVerificationTokenPrefix) {
+		return nil, ErrInvalidVerificationToken
+	}
+
+	var pending struct {
+		ID           string `bson:"_id"`
+		PendingEmail string `bson:"pending_email"`
+	}
+	err := s.collection.FindOne(ctx, bson.M{
+		"email_verification.token_hash": hashToken(token),
+		"email_verification.expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&pending)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrInvalidVerificationToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	profile := &models.UserProfile{}
+	err = s.collection.FindOneAndUpdate(ctx,
+		// Only if no newer address was requested since
+		bson.M{"_id": pending.ID, "email_verification.token_hash": hashToken(token)},
+		bson.M{
+			"$set":   bson.M{"email": pending.PendingEmail},
+			"$unset": bson.M{"pending_email": "", "email_verification": ""},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(profile)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrInvalidVerificationToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+func (s *ProfileService) GetProfiles(ctx context.Context, userIDs []string) ([]*models.UserProfile, error) {
+	return s.find(ctx, bson.M{"_id": bson.M{"$in": userIDs}})
+}
+
+// FindMembersByUsernames returns the profiles among userIDs whose username
+// matches one of usernames, ignoring case. Usernames aren't unique, so when
+// several match the same name only the most recently seen is returned.
+func (s *ProfileService) FindMembersByUsernames(ctx context.Context, userIDs, usernames []string) ([]*models.UserProfile, error) {
+	profiles, err := s.find(ctx,
+		bson.M{"_id": bson.M{"$in": userIDs}, "username": bson.M{"$in": usernames}},
+		options.Find().
+			SetCollation(&options.Collation{Locale: "en", Strength: 2}).
+			SetSort(bson.D{{Key: "last_seen", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(profiles))
+	result := profiles[:0]
+	for _, profile := range profiles {
+		name := strings.ToLower(profile.Username)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		result = append(result, profile)
+	}
+	return result, nil
+}
+
+func (s *ProfileService) find(ctx context.Context, filter bson.M, opts ...*options.FindOptions) ([]*models.UserProfile, error) {
+	cursor, err := s.collection.Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var profiles []*models.UserProfile
+	if err := cursor.All(ctx, &profiles); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
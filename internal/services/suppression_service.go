@@ -0,0 +1,93 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	SuppressionBounce      = "bounce"
+	SuppressionComplaint   = "complaint"
+	SuppressionUnsubscribe = "unsubscribe"
+)
+
+type Suppression struct {
+	Email     string    `bson:"_id" json:"email"`
+	Reason    string    `bson:"reason" json:"reason"`
+	Detail    string    `bson:"detail,omitempty" json:"detail,omitempty"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+}
+
+// SuppressionService is the list of addresses we must not email: hard
+// bounces, spam complaints and global opt-outs.
+type SuppressionService struct {
+	collection *mongo.Collection
+}
+
+func NewSuppressionService(db *mongo.Database) *SuppressionService {
+	return &SuppressionService{
+		collection: db.Collection("email_suppressions"),
+	}
+}
+
+func (s *SuppressionService) IsSuppressed(ctx context.Context, email string) (bool, error) {
+	err := s.collection.FindOne(ctx, bson.M{"_id": normalizeEmail(email)}).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// suppressionRank orders reasons by how sure we are the address must not be
+// emailed. A suppression is never replaced by a weaker one, so an unsubscribe
+// can't turn a hard bounce into something a re-subscribe would lift.
+var suppressionRank = map[string]int{
+	SuppressionUnsubscribe: 1,
+	SuppressionComplaint:   2,
+	SuppressionBounce:      3,
+}
+
+func (s *SuppressionService) Suppress(ctx context.Context, email, reason, detail string) error {
+	email = normalizeEmail(email)
+
+	var weaker []string
+	for r, rank := range suppressionRank {
+		if rank <= suppressionRank[reason] {
+			weaker = append(weaker, r)
+		}
+	}
+
+	result, err := s.collection.UpdateOne(ctx,
+		bson.M{"_id": email, "reason": bson.M{"$in": weaker}},
+		bson.M{"$set": bson.M{"reason": reason, "detail": detail}},
+	)
+	if err != nil || result.MatchedCount > 0 {
+		return err
+	}
+
+	// Either not suppressed yet or suppressed for a stronger reason, which
+	// is left as it is
+	_, err = s.collection.UpdateOne(ctx,
+		bson.M{"_id": email},
+		bson.M{"$setOnInsert": bson.M{"reason": reason, "detail": detail, "created_at": time.Now()}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// Lift removes a suppression, but only if it was added for reason. A user
+// re-subscribing must not clear a hard bounce.
+func (s *SuppressionService) Lift(ctx context.Context, email, reason string) error {
+	_, err := s.collection.DeleteOne(ctx, bson.M{"_id": normalizeEmail(email), "reason": reason})
+	return err
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
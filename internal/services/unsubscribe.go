@@ -0,0 +1,57 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+var ErrInvalidUnsubscribeToken = errors.New("invalid unsubscribe token")
+
+// UnsubscribeSigner issues and checks the tokens embedded in unsubscribe
+// links. A token names a user and optionally a room; without a room it
+// unsubscribes the user from everything.
+type UnsubscribeSigner struct {
+	secret []byte
+}
+
+func NewUnsubscribeSigner(secret []byte) *UnsubscribeSigner {
+	return &UnsubscribeSigner{secret: secret}
+}
+
+func (s *UnsubscribeSigner) Sign(userID, roomID string) string {
+	payload := []byte(userID + "\n" + roomID)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(s.mac(payload))
+}
+
+func (s *UnsubscribeSigner) Verify(token string) (userID, roomID string, err error) {
+	encodedPayload, encodedMAC, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", "", ErrInvalidUnsubscribeToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return "", "", ErrInvalidUnsubscribeToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(encodedMAC)
+	if err != nil || !hmac.Equal(mac, s.mac(payload)) {
+		return "", "", ErrInvalidUnsubscribeToken
+	}
+
+	userID, roomID, _ = strings.Cut(string(payload), "\n")
+	if userID == "" {
+		return "", "", ErrInvalidUnsubscribeToken
+	}
+	return userID, roomID, nil
+}
+
+func (s *UnsubscribeSigner) mac(payload []byte) []byte {
+	h := hmac.New(sha256.New, s.secret)
+	h.Write([]byte("unsubscribe:"))
+	h.Write(payload)
+	return h.Sum(nil)
+}
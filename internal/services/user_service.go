@@ -61,6 +61,18 @@ func (s *UserService) GetUserClients(userID, roomID string) []interface{} {
 	return nil
 }
 
+// GetAllUserClients returns the user's clients across every room they are connected to.
+func (s *UserService) GetAllUserClients(userID string) []interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var clients []interface{}
+	for _, roomClients := range s.userClients[userID] {
+		clients = append(clients, roomClients...)
+	}
+	return clients
+}
+
 func (s *UserService) IsUserOnline(userID string) bool {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -0,0 +1,425 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"gochat-server/internal/metrics"
+	"gochat-server/internal/models"
+	"gochat-server/internal/queue"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Webhook events
+const (
+	WebhookMessageCreated = "message.created"
+	WebhookUserJoined     = "user.joined"
+	WebhookUserLeft       = "user.left"
+
+	// WebhookMessageUpdated is sent when the server enriches a stored
+	// message, so far by attaching link previews. It is not a user's edit.
+	WebhookMessageUpdated = "message.updated"
+
+	// Users can't edit or delete messages or react to them yet. These events
+	// can already be subscribed to, but nothing sends them until those
+	// features exist.
+	WebhookMessageEdited   = "message.edited"
+	WebhookMessageDeleted  = "message.deleted"
+	WebhookReactionAdded   = "reaction.added"
+	WebhookReactionRemoved = "reaction.removed"
+
+	// WebhookTest is only sent by Test and can't be subscribed to.
+	WebhookTest = "webhook.test"
+)
+
+// WebhookEvents lists the events a webhook can subscribe to; "*" subscribes
+// to all of them.
+var WebhookEvents = []string{
+	WebhookMessageCreated,
+	WebhookMessageUpdated,
+	WebhookMessageEdited,
+	WebhookMessageDeleted,
+	WebhookReactionAdded,
+	WebhookReactionRemoved,
+	WebhookUserJoined,
+	WebhookUserLeft,
+}
+
+// Headers sent with every delivery. The signature is
+// "sha256=" + hex(HMAC-SHA256(secret, timestamp + "." + body)).
+const (
+	WebhookEventHeader     = "X-GoChat-Event"
+	WebhookDeliveryHeader  = "X-GoChat-Delivery"
+	WebhookTimestampHeader = "X-GoChat-Timestamp"
+	WebhookSignatureHeader = "X-GoChat-Signature"
+)
+
+const (
+	TypeWebhookDelivery = "webhook:deliver"
+
+	webhookTimeout       = 10 * time.Second
+	webhookMaxRetry      = 8
+	webhookMaxRetryDelay = time.Hour
+
+	// Delivery log entries expire after this long
+	webhookDeliveryRetention = 30 * 24 * time.Hour
+)
+
+var (
+	ErrWebhookNotFound     = errors.New("webhook not found")
+	ErrInvalidWebhookURL   = errors.New("webhook URL must be an absolute http or https URL")
+	ErrUnknownWebhookEvent = errors.New("unknown webhook event")
+)
+
+// WebhookService manages per-room webhook subscriptions and delivers signed
+// event payloads to them through the job queue, logging every attempt.
+type WebhookService struct {
+	webhooks   *mongo.Collection
+	deliveries *mongo.Collection
+	client     *http.Client
+	queue      *queue.Manager
+}
+
+type webhookDeliveryPayload struct {
+	WebhookID string          `json:"webhook_id"`
+	EventID   string          `json:"event_id"`
+	Event     string          `json:"event"`
+	Body      json.RawMessage `json:"body"`
+}
+
+func NewWebhookService(db *mongo.Database) *WebhookService {
+	return &WebhookService{
+		webhooks:   db.Collection("webhooks"),
+		deliveries: db.Collection("webhook_deliveries"),
+		client:     &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+// EnsureIndexes creates the indexes the delivery log relies on, including
+// the TTL index that keeps it from growing without bound.
+func (s *WebhookService) EnsureIndexes(ctx context.Context) error {
+	_, err := s.deliveries.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "webhook_id", Value: 1}, {Key: "timestamp", Value: -1}}},
+		{
+			Keys:    bson.D{{Key: "timestamp", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(webhookDeliveryRetention.Seconds())),
+		},
+	})
+	return err
+}
+
+// RegisterJobs registers the delivery job. Failed deliveries are retried
+// with exponential backoff.
+func (s *WebhookService) RegisterJobs(q *queue.Manager) {
+	s.queue = q
+	q.Register(queue.Job{
+		Type:       TypeWebhookDelivery,
+		Queue:      queue.QueueDefault,
+		MaxRetry:   webhookMaxRetry,
+		Timeout:    2 * webhookTimeout,
+		RetryDelay: webhookRetryDelay,
+		Handler:    queue.Handle(s.deliver),
+	})
+}
+
+// webhookRetryDelay doubles from 10s up to an hour: 10s, 20s, 40s, ...
+func webhookRetryDelay(retried int, _ error) time.Duration {
+	if retried > 12 {
+		return webhookMaxRetryDelay
+	}
+	return min(10*time.Second<<retried, webhookMaxRetryDelay)
+}
+
+// CreateWebhook subscribes rawURL to events in roomID and generates its
+// signing secret.
+func (s *WebhookService) CreateWebhook(ctx context.Context, roomID, rawURL string, events []string) (*models.Webhook, error) {
+	defer metrics.ObserveMongo("create_webhook", time.Now())
+
+	target, err := url.Parse(rawURL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, ErrInvalidWebhookURL
+	}
+	for _, event := range events {
+		if event != "*" && !slices.Contains(WebhookEvents, event) {
+			return nil, fmt.Errorf("%w %q", ErrUnknownWebhookEvent, event)
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	webhook := &models.Webhook{
+		ID:        primitive.NewObjectID(),
+		RoomID:    roomID,
+		URL:       target.String(),
+		Events:    events,
+		Secret:    "whsec_" + hex.EncodeToString(secret),
+		CreatedAt: time.Now(),
+	}
+	if _, err := s.webhooks.InsertOne(ctx, webhook); err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+func (s *WebhookService) ListWebhooks(ctx context.Context, roomID string) ([]*models.Webhook, error) {
+	defer metrics.ObserveMongo("list_webhooks", time.Now())
+
+	cursor, err := s.webhooks.Find(ctx, bson.M{"room_id": roomID}, options.Find().SetSort(bson.M{"created_at": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	webhooks := []*models.Webhook{}
+	if err := cursor.All(ctx, &webhooks); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+func (s *WebhookService) GetWebhook(ctx context.Context, id string) (*models.Webhook, error) {
+	defer metrics.ObserveMongo("get_webhook", time.Now())
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrWebhookNotFound
+	}
+
+	webhook := &models.Webhook{}
+	err = s.webhooks.FindOne(ctx, bson.M{"_id": objectID}).Decode(webhook)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrWebhookNotFound
+	}
+	return webhook, err
+}
+
+// DeleteWebhook removes the webhook and its delivery log. Deliveries already
+// queued are dropped.
+func (s *WebhookService) DeleteWebhook(ctx context.Context, id string) error {
+	defer metrics.ObserveMongo("delete_webhook", time.Now())
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrWebhookNotFound
+	}
+
+	result, err := s.webhooks.DeleteOne(ctx, bson.M{"_id": objectID})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrWebhookNotFound
+	}
+
+	_, err = s.deliveries.DeleteMany(ctx, bson.M{"webhook_id": objectID})
+	return err
+}
+
+// Deliveries returns the webhook's most recent delivery attempts, newest first.
+func (s *WebhookService) Deliveries(ctx context.Context, id string, limit int64) ([]*models.WebhookDelivery, error) {
+	defer metrics.ObserveMongo("find_webhook_deliveries", time.Now())
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrWebhookNotFound
+	}
+
+	opts := options.Find().SetSort(bson.M{"timestamp": -1}).SetLimit(limit)
+	cursor, err := s.deliveries.Find(ctx, bson.M{"webhook_id": objectID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	deliveries := []*models.WebhookDelivery{}
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// Dispatch queues a delivery of event to every webhook in roomID subscribed
+// to it. The payload is built once, so retries send the same body.
+func (s *WebhookService) Dispatch(ctx context.Context, roomID, event string, data interface{}) error {
+	start := time.Now()
+	cursor, err := s.webhooks.Find(ctx, bson.M{
+		"room_id": roomID,
+		"events":  bson.M{"$in": []string{event, "*"}},
+	})
+	if err != nil {
+		return err
+	}
+	var webhooks []*models.Webhook
+	err = cursor.All(ctx, &webhooks)
+	metrics.ObserveMongo("find_webhooks_for_event", start)
+	if err != nil || len(webhooks) == 0 {
+		return err
+	}
+
+	eventID := primitive.NewObjectID().Hex()
+	body, err := json.Marshal(&models.WebhookEvent{
+		ID:        eventID,
+		Event:     event,
+		RoomID:    roomID,
+		Data:      data,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, webhook := range webhooks {
+		_, err := s.queue.Enqueue(ctx, TypeWebhookDelivery, &webhookDeliveryPayload{
+			WebhookID: webhook.ID.Hex(),
+			EventID:   eventID,
+			Event:     event,
+			Body:      body,
+		}, queue.UniqueKey(webhook.ID.Hex()+":"+eventID))
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (s *WebhookService) deliver(ctx context.Context, payload *webhookDeliveryPayload) error {
+	webhook, err := s.GetWebhook(ctx, payload.WebhookID)
+	if errors.Is(err, ErrWebhookNotFound) {
+		// Deleted since the event was queued
+		return queue.Permanent(err)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = s.send(ctx, webhook, payload.EventID, payload.Event, payload.Body, queue.Retried(ctx)+1)
+	return err
+}
+
+// Test sends a webhook.test event to the webhook straight away, without
+// retries, and returns the logged attempt.
+func (s *WebhookService) Test(ctx context.Context, id string) (*models.WebhookDelivery, error) {
+	webhook, err := s.GetWebhook(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	eventID := primitive.NewObjectID().Hex()
+	body, err := json.Marshal(&models.WebhookEvent{
+		ID:     eventID,
+		Event:  WebhookTest,
+		RoomID: webhook.RoomID,
+		Data: map[string]interface{}{
+			"webhook_id": webhook.ID.Hex(),
+		},
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	delivery, _ := s.send(ctx, webhook, eventID, WebhookTest, body, 1)
+	return delivery, nil
+}
+
+// send makes one delivery attempt and logs it. Client errors other than 408
+// and 429 won't be fixed by retrying, so they are permanent.
+func (s *WebhookService) send(ctx context.Context, webhook *models.Webhook, eventID, event string, body []byte, attempt int) (*models.WebhookDelivery, error) {
+	delivery := &models.WebhookDelivery{
+		WebhookID: webhook.ID,
+		EventID:   eventID,
+		Event:     event,
+		Attempt:   attempt,
+		Timestamp: time.Now(),
+	}
+
+	err := s.post(ctx, webhook, eventID, event, body, delivery)
+	delivery.DurationMs = time.Since(delivery.Timestamp).Milliseconds()
+	delivery.Success = err == nil
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+
+	logCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if _, logErr := s.deliveries.InsertOne(logCtx, delivery); logErr != nil {
+		logrus.Error("Failed to log webhook delivery: ", logErr)
+	}
+	metrics.ObserveMongo("log_webhook_delivery", start)
+
+	fields := logrus.Fields{
+		"webhook_id": webhook.ID.Hex(),
+		"event":      event,
+		"event_id":   eventID,
+		"attempt":    attempt,
+	}
+	if err != nil {
+		logrus.WithFields(fields).WithField("error", err.Error()).Warn("Webhook delivery failed")
+	} else {
+		logrus.WithFields(fields).Info("Webhook delivered")
+	}
+
+	code := delivery.StatusCode
+	if code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests {
+		err = queue.Permanent(err)
+	}
+	return delivery, err
+}
+
+func (s *WebhookService) post(ctx context.Context, webhook *models.Webhook, eventID, event string, body []byte, delivery *models.WebhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "GoChat-Webhook/1.0")
+	req.Header.Set(WebhookEventHeader, event)
+	req.Header.Set(WebhookDeliveryHeader, eventID)
+	req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(webhook.Secret, timestamp, body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	delivery.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+// SignWebhook returns the signature header value for body sent at timestamp.
+// Receivers recompute it with their copy of the secret to verify a delivery.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
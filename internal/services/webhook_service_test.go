@@ -0,0 +1,170 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"gochat-server/internal/models"
+	"gochat-server/internal/queue"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestSignWebhook(t *testing.T) {
+	body := []byte(`{"event":"message.created"}`)
+
+	mac := hmac.New(sha256.New, []byte("whsec_test"))
+	mac.Write([]byte("1700000000."))
+	mac.Write(body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	if got := SignWebhook("whsec_test", 1700000000, body); got != want {
+		t.Errorf("SignWebhook = %q, want %q", got, want)
+	}
+	if SignWebhook("whsec_other", 1700000000, body) == want {
+		t.Error("signature doesn't depend on the secret")
+	}
+	if SignWebhook("whsec_test", 1700000001, body) == want {
+		t.Error("signature doesn't depend on the timestamp")
+	}
+}
+
+func TestSendSignsDelivery(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("headers", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+		body := []byte(`{"id":"evt1"}`)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ := io.ReadAll(r.Body)
+			timestamp, err := strconv.ParseInt(r.Header.Get(WebhookTimestampHeader), 10, 64)
+			if err != nil {
+				t.Errorf("bad %s header: %v", WebhookTimestampHeader, err)
+			}
+			if sig := r.Header.Get(WebhookSignatureHeader); sig != SignWebhook("whsec_test", timestamp, got) {
+				t.Errorf("signature %q doesn't verify", sig)
+			}
+			if r.Header.Get(WebhookEventHeader) != WebhookMessageCreated {
+				t.Errorf("%s = %q", WebhookEventHeader, r.Header.Get(WebhookEventHeader))
+			}
+			if r.Header.Get(WebhookDeliveryHeader) != "evt1" {
+				t.Errorf("%s = %q", WebhookDeliveryHeader, r.Header.Get(WebhookDeliveryHeader))
+			}
+		}))
+		defer srv.Close()
+
+		webhook := &models.Webhook{ID: primitive.NewObjectID(), URL: srv.URL, Secret: "whsec_test"}
+		if _, err := NewWebhookService(mt.DB).send(context.Background(), webhook, "evt1", WebhookMessageCreated, body, 1); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	})
+}
+
+func TestSendClassifiesFailures(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	tests := []struct {
+		status    int
+		fails     bool
+		permanent bool
+	}{
+		{http.StatusOK, false, false},
+		{http.StatusNoContent, false, false},
+		{http.StatusBadRequest, true, true},
+		{http.StatusGone, true, true},
+		{http.StatusRequestTimeout, true, false},
+		{http.StatusTooManyRequests, true, false},
+		{http.StatusInternalServerError, true, false},
+		{http.StatusServiceUnavailable, true, false},
+	}
+
+	for _, tt := range tests {
+		mt.Run(strconv.Itoa(tt.status), func(mt *mtest.T) {
+			mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			webhook := &models.Webhook{ID: primitive.NewObjectID(), URL: srv.URL, Secret: "whsec_test"}
+			delivery, err := NewWebhookService(mt.DB).send(context.Background(), webhook, "evt1", WebhookUserJoined, []byte(`{}`), 3)
+
+			if (err != nil) != tt.fails {
+				t.Fatalf("send error = %v, want failure %v", err, tt.fails)
+			}
+			if got := errors.Is(err, queue.ErrPermanent); got != tt.permanent {
+				t.Errorf("permanent = %v, want %v", got, tt.permanent)
+			}
+			if delivery.StatusCode != tt.status || delivery.Success == tt.fails {
+				t.Errorf("delivery = %+v", delivery)
+			}
+
+			// The attempt is written to the delivery log
+			started := mt.GetStartedEvent()
+			if started == nil || started.CommandName != "insert" {
+				t.Fatalf("want the attempt inserted, got %+v", started)
+			}
+			if coll := started.Command.Lookup("insert").StringValue(); coll != "webhook_deliveries" {
+				t.Errorf("inserted into %q", coll)
+			}
+			doc := started.Command.Lookup("documents").Array().Index(0).Value().Document()
+			if doc.Lookup("webhook_id").ObjectID() != webhook.ID {
+				t.Errorf("logged webhook_id = %v", doc.Lookup("webhook_id"))
+			}
+			if doc.Lookup("attempt").AsInt64() != 3 {
+				t.Errorf("logged attempt = %v", doc.Lookup("attempt"))
+			}
+			if doc.Lookup("status_code").AsInt64() != int64(tt.status) {
+				t.Errorf("logged status_code = %v", doc.Lookup("status_code"))
+			}
+			if doc.Lookup("success").Boolean() == tt.fails {
+				t.Errorf("logged success = %v", doc.Lookup("success"))
+			}
+		})
+	}
+}
+
+func TestSendRetriesNetworkErrors(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("unreachable", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+		srv := httptest.NewServer(http.NotFoundHandler())
+		url := srv.URL
+		srv.Close()
+
+		webhook := &models.Webhook{ID: primitive.NewObjectID(), URL: url, Secret: "whsec_test"}
+		delivery, err := NewWebhookService(mt.DB).send(context.Background(), webhook, "evt1", WebhookUserLeft, []byte(`{}`), 1)
+		if err == nil || errors.Is(err, queue.ErrPermanent) {
+			t.Fatalf("send error = %v, want a retryable error", err)
+		}
+		if delivery.Error == "" {
+			t.Error("delivery doesn't record the error")
+		}
+	})
+}
+
+func TestCreateWebhookRejectsUnknownEvents(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("unknown", func(mt *mtest.T) {
+		for _, event := range []string{"message.pinned", "reaction", WebhookTest} {
+			_, err := NewWebhookService(mt.DB).CreateWebhook(context.Background(), "general", "https://example.com/hook", []string{event})
+			if !errors.Is(err, ErrUnknownWebhookEvent) {
+				t.Errorf("CreateWebhook(%q) error = %v, want ErrUnknownWebhookEvent", event, err)
+			}
+		}
+	})
+}
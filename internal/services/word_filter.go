@@ -0,0 +1,46 @@
+package services
+
+import (
+	"regexp"
+	"strings"
+)
+
+var wordPattern = regexp.MustCompile(`[\pL\pN_]+`)
+
+// WordFilter masks banned words in message content. A nil *WordFilter masks
+// nothing.
+type WordFilter struct {
+	banned map[string]bool
+}
+
+// NewWordFilter matches each word whole and case-insensitively. It returns
+// nil for an empty list.
+func NewWordFilter(words []string) *WordFilter {
+	banned := make(map[string]bool, len(words))
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			banned[strings.ToLower(word)] = true
+		}
+	}
+	if len(banned) == 0 {
+		return nil
+	}
+	return &WordFilter{banned: banned}
+}
+
+// Censor replaces every banned word in s with asterisks and reports whether
+// anything was masked.
+func (f *WordFilter) Censor(s string) (string, bool) {
+	if f == nil {
+		return s, false
+	}
+	masked := false
+	s = wordPattern.ReplaceAllStringFunc(s, func(word string) string {
+		if !f.banned[strings.ToLower(word)] {
+			return word
+		}
+		masked = true
+		return strings.Repeat("*", len([]rune(word)))
+	})
+	return s, masked
+}